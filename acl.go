@@ -0,0 +1,894 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ACL 命令类别
+const (
+	ACL_CATEGORY_KEYSPACE    uint64 = 1 << 0
+	ACL_CATEGORY_READ        uint64 = 1 << 1
+	ACL_CATEGORY_WRITE       uint64 = 1 << 2
+	ACL_CATEGORY_SET         uint64 = 1 << 3
+	ACL_CATEGORY_SORTEDSET   uint64 = 1 << 4
+	ACL_CATEGORY_LIST        uint64 = 1 << 5
+	ACL_CATEGORY_HASH        uint64 = 1 << 6
+	ACL_CATEGORY_STRING      uint64 = 1 << 7
+	ACL_CATEGORY_BITMAP      uint64 = 1 << 8
+	ACL_CATEGORY_HYPERLOGLOG uint64 = 1 << 9
+	ACL_CATEGORY_GEO         uint64 = 1 << 10
+	ACL_CATEGORY_STREAM      uint64 = 1 << 11
+	ACL_CATEGORY_PUBSUB      uint64 = 1 << 12
+	ACL_CATEGORY_ADMIN       uint64 = 1 << 13
+	ACL_CATEGORY_FAST        uint64 = 1 << 14
+	ACL_CATEGORY_SLOW        uint64 = 1 << 15
+	ACL_CATEGORY_BLOCKING    uint64 = 1 << 16
+	ACL_CATEGORY_DANGEROUS   uint64 = 1 << 17
+	ACL_CATEGORY_CONNECTION  uint64 = 1 << 18
+	ACL_CATEGORY_TRANSACTION uint64 = 1 << 19
+	ACL_CATEGORY_SCRIPTING   uint64 = 1 << 20
+)
+
+var aclCategoryNames = []struct {
+	name string
+	flag uint64
+}{
+	{"keyspace", ACL_CATEGORY_KEYSPACE},
+	{"read", ACL_CATEGORY_READ},
+	{"write", ACL_CATEGORY_WRITE},
+	{"set", ACL_CATEGORY_SET},
+	{"sortedset", ACL_CATEGORY_SORTEDSET},
+	{"list", ACL_CATEGORY_LIST},
+	{"hash", ACL_CATEGORY_HASH},
+	{"string", ACL_CATEGORY_STRING},
+	{"bitmap", ACL_CATEGORY_BITMAP},
+	{"hyperloglog", ACL_CATEGORY_HYPERLOGLOG},
+	{"geo", ACL_CATEGORY_GEO},
+	{"stream", ACL_CATEGORY_STREAM},
+	{"pubsub", ACL_CATEGORY_PUBSUB},
+	{"admin", ACL_CATEGORY_ADMIN},
+	{"fast", ACL_CATEGORY_FAST},
+	{"slow", ACL_CATEGORY_SLOW},
+	{"blocking", ACL_CATEGORY_BLOCKING},
+	{"dangerous", ACL_CATEGORY_DANGEROUS},
+	{"connection", ACL_CATEGORY_CONNECTION},
+	{"transaction", ACL_CATEGORY_TRANSACTION},
+	{"scripting", ACL_CATEGORY_SCRIPTING},
+}
+
+func aclGetCategoryByName(name string) (uint64, bool) {
+	for _, c := range aclCategoryNames {
+		if c.name == strings.ToLower(name) {
+			return c.flag, true
+		}
+	}
+	return 0, false
+}
+
+// 权限检查的结果
+const (
+	ACL_OK             int = 0
+	ACL_DENIED_CMD     int = 1
+	ACL_DENIED_KEY     int = 2
+	ACL_DENIED_AUTH    int = 3
+	ACL_DENIED_CHANNEL int = 4
+)
+
+const DEFAULT_ACLLOG_MAX_LEN int = 128
+
+// ACL_LOG_GROUPING_MAX_TIME_DELTA 相同的拒绝记录在该时间(ms)内合并为一条
+const ACL_LOG_GROUPING_MAX_TIME_DELTA int64 = 60000
+
+var (
+	ACL_SYNTAX_ERR          = errors.New("Syntax error")
+	ACL_UNKNOWN_CMD_ERR     = errors.New("Unknown command or category name in ACL")
+	ACL_NO_SUCH_PASS_ERR    = errors.New("The password you are trying to remove from the user does not exist")
+	ACL_INVALID_HASH_ERR    = errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+	ACL_FIRST_ARG_ALLOW_ERR = errors.New("Allowing first-arg of a subcommand is not supported")
+)
+
+type AclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords []string //sha256的16进制
+
+	allcommands      bool            //+@all，包括之后新增的命令
+	allowedCommands  map[string]bool //命令名
+	allowedFirstArgs map[string][]string
+	cmdRules         []string //按设置顺序记录的命令规则，用于ACL LIST/GETUSER
+
+	keyPatterns     []string
+	channelPatterns []string
+}
+
+func createAclUser(name string) *AclUser {
+	return &AclUser{
+		name:             name,
+		allowedCommands:  make(map[string]bool),
+		allowedFirstArgs: make(map[string][]string),
+	}
+}
+
+func (u *AclUser) dup() *AclUser {
+	nu := *u
+	nu.passwords = append([]string(nil), u.passwords...)
+	nu.allowedCommands = make(map[string]bool, len(u.allowedCommands))
+	for k, v := range u.allowedCommands {
+		nu.allowedCommands[k] = v
+	}
+	nu.allowedFirstArgs = make(map[string][]string, len(u.allowedFirstArgs))
+	for k, v := range u.allowedFirstArgs {
+		nu.allowedFirstArgs[k] = append([]string(nil), v...)
+	}
+	nu.cmdRules = append([]string(nil), u.cmdRules...)
+	nu.keyPatterns = append([]string(nil), u.keyPatterns...)
+	nu.channelPatterns = append([]string(nil), u.channelPatterns...)
+	return &nu
+}
+
+func aclHashPassword(password string) string {
+	h := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(h[:])
+}
+
+func isValidPasswordHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range []byte(hash) {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *AclUser) addPassword(hash string) {
+	for _, p := range u.passwords {
+		if p == hash {
+			return
+		}
+	}
+	u.passwords = append(u.passwords, hash)
+	u.nopass = false
+}
+
+func (u *AclUser) removePassword(hash string) error {
+	for i, p := range u.passwords {
+		if p == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return nil
+		}
+	}
+	return ACL_NO_SUCH_PASS_ERR
+}
+
+// checkPassword 与所有密码逐个做常数时间比较，不提前返回
+func (u *AclUser) checkPassword(password string) bool {
+	if u.nopass {
+		return true
+	}
+	hash := []byte(aclHashPassword(password))
+	ok := false
+	for _, p := range u.passwords {
+		if subtle.ConstantTimeCompare(hash, []byte(p)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// addCmdRule 同一对象之前的规则会被完全覆盖，可以直接去掉
+func (u *AclUser) addCmdRule(rule string) {
+	target := rule[1:]
+	rules := u.cmdRules[:0]
+	for _, r := range u.cmdRules {
+		if r[1:] != target {
+			rules = append(rules, r)
+		}
+	}
+	u.cmdRules = append(rules, rule)
+}
+
+func (u *AclUser) setCommand(server *GodisServer, name string, allow bool) {
+	if u.allcommands && !allow {
+		// 从全部命令中去掉某些命令，先展开成具体的命令
+		u.allcommands = false
+		for name := range server.commands {
+			u.allowedCommands[name] = true
+		}
+	}
+	if allow {
+		u.allowedCommands[name] = true
+	} else {
+		delete(u.allowedCommands, name)
+	}
+	delete(u.allowedFirstArgs, name)
+}
+
+func (u *AclUser) setAllCommands(allow bool) {
+	u.allcommands = allow
+	u.allowedCommands = make(map[string]bool)
+	u.allowedFirstArgs = make(map[string][]string)
+	u.cmdRules = nil
+}
+
+// setRule 对应ACL SETUSER的一个规则
+func (u *AclUser) setRule(server *GodisServer, rule string) error {
+	lower := strings.ToLower(rule)
+	switch {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass = true
+		u.passwords = nil
+	case lower == "resetpass":
+		u.nopass = false
+		u.passwords = nil
+	case lower == "allkeys":
+		u.keyPatterns = []string{"*"}
+	case lower == "resetkeys":
+		u.keyPatterns = nil
+	case lower == "allchannels":
+		u.channelPatterns = []string{"*"}
+	case lower == "resetchannels":
+		u.channelPatterns = nil
+	case lower == "allcommands" || lower == "+@all":
+		u.setAllCommands(true)
+		u.cmdRules = []string{"+@all"}
+	case lower == "nocommands" || lower == "-@all":
+		u.setAllCommands(false)
+		u.cmdRules = []string{"-@all"}
+	case lower == "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"} {
+			u.setRule(server, r)
+		}
+	case rule[0] == '>':
+		u.addPassword(aclHashPassword(rule[1:]))
+	case rule[0] == '<':
+		return u.removePassword(aclHashPassword(rule[1:]))
+	case rule[0] == '#':
+		if !isValidPasswordHash(rule[1:]) {
+			return ACL_INVALID_HASH_ERR
+		}
+		u.addPassword(rule[1:])
+	case rule[0] == '!':
+		if !isValidPasswordHash(rule[1:]) {
+			return ACL_INVALID_HASH_ERR
+		}
+		return u.removePassword(rule[1:])
+	case rule[0] == '~':
+		if u.keyPatterns == nil || u.keyPatterns[0] != "*" {
+			u.keyPatterns = append(u.keyPatterns, rule[1:])
+		}
+		if rule[1:] == "*" {
+			u.keyPatterns = []string{"*"}
+		}
+	case rule[0] == '&':
+		if u.channelPatterns == nil || u.channelPatterns[0] != "*" {
+			u.channelPatterns = append(u.channelPatterns, rule[1:])
+		}
+		if rule[1:] == "*" {
+			u.channelPatterns = []string{"*"}
+		}
+	case len(rule) > 2 && (rule[0] == '+' || rule[0] == '-') && rule[1] == '@':
+		flag, ok := aclGetCategoryByName(rule[2:])
+		if !ok {
+			return ACL_UNKNOWN_CMD_ERR
+		}
+		for name, cmd := range server.commands {
+			if cmd.aclCategories&flag != 0 {
+				u.setCommand(server, name, rule[0] == '+')
+			}
+		}
+		u.addCmdRule(lower)
+	case len(rule) > 1 && (rule[0] == '+' || rule[0] == '-'):
+		name, arg, hasArg := strings.Cut(lower[1:], "|")
+		if server.lookupCommand(name) == nil {
+			return ACL_UNKNOWN_CMD_ERR
+		}
+		if !hasArg {
+			u.setCommand(server, name, rule[0] == '+')
+		} else if rule[0] == '+' && arg != "" && !strings.Contains(arg, "|") {
+			if !u.allcommands && !u.allowedCommands[name] {
+				u.allowedFirstArgs[name] = append(u.allowedFirstArgs[name], arg)
+			}
+		} else if rule[0] == '-' {
+			return ACL_FIRST_ARG_ALLOW_ERR
+		} else {
+			return ACL_SYNTAX_ERR
+		}
+		u.addCmdRule(lower)
+	default:
+		return ACL_SYNTAX_ERR
+	}
+	return nil
+}
+
+func (u *AclUser) describeCommands() string {
+	rules := u.cmdRules
+	if len(rules) == 0 || (rules[0] != "+@all" && rules[0] != "-@all") {
+		rules = append([]string{"-@all"}, rules...)
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *AclUser) describeKeys() string {
+	var keys []string
+	for _, p := range u.keyPatterns {
+		keys = append(keys, "~"+p)
+	}
+	return strings.Join(keys, " ")
+}
+
+func (u *AclUser) describeChannels() string {
+	if len(u.channelPatterns) == 0 {
+		return "resetchannels"
+	}
+	var channels []string
+	for _, p := range u.channelPatterns {
+		channels = append(channels, "&"+p)
+	}
+	return strings.Join(channels, " ")
+}
+
+// describe 生成的规则可以被ACL SETUSER与aclfile重新加载
+func (u *AclUser) describe() string {
+	parts := []string{"user", u.name}
+	if u.enabled {
+		parts = append(parts, "on")
+	} else {
+		parts = append(parts, "off")
+	}
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	for _, p := range u.passwords {
+		parts = append(parts, "#"+p)
+	}
+	if keys := u.describeKeys(); keys != "" {
+		parts = append(parts, keys)
+	}
+	parts = append(parts, u.describeChannels(), u.describeCommands())
+	return strings.Join(parts, " ")
+}
+
+func (u *AclUser) canRunCommand(cmd *GodisCommand, args []*GObj) bool {
+	if u.allcommands || u.allowedCommands[cmd.name] {
+		return true
+	}
+	if len(args) > 1 {
+		arg := strings.ToLower(args[1].StrVal())
+		for _, a := range u.allowedFirstArgs[cmd.name] {
+			if a == arg {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (u *AclUser) canAccessKey(key string) bool {
+	for _, p := range u.keyPatterns {
+		if stringMatch(p, key, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessChannel 对于PSUBSCRIBE，pattern必须与用户的某个pattern完全相同
+func (u *AclUser) canAccessChannel(channel string, isPattern bool) bool {
+	for _, p := range u.channelPatterns {
+		if p == "*" || (isPattern && p == channel) || (!isPattern && stringMatch(p, channel, false)) {
+			return true
+		}
+	}
+	return false
+}
+
+// getKeysFromCommand 返回args中是key的参数下标
+func getKeysFromCommand(cmd *GodisCommand, args []*GObj) []int {
+	if cmd.firstKey == 0 {
+		return nil
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last = len(args) + last
+	}
+	var keys []int
+	for i := cmd.firstKey; i <= last && i < len(args); i += cmd.keyStep {
+		keys = append(keys, i)
+	}
+	return keys
+}
+
+// aclCheckCommandPerm 返回检查结果，被拒绝时还返回拒绝的对象(命令名、key或channel)
+// user为nil表示不受限制，如master连接
+func (server *GodisServer) aclCheckCommandPerm(u *AclUser, cmd *GodisCommand, args []*GObj) (int, string) {
+	if u == nil {
+		return ACL_OK, ""
+	}
+	// 未认证也能执行的命令(AUTH、HELLO等)不检查命令权限，否则无法切换用户
+	if cmd.flags&CMD_NO_AUTH == 0 && !u.canRunCommand(cmd, args) {
+		return ACL_DENIED_CMD, cmd.name
+	}
+	for _, i := range getKeysFromCommand(cmd, args) {
+		if !u.canAccessKey(args[i].StrVal()) {
+			return ACL_DENIED_KEY, args[i].StrVal()
+		}
+	}
+	channels, isPattern := server.getChannelsFromCommand(cmd, args)
+	for _, ch := range channels {
+		if !u.canAccessChannel(ch.StrVal(), isPattern) {
+			return ACL_DENIED_CHANNEL, ch.StrVal()
+		}
+	}
+	return ACL_OK, ""
+}
+
+func aclDeniedReply(u *AclUser, cmd *GodisCommand, result int) string {
+	switch result {
+	case ACL_DENIED_CMD:
+		return fmt.Sprintf("-NOPERM User %s has no permissions to run the '%s' command\r\n", u.name, cmd.name)
+	case ACL_DENIED_KEY:
+		return "-NOPERM No permissions to access a key\r\n"
+	case ACL_DENIED_CHANNEL:
+		return "-NOPERM No permissions to access a channel\r\n"
+	}
+	return "-NOPERM\r\n"
+}
+
+type AclLogEntry struct {
+	id       int64
+	count    int64
+	reason   int
+	context  string
+	object   string
+	username string
+	ctime    int64 //ms
+	utime    int64 //ms
+	cinfo    string
+}
+
+func aclReasonString(reason int) string {
+	switch reason {
+	case ACL_DENIED_CMD:
+		return "command"
+	case ACL_DENIED_KEY:
+		return "key"
+	case ACL_DENIED_AUTH:
+		return "auth"
+	case ACL_DENIED_CHANNEL:
+		return "channel"
+	}
+	return "unknown"
+}
+
+// addACLLogEntry 记录被拒绝的命令或认证失败，与最近的相同记录合并
+func (server *GodisServer) addACLLogEntry(c *GodisClient, reason int, object, username string) {
+	now := GetMsTime()
+	cinfo := strings.TrimSuffix(catClientInfoString(c), "\n")
+	for i, e := range server.aclLog {
+		if e.reason == reason && e.object == object && e.username == username &&
+			now-e.utime <= ACL_LOG_GROUPING_MAX_TIME_DELTA {
+			e.count++
+			e.utime = now
+			e.cinfo = cinfo
+			copy(server.aclLog[1:i+1], server.aclLog[:i])
+			server.aclLog[0] = e
+			return
+		}
+	}
+	e := &AclLogEntry{
+		id:       server.aclLogEntryId,
+		count:    1,
+		reason:   reason,
+		context:  "toplevel",
+		object:   object,
+		username: username,
+		ctime:    now,
+		utime:    now,
+		cinfo:    cinfo,
+	}
+	server.aclLogEntryId++
+	server.aclLog = append([]*AclLogEntry{e}, server.aclLog...)
+	if len(server.aclLog) > server.aclLogMaxLen {
+		server.aclLog = server.aclLog[:server.aclLogMaxLen]
+	}
+}
+
+// authRequired default用户没有密码时新连接无需认证
+func (server *GodisServer) authRequired(c *GodisClient) bool {
+	u := server.defaultUser
+	return (!u.nopass || !u.enabled) && !c.authenticated
+}
+
+// checkUserPassword 校验用户名密码，失败时记录客户端地址
+func (server *GodisServer) checkUserPassword(c *GodisClient, username, password string) bool {
+	u := server.users[username]
+	if u != nil && u.enabled && u.checkPassword(password) {
+		c.user = u
+		c.authenticated = true
+		return true
+	}
+	log.Printf("auth failed for client %v, user: %v\n", c.addr, username)
+	server.addACLLogEntry(c, ACL_DENIED_AUTH, "AUTH", username)
+	return false
+}
+
+func (server *GodisServer) initAcl(config *Config) error {
+	server.users = make(map[string]*AclUser)
+	server.defaultUser = createAclUser(DEFAULT_USERNAME)
+	for _, r := range []string{"+@all", "~*", "&*", "on", "nopass"} {
+		server.defaultUser.setRule(server, r)
+	}
+	if config.RequirePass != "" {
+		server.defaultUser.setRule(server, "resetpass")
+		server.defaultUser.setRule(server, ">"+config.RequirePass)
+	}
+	server.users[DEFAULT_USERNAME] = server.defaultUser
+	server.aclLog = nil
+	server.aclLogMaxLen = DEFAULT_ACLLOG_MAX_LEN
+	if config.AclLogMaxLen != nil {
+		server.aclLogMaxLen = *config.AclLogMaxLen
+	}
+	server.aclfile = config.AclFile
+	if server.aclfile != "" {
+		return server.aclLoadFromFile()
+	}
+	return nil
+}
+
+// parseAclFile 每行格式为 user <name> <rule> ...
+func (server *GodisServer) parseAclFile(path string) (map[string]*AclUser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	users := make(map[string]*AclUser)
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: line should start with user keyword", path, lineno)
+		}
+		if users[fields[1]] != nil {
+			return nil, fmt.Errorf("%s:%d: duplicate user '%s' found", path, lineno, fields[1])
+		}
+		u := createAclUser(fields[1])
+		for _, rule := range fields[2:] {
+			if err := u.setRule(server, rule); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v. Use ACL SETUSER %s ... to check the rule '%s'", path, lineno, err, fields[1], rule)
+			}
+		}
+		users[u.name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// aclLoadFromFile 加载失败时保留原有的用户，已删除用户的连接会被关闭
+func (server *GodisServer) aclLoadFromFile() error {
+	users, err := server.parseAclFile(server.aclfile)
+	if err != nil {
+		return err
+	}
+	if users[DEFAULT_USERNAME] == nil {
+		users[DEFAULT_USERNAME] = server.defaultUser.dup()
+	}
+	for name, u := range users {
+		// 保持已认证客户端持有的指针有效
+		if old := server.users[name]; old != nil {
+			*old = *u
+			users[name] = old
+		}
+	}
+	old := server.users
+	server.users = users
+	server.defaultUser = users[DEFAULT_USERNAME]
+	for name, u := range old {
+		if users[name] == nil {
+			server.disconnectAllClientsOfUser(u)
+		}
+	}
+	return nil
+}
+
+func (server *GodisServer) aclSaveToFile() error {
+	var buf strings.Builder
+	for _, u := range server.sortedUsers() {
+		buf.WriteString(u.describe())
+		buf.WriteString("\n")
+	}
+	tmp := fmt.Sprintf("%s.tmp-%d", server.aclfile, os.Getpid())
+	if err := os.WriteFile(tmp, []byte(buf.String()), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, server.aclfile); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// sortedUsers default用户在前，其余按名字排序
+func (server *GodisServer) sortedUsers() []*AclUser {
+	users := []*AclUser{server.defaultUser}
+	var names []string
+	for name := range server.users {
+		if name != DEFAULT_USERNAME {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		users = append(users, server.users[name])
+	}
+	return users
+}
+
+func (server *GodisServer) disconnectAllClientsOfUser(u *AclUser) {
+	for e := server.clientList.Front(); e != nil; e = e.Next() {
+		c := e.Value.(*GodisClient)
+		if c.user == u {
+			server.closeClientAfterReply(c)
+		}
+	}
+}
+
+func (server *GodisServer) aclCommand(c *GodisClient) {
+	if len(c.args) < 2 {
+		server.AddReplyStr(c, "-ERR wrong number of arguments for 'acl' command\r\n")
+		return
+	}
+	sub := strings.ToLower(c.args[1].StrVal())
+	switch {
+	case sub == "setuser" && len(c.args) >= 3:
+		server.aclSetUserCommand(c)
+	case sub == "getuser" && len(c.args) == 3:
+		server.aclGetUserCommand(c)
+	case sub == "deluser" && len(c.args) >= 3:
+		server.aclDelUserCommand(c)
+	case sub == "list" && len(c.args) == 2:
+		var lines []string
+		for _, u := range server.sortedUsers() {
+			lines = append(lines, u.describe())
+		}
+		server.AddReplyStr(c, addReplyBulkArray(lines))
+	case sub == "users" && len(c.args) == 2:
+		var names []string
+		for _, u := range server.sortedUsers() {
+			names = append(names, u.name)
+		}
+		server.AddReplyStr(c, addReplyBulkArray(names))
+	case sub == "whoami" && len(c.args) == 2:
+		if c.user == nil {
+			server.AddReplyStr(c, "$-1\r\n")
+		} else {
+			server.AddReplyBulk(c, c.user.name)
+		}
+	case sub == "cat" && len(c.args) <= 3:
+		server.aclCatCommand(c)
+	case sub == "dryrun" && len(c.args) >= 4:
+		server.aclDryRunCommand(c)
+	case sub == "log" && len(c.args) <= 3:
+		server.aclLogCommand(c)
+	case sub == "load" && len(c.args) == 2:
+		if server.aclfile == "" {
+			server.AddReplyStr(c, "-ERR This Redis instance is not configured to use an ACL file.\r\n")
+			return
+		}
+		if err := server.aclLoadFromFile(); err != nil {
+			server.AddReplyStr(c, fmt.Sprintf("-ERR Error loading ACLs: %v\r\n", err))
+			return
+		}
+		server.AddReplyStr(c, "+OK\r\n")
+	case sub == "save" && len(c.args) == 2:
+		if server.aclfile == "" {
+			server.AddReplyStr(c, "-ERR This Redis instance is not configured to use an ACL file.\r\n")
+			return
+		}
+		if err := server.aclSaveToFile(); err != nil {
+			log.Printf("save acl file error: %v\n", err)
+			server.AddReplyStr(c, "-ERR There was an error trying to save the ACLs. Please check the server logs for more information\r\n")
+			return
+		}
+		server.AddReplyStr(c, "+OK\r\n")
+	default:
+		server.AddReplyStr(c, fmt.Sprintf("-ERR unknown subcommand or wrong number of arguments for '%s'. Try ACL HELP.\r\n", c.args[1].StrVal()))
+	}
+}
+
+// ACL SETUSER username [rule ...]，规则全部合法时才生效
+func (server *GodisServer) aclSetUserCommand(c *GodisClient) {
+	name := c.args[2].StrVal()
+	old := server.users[name]
+	var u *AclUser
+	if old != nil {
+		u = old.dup()
+	} else {
+		u = createAclUser(name)
+	}
+	for _, arg := range c.args[3:] {
+		rule := arg.StrVal()
+		if rule == "" {
+			server.AddReplyStr(c, fmt.Sprintf("-ERR Error in ACL SETUSER modifier '%s': %v\r\n", rule, ACL_SYNTAX_ERR))
+			return
+		}
+		if err := u.setRule(server, rule); err != nil {
+			server.AddReplyStr(c, fmt.Sprintf("-ERR Error in ACL SETUSER modifier '%s': %v\r\n", rule, err))
+			return
+		}
+	}
+	if old != nil {
+		*old = *u
+	} else {
+		server.users[name] = u
+	}
+	server.AddReplyStr(c, "+OK\r\n")
+}
+
+func (server *GodisServer) aclGetUserCommand(c *GodisClient) {
+	u := server.users[c.args[2].StrVal()]
+	if u == nil {
+		server.AddReplyStr(c, "*-1\r\n")
+		return
+	}
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	var reply strings.Builder
+	reply.WriteString("*12\r\n$5\r\nflags\r\n")
+	reply.WriteString(addReplyBulkArray(flags))
+	reply.WriteString("$9\r\npasswords\r\n")
+	reply.WriteString(addReplyBulkArray(u.passwords))
+	for _, kv := range [][2]string{
+		{"commands", u.describeCommands()},
+		{"keys", u.describeKeys()},
+		{"channels", u.describeChannels()},
+	} {
+		reply.WriteString(fmt.Sprintf("$%d\r\n%s\r\n$%d\r\n%s\r\n", len(kv[0]), kv[0], len(kv[1]), kv[1]))
+	}
+	reply.WriteString("$9\r\nselectors\r\n*0\r\n")
+	server.AddReplyStr(c, reply.String())
+}
+
+func (server *GodisServer) aclDelUserCommand(c *GodisClient) {
+	deleted := 0
+	for _, arg := range c.args[2:] {
+		name := arg.StrVal()
+		if name == DEFAULT_USERNAME {
+			server.AddReplyStr(c, "-ERR The 'default' user cannot be removed\r\n")
+			return
+		}
+	}
+	for _, arg := range c.args[2:] {
+		u := server.users[arg.StrVal()]
+		if u == nil {
+			continue
+		}
+		delete(server.users, u.name)
+		server.disconnectAllClientsOfUser(u)
+		deleted++
+	}
+	server.AddReplyStr(c, fmt.Sprintf(":%d\r\n", deleted))
+}
+
+func (server *GodisServer) aclCatCommand(c *GodisClient) {
+	var names []string
+	if len(c.args) == 2 {
+		for _, cat := range aclCategoryNames {
+			names = append(names, cat.name)
+		}
+	} else {
+		flag, ok := aclGetCategoryByName(c.args[2].StrVal())
+		if !ok {
+			server.AddReplyStr(c, fmt.Sprintf("-ERR Unknown category '%s'\r\n", c.args[2].StrVal()))
+			return
+		}
+		for name, cmd := range server.commands {
+			if cmd.aclCategories&flag != 0 {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+	server.AddReplyStr(c, addReplyBulkArray(names))
+}
+
+// ACL DRYRUN username command [arg ...]
+func (server *GodisServer) aclDryRunCommand(c *GodisClient) {
+	u := server.users[c.args[2].StrVal()]
+	if u == nil {
+		server.AddReplyStr(c, fmt.Sprintf("-ERR User '%s' not found\r\n", c.args[2].StrVal()))
+		return
+	}
+	cmd := server.lookupCommand(strings.ToLower(c.args[3].StrVal()))
+	if cmd == nil {
+		server.AddReplyStr(c, fmt.Sprintf("-ERR Command '%s' not found\r\n", c.args[3].StrVal()))
+		return
+	}
+	args := c.args[3:]
+	if !cmd.checkArity(len(args)) {
+		server.AddReplyStr(c, fmt.Sprintf("-ERR wrong number of arguments for '%s' command\r\n", cmd.name))
+		return
+	}
+	result, object := server.aclCheckCommandPerm(u, cmd, args)
+	switch result {
+	case ACL_OK:
+		server.AddReplyStr(c, "+OK\r\n")
+	case ACL_DENIED_CMD:
+		server.AddReplyBulk(c, fmt.Sprintf("This user has no permissions to run the '%s' command", object))
+	case ACL_DENIED_KEY:
+		server.AddReplyBulk(c, fmt.Sprintf("This user has no permissions to access the '%s' key", object))
+	case ACL_DENIED_CHANNEL:
+		server.AddReplyBulk(c, fmt.Sprintf("This user has no permissions to access the '%s' channel", object))
+	}
+}
+
+// ACL LOG [count | RESET]
+func (server *GodisServer) aclLogCommand(c *GodisClient) {
+	count := 10
+	if len(c.args) == 3 {
+		arg := c.args[2].StrVal()
+		if strings.ToLower(arg) == "reset" {
+			server.aclLog = nil
+			server.AddReplyStr(c, "+OK\r\n")
+			return
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			server.AddReplyStr(c, "-ERR value is out of range, must be positive\r\n")
+			return
+		}
+		count = n
+	}
+	if count > len(server.aclLog) {
+		count = len(server.aclLog)
+	}
+	now := GetMsTime()
+	var reply strings.Builder
+	reply.WriteString(fmt.Sprintf("*%d\r\n", count))
+	for _, e := range server.aclLog[:count] {
+		reply.WriteString("*20\r\n")
+		reply.WriteString(fmt.Sprintf("$5\r\ncount\r\n:%d\r\n", e.count))
+		for _, kv := range [][2]string{
+			{"reason", aclReasonString(e.reason)},
+			{"context", e.context},
+			{"object", e.object},
+			{"username", e.username},
+			{"age-seconds", strconv.FormatFloat(float64(now-e.ctime)/1000, 'f', 3, 64)},
+			{"client-info", e.cinfo},
+		} {
+			reply.WriteString(fmt.Sprintf("$%d\r\n%s\r\n$%d\r\n%s\r\n", len(kv[0]), kv[0], len(kv[1]), kv[1]))
+		}
+		reply.WriteString(fmt.Sprintf("$8\r\nentry-id\r\n:%d\r\n", e.id))
+		reply.WriteString(fmt.Sprintf("$17\r\ntimestamp-created\r\n:%d\r\n", e.ctime))
+		reply.WriteString(fmt.Sprintf("$22\r\ntimestamp-last-updated\r\n:%d\r\n", e.utime))
+	}
+	server.AddReplyStr(c, reply.String())
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStringMatch(t *testing.T) {
+	assert.True(t, stringMatch("*", "", false))
+	assert.True(t, stringMatch("cache:*", "cache:user:1", false))
+	assert.False(t, stringMatch("cache:*", "session:1", false))
+	assert.True(t, stringMatch("h?llo", "hello", false))
+	assert.False(t, stringMatch("h?llo", "hllo", false))
+	assert.True(t, stringMatch("h[ae]llo", "hallo", false))
+	assert.False(t, stringMatch("h[^e]llo", "hello", false))
+	assert.True(t, stringMatch("h[a-b]llo", "hbllo", false))
+	assert.True(t, stringMatch("h\\*llo", "h*llo", false))
+	assert.False(t, stringMatch("h\\*llo", "hello", false))
+	assert.True(t, stringMatch("HELLO*", "hello world", true))
+	assert.False(t, stringMatch("HELLO*", "hello world", false))
+	assert.True(t, stringMatch("a*b*c", "axxbyyc", false))
+	assert.False(t, stringMatch("a*b*c", "axxbyy", false))
+	assert.True(t, stringMatch("*llo*wor?d", "hello hello world", false))
+	assert.True(t, stringMatch("[a-c]*\\?", "b?", false))
+	assert.False(t, stringMatch("[a-c]*\\?", "bx", false))
+	// 多个*不会指数级回溯
+	str := strings.Repeat("a", 64)
+	assert.False(t, stringMatch(strings.Repeat("a*", 32)+"b", str, false))
+}
+
+func TestAcl(t *testing.T) {
+	conf := Config{AclFile: filepath.Join(t.TempDir(), "users.acl")}
+	assert.Nil(t, os.WriteFile(conf.AclFile, []byte("user default on nopass ~* &* +@all\n"), 0644))
+	assert.Nil(t, server.initServer(&conf))
+	admin := newTestClient(t, "127.0.0.1", 6000)
+	c := newTestClient(t, "127.0.0.1", 6001)
+
+	assert.Equal(t, "$7\r\ndefault\r\n", runQuery(t, admin, "acl whoami\r\n"))
+	assert.Equal(t, "+OK\r\n", runQuery(t, admin, "acl setuser svc on >secret ~cache:* +@read -@dangerous +set +acl|whoami\r\n"))
+	assert.Contains(t, runQuery(t, admin, "acl setuser svc +nosuchcmd\r\n"), "-ERR Error in ACL SETUSER modifier '+nosuchcmd'")
+	assert.Contains(t, runQuery(t, admin, "acl setuser svc ~x #abc\r\n"), "-ERR Error in ACL SETUSER modifier '#abc'")
+	// 规则有误时整条命令不生效
+	assert.Equal(t, []string{"cache:*"}, server.users["svc"].keyPatterns)
+
+	list := runQuery(t, admin, "acl list\r\n")
+	assert.Contains(t, list, "user default on nopass ~* &* +@all\r\n")
+	assert.Contains(t, list, "user svc on #"+aclHashPassword("secret")+" ~cache:* resetchannels -@all +@read -@dangerous +set +acl|whoami\r\n")
+	getuser := runQuery(t, admin, "acl getuser svc\r\n")
+	assert.Contains(t, getuser, "$8\r\ncommands\r\n$41\r\n-@all +@read -@dangerous +set +acl|whoami\r\n")
+	assert.Contains(t, getuser, "$4\r\nkeys\r\n$8\r\n~cache:*\r\n")
+	assert.Equal(t, "*-1\r\n", runQuery(t, admin, "acl getuser nobody\r\n"))
+	assert.Contains(t, runQuery(t, admin, "acl cat\r\n"), "$9\r\nsortedset\r\n")
+	assert.Contains(t, runQuery(t, admin, "acl cat list\r\n"), "$5\r\nlpush\r\n")
+	assert.Contains(t, runQuery(t, admin, "acl cat foo\r\n"), "-ERR Unknown category 'foo'")
+
+	assert.Equal(t, "+OK\r\n", runQuery(t, admin, "acl dryrun svc get cache:1\r\n"))
+	assert.Equal(t, "$54\r\nThis user has no permissions to access the 'other' key\r\n", runQuery(t, admin, "acl dryrun svc get other\r\n"))
+	assert.Contains(t, runQuery(t, admin, "acl dryrun svc lpush cache:1 a\r\n"), "no permissions to run the 'lpush' command")
+	assert.Contains(t, runQuery(t, admin, "acl dryrun svc info\r\n"), "no permissions to run the 'info' command")
+
+	// 以svc登录后只能访问自己的key
+	assert.Contains(t, runQuery(t, c, "auth svc wrong\r\n"), "-WRONGPASS")
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "auth svc secret\r\n"))
+	assert.Equal(t, "$3\r\nsvc\r\n", runQuery(t, c, "acl whoami\r\n"))
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "set cache:1 v\r\n"))
+	assert.Equal(t, "$1\r\nv\r\n", runQuery(t, c, "get cache:1\r\n"))
+	assert.Equal(t, "-NOPERM No permissions to access a key\r\n", runQuery(t, c, "get other\r\n"))
+	assert.Equal(t, "-NOPERM User svc has no permissions to run the 'lpush' command\r\n", runQuery(t, c, "lpush cache:2 a\r\n"))
+	assert.Equal(t, "-NOPERM No permissions to access a key\r\n", runQuery(t, c, "get other\r\n"))
+
+	log := runQuery(t, admin, "acl log\r\n")
+	assert.True(t, strings.HasPrefix(log, "*3\r\n*20\r\n$5\r\ncount\r\n:2\r\n$6\r\nreason\r\n$3\r\nkey\r\n"))
+	assert.Contains(t, log, "$6\r\nreason\r\n$4\r\nauth\r\n")
+	assert.Contains(t, log, "$6\r\nobject\r\n$5\r\nlpush\r\n")
+	assert.Equal(t, "*1\r\n", runQuery(t, admin, "acl log 1\r\n")[:4])
+	assert.Equal(t, "+OK\r\n", runQuery(t, admin, "acl log reset\r\n"))
+	assert.Equal(t, "*0\r\n", runQuery(t, admin, "acl log\r\n"))
+
+	// 保存后重新加载，已删除用户的连接被关闭
+	assert.Equal(t, "+OK\r\n", runQuery(t, admin, "acl save\r\n"))
+	data, err := os.ReadFile(conf.AclFile)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "user svc on #")
+	assert.Equal(t, "+OK\r\n", runQuery(t, admin, "acl setuser svc off\r\n"))
+	assert.Equal(t, "+OK\r\n", runQuery(t, admin, "acl load\r\n"))
+	assert.True(t, server.users["svc"].enabled)
+	assert.Equal(t, server.users["svc"], c.user)
+	assert.Contains(t, runQuery(t, admin, "acl deluser default\r\n"), "-ERR The 'default' user cannot be removed")
+	assert.Equal(t, ":1\r\n", runQuery(t, admin, "acl deluser svc nobody\r\n"))
+	assert.NotEqual(t, 0, c.flags&CLIENT_CLOSE_ASAP)
+	server.beforeSleep(server.aeloop)
+	assert.Nil(t, server.clients[c.fd])
+
+	assert.Nil(t, os.WriteFile(conf.AclFile, []byte("user svc on +nosuchcmd\n"), 0644))
+	assert.Contains(t, runQuery(t, admin, "acl load\r\n"), "-ERR Error loading ACLs")
+
+	// 没有权限的用户仍可以执行AUTH、HELLO切换用户
+	assert.Equal(t, "+OK\r\n", runQuery(t, admin, "acl setuser bob on >pw -@all +get\r\n"))
+	bob := newTestClient(t, "127.0.0.1", 6002)
+	assert.Equal(t, "+OK\r\n", runQuery(t, bob, "auth bob pw\r\n"))
+	assert.Contains(t, runQuery(t, bob, "acl whoami\r\n"), "-NOPERM")
+	assert.Contains(t, runQuery(t, bob, "hello 2\r\n"), "$6\r\nserver\r\n")
+	assert.Equal(t, "+OK\r\n", runQuery(t, bob, "auth default x\r\n"))
+	assert.Equal(t, "$7\r\ndefault\r\n", runQuery(t, bob, "acl whoami\r\n"))
+	server.freeClient(bob)
+	server.freeClient(admin)
+}
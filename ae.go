@@ -22,6 +22,7 @@ const (
 
 type FileProc func(loop *AeLoop, fd int, extra interface{})
 type TimeProc func(loop *AeLoop, id int, extra interface{})
+type BeforeSleepProc func(loop *AeLoop)
 
 type AeFileEvent struct {
 	fd    int
@@ -46,6 +47,7 @@ type AeLoop struct {
 	fileEventFd     int
 	timeEventNextId int
 	stop            bool
+	beforeSleep     BeforeSleepProc
 }
 
 var fe2ep [3]uint32 = [3]uint32{0, unix.EPOLLIN, unix.EPOLLOUT}
@@ -228,8 +230,16 @@ func (loop *AeLoop) AeProcess(tes []*AeTimeEvent, fes []*AeFileEvent) {
 	}
 }
 
+// SetBeforeSleepProc 设置每次进入epoll_wait前执行的回调
+func (loop *AeLoop) SetBeforeSleepProc(proc BeforeSleepProc) {
+	loop.beforeSleep = proc
+}
+
 func (loop *AeLoop) AeMain() {
 	for loop.stop != true {
+		if loop.beforeSleep != nil {
+			loop.beforeSleep(loop)
+		}
 		tes, fes := loop.AeWait()
 		loop.AeProcess(tes, fes)
 	}
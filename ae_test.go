@@ -30,7 +30,7 @@ func ReadProc(loop *AeLoop, fd int, extra interface{}) {
 }
 
 func AcceptProc(loop *AeLoop, fd int, extra interface{}) {
-	cfd, err := Accept(fd)
+	cfd, _, _, err := Accept(fd)
 	if err != nil {
 		fmt.Printf("accept err: %v\n", err)
 		return
@@ -53,12 +53,11 @@ func NormalProc(loop *AeLoop, id int, extra interface{}) {
 func TestAe(t *testing.T) {
 	loop, err := AeLoopCreate()
 	assert.Nil(t, err)
-	sfd, err := TcpServer(6666)
+	sfd, err := TcpServer("0.0.0.0", 6666)
 	loop.AddFileEvent(sfd, AE_READABLE, AcceptProc, nil)
 	go loop.AeMain()
 	// init client & test file events
-	host := [4]byte{0, 0, 0, 0}
-	cfd, err := Connect(host, 6666)
+	cfd, err := Connect("127.0.0.1", 6666)
 	assert.Nil(t, err)
 	msg := "helloworld"
 	n, err := Write(cfd, []byte(msg))
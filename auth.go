@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	GODIS_VERSION    string = "1.0.0"
+	DEFAULT_USERNAME string = "default"
+)
+
+// AUTH [username] password
+func (server *GodisServer) authCommand(c *GodisClient) {
+	if len(c.args) < 2 || len(c.args) > 3 {
+		server.AddReplyStr(c, "-ERR wrong number of arguments for 'auth' command\r\n")
+		return
+	}
+	username := DEFAULT_USERNAME
+	password := c.args[1].StrVal()
+	if len(c.args) == 3 {
+		username = c.args[1].StrVal()
+		password = c.args[2].StrVal()
+	}
+	// 密码不出现在MONITOR的输出中
+	for i := 1; i < len(c.args); i++ {
+		redactClientCommandArgument(c, i)
+	}
+	if len(c.args) == 2 && server.defaultUser.nopass {
+		server.AddReplyStr(c, "-ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?\r\n")
+		return
+	}
+	if !server.checkUserPassword(c, username, password) {
+		server.AddReplyStr(c, "-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+		return
+	}
+	server.AddReplyStr(c, "+OK\r\n")
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+// RESP3只用于推送消息，普通回复与RESP2相同
+func (server *GodisServer) helloCommand(c *GodisClient) {
+	ver := c.resp
+	if len(c.args) >= 2 {
+		var err error
+		ver, err = strconv.Atoi(c.args[1].StrVal())
+		if err != nil {
+			server.AddReplyStr(c, "-ERR Protocol version is not an integer or out of range\r\n")
+			return
+		}
+		if ver != 2 && ver != 3 {
+			server.AddReplyStr(c, "-NOPROTO unsupported protocol version\r\n")
+			return
+		}
+	}
+	var name string
+	setname := false
+	for i := 2; i < len(c.args); i++ {
+		opt := strings.ToLower(c.args[i].StrVal())
+		if opt == "auth" && i+2 < len(c.args) {
+			username, password := c.args[i+1].StrVal(), c.args[i+2].StrVal()
+			redactClientCommandArgument(c, i+1)
+			redactClientCommandArgument(c, i+2)
+			if !server.checkUserPassword(c, username, password) {
+				server.AddReplyStr(c, "-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+				return
+			}
+			i += 2
+		} else if opt == "setname" && i+1 < len(c.args) {
+			name = c.args[i+1].StrVal()
+			setname = true
+			i++
+		} else {
+			server.AddReplyStr(c, fmt.Sprintf("-ERR Syntax error in HELLO option '%s'\r\n", c.args[i].StrVal()))
+			return
+		}
+	}
+	if server.authRequired(c) {
+		server.AddReplyStr(c, "-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time\r\n")
+		return
+	}
+	if setname {
+		if !validClientName(name) {
+			server.AddReplyStr(c, "-ERR Client names cannot contain spaces, newlines or special characters.\r\n")
+			return
+		}
+		c.name = name
+	}
+	c.resp = ver
+
+	var reply strings.Builder
+	if c.resp == 3 {
+		reply.WriteString("%7\r\n")
+	} else {
+		reply.WriteString("*14\r\n")
+	}
+	for _, kv := range [][2]string{
+		{"server", "godis"},
+		{"version", GODIS_VERSION},
+	} {
+		reply.WriteString(fmt.Sprintf("$%d\r\n%s\r\n$%d\r\n%s\r\n", len(kv[0]), kv[0], len(kv[1]), kv[1]))
+	}
+	reply.WriteString(fmt.Sprintf("$5\r\nproto\r\n:%d\r\n$2\r\nid\r\n:%d\r\n", c.resp, c.id))
+	reply.WriteString("$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n")
+	server.AddReplyStr(c, reply.String())
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func getClientFlagsString(c *GodisClient) string {
+	var flags strings.Builder
+	if c.flags&CLIENT_SLAVE != 0 {
+		flags.WriteByte('S')
+	}
+	if c.flags&CLIENT_MASTER != 0 {
+		flags.WriteByte('M')
+	}
+	if c.flags&CLIENT_MONITOR != 0 {
+		flags.WriteByte('O')
+	}
+	if c.flags&CLIENT_PUBSUB != 0 {
+		flags.WriteByte('P')
+	}
+	if c.flags&CLIENT_BLOCKED != 0 {
+		flags.WriteByte('b')
+	}
+	if c.flags&CLIENT_CLOSE_AFTER_REPLY != 0 {
+		flags.WriteByte('c')
+	}
+	if c.flags&CLIENT_CLOSE_ASAP != 0 {
+		flags.WriteByte('A')
+	}
+	if c.flags&CLIENT_NO_EVICT != 0 {
+		flags.WriteByte('e')
+	}
+	if c.flags&CLIENT_MULTI != 0 {
+		flags.WriteByte('x')
+	}
+	if flags.Len() == 0 {
+		flags.WriteByte('N')
+	}
+	return flags.String()
+}
+
+// validClientName 名字中只能包含可见字符
+func validClientName(name string) bool {
+	for _, ch := range []byte(name) {
+		if ch < '!' || ch > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// catClientInfoString 与redis的CLIENT LIST格式一致
+func catClientInfoString(c *GodisClient) string {
+	now := time.Now().Unix()
+	cmd := "NULL"
+	if c.lastcmd != nil {
+		cmd = c.lastcmd.name
+	}
+	user := "(superuser)"
+	if c.user != nil {
+		user = c.user.name
+	}
+	return fmt.Sprintf("id=%d addr=%s laddr=%s fd=%d name=%s age=%d idle=%d flags=%s db=0 qbuf=%d omem=%d cmd=%s user=%s\n",
+		c.id, c.addr, c.laddr, c.fd, c.name, now-c.ctime, now-c.lastinteraction,
+		getClientFlagsString(c), c.queryLen, c.replyBytes, cmd, user)
+}
+
+func (server *GodisServer) clientCommand(c *GodisClient) {
+	if len(c.args) < 2 {
+		server.AddReplyStr(c, "-ERR wrong number of arguments for 'client' command\r\n")
+		return
+	}
+	sub := strings.ToLower(c.args[1].StrVal())
+	switch {
+	case sub == "id" && len(c.args) == 2:
+		server.AddReplyStr(c, fmt.Sprintf(":%d\r\n", c.id))
+	case sub == "info" && len(c.args) == 2:
+		server.AddReplyBulk(c, catClientInfoString(c))
+	case sub == "list":
+		server.clientListCommand(c)
+	case sub == "setname" && len(c.args) == 3:
+		name := c.args[2].StrVal()
+		if !validClientName(name) {
+			server.AddReplyStr(c, "-ERR Client names cannot contain spaces, newlines or special characters.\r\n")
+			return
+		}
+		c.name = name
+		server.AddReplyStr(c, "+OK\r\n")
+	case sub == "getname" && len(c.args) == 2:
+		if c.name == "" {
+			server.AddReplyStr(c, "$-1\r\n")
+		} else {
+			server.AddReplyBulk(c, c.name)
+		}
+	case sub == "kill" && len(c.args) >= 3:
+		server.clientKillCommand(c)
+	case sub == "pause" && (len(c.args) == 3 || len(c.args) == 4):
+		server.clientPauseCommand(c)
+	case sub == "unpause" && len(c.args) == 2:
+		server.unpauseClients()
+		server.AddReplyStr(c, "+OK\r\n")
+	case sub == "no-evict" && len(c.args) == 3:
+		switch strings.ToLower(c.args[2].StrVal()) {
+		case "on":
+			c.flags |= CLIENT_NO_EVICT
+		case "off":
+			c.flags &= ^CLIENT_NO_EVICT
+		default:
+			server.AddReplyStr(c, "-ERR syntax error\r\n")
+			return
+		}
+		server.AddReplyStr(c, "+OK\r\n")
+	case sub == "tracking" && len(c.args) >= 3:
+		server.clientTrackingCommand(c)
+	case sub == "caching" && len(c.args) == 3:
+		server.clientCachingCommand(c)
+	case sub == "getredir" && len(c.args) == 2:
+		server.clientGetredirCommand(c)
+	case sub == "reply" && len(c.args) == 3:
+		switch strings.ToLower(c.args[2].StrVal()) {
+		case "on":
+			c.flags &= ^(CLIENT_REPLY_OFF | CLIENT_REPLY_SKIP_NEXT)
+			server.AddReplyStr(c, "+OK\r\n")
+		case "off":
+			c.flags |= CLIENT_REPLY_OFF
+		case "skip":
+			if c.flags&CLIENT_REPLY_OFF == 0 {
+				c.flags |= CLIENT_REPLY_SKIP_NEXT
+			}
+		default:
+			server.AddReplyStr(c, "-ERR syntax error\r\n")
+		}
+	default:
+		server.AddReplyStr(c, fmt.Sprintf("-ERR unknown subcommand or wrong number of arguments for '%s'. Try CLIENT HELP.\r\n", c.args[1].StrVal()))
+	}
+}
+
+// CLIENT LIST [TYPE normal|replica|pubsub] [ID id [id ...]]
+func (server *GodisServer) clientListCommand(c *GodisClient) {
+	ctype := -1
+	var ids map[int64]bool
+	if len(c.args) == 4 && strings.ToLower(c.args[2].StrVal()) == "type" {
+		ctype = getClientTypeByName(c.args[3].StrVal())
+		if ctype == -1 {
+			server.AddReplyStr(c, fmt.Sprintf("-ERR Unknown client type '%s'\r\n", c.args[3].StrVal()))
+			return
+		}
+	} else if len(c.args) > 3 && strings.ToLower(c.args[2].StrVal()) == "id" {
+		ids = make(map[int64]bool)
+		for _, arg := range c.args[3:] {
+			id, err := strconv.ParseInt(arg.StrVal(), 10, 64)
+			if err != nil || id <= 0 {
+				server.AddReplyStr(c, "-ERR Invalid client ID\r\n")
+				return
+			}
+			ids[id] = true
+		}
+	} else if len(c.args) != 2 {
+		server.AddReplyStr(c, "-ERR syntax error\r\n")
+		return
+	}
+	var list strings.Builder
+	for e := server.clientList.Front(); e != nil; e = e.Next() {
+		client := e.Value.(*GodisClient)
+		if ctype != -1 && getClientType(client) != ctype {
+			continue
+		}
+		if ids != nil && !ids[client.id] {
+			continue
+		}
+		list.WriteString(catClientInfoString(client))
+	}
+	server.AddReplyBulk(c, list.String())
+}
+
+type clientKillFilter struct {
+	id     int64
+	ctype  int
+	addr   string
+	laddr  string
+	maxage int64
+	skipme bool
+}
+
+func (f *clientKillFilter) match(c *GodisClient, now int64) bool {
+	if f.id != 0 && c.id != f.id {
+		return false
+	}
+	if f.ctype != -1 && getClientType(c) != f.ctype {
+		return false
+	}
+	if f.addr != "" && c.addr != f.addr {
+		return false
+	}
+	if f.laddr != "" && c.laddr != f.laddr {
+		return false
+	}
+	if f.maxage != 0 && now-c.ctime < f.maxage {
+		return false
+	}
+	return true
+}
+
+// CLIENT KILL ip:port
+// CLIENT KILL [ID id] [TYPE type] [ADDR ip:port] [LADDR ip:port] [SKIPME yes|no] [MAXAGE seconds]
+func (server *GodisServer) clientKillCommand(c *GodisClient) {
+	filter := clientKillFilter{ctype: -1, skipme: true}
+	oldStyle := len(c.args) == 3
+	if oldStyle {
+		filter.addr = c.args[2].StrVal()
+		filter.skipme = false
+	} else {
+		if len(c.args)%2 != 0 {
+			server.AddReplyStr(c, "-ERR syntax error\r\n")
+			return
+		}
+		for i := 2; i < len(c.args); i += 2 {
+			opt := strings.ToLower(c.args[i].StrVal())
+			val := c.args[i+1].StrVal()
+			switch opt {
+			case "id":
+				id, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || id <= 0 {
+					server.AddReplyStr(c, "-ERR client-id should be greater than 0\r\n")
+					return
+				}
+				filter.id = id
+			case "type":
+				filter.ctype = getClientTypeByName(val)
+				if filter.ctype == -1 {
+					server.AddReplyStr(c, fmt.Sprintf("-ERR Unknown client type '%s'\r\n", val))
+					return
+				}
+			case "addr":
+				filter.addr = val
+			case "laddr":
+				filter.laddr = val
+			case "maxage":
+				maxage, err := strconv.ParseInt(val, 10, 64)
+				if err != nil || maxage <= 0 {
+					server.AddReplyStr(c, "-ERR syntax error\r\n")
+					return
+				}
+				filter.maxage = maxage
+			case "skipme":
+				switch strings.ToLower(val) {
+				case "yes":
+					filter.skipme = true
+				case "no":
+					filter.skipme = false
+				default:
+					server.AddReplyStr(c, "-ERR syntax error\r\n")
+					return
+				}
+			default:
+				server.AddReplyStr(c, "-ERR syntax error\r\n")
+				return
+			}
+		}
+	}
+
+	now := time.Now().Unix()
+	killed := 0
+	closeMyself := false
+	for e := server.clientList.Front(); e != nil; {
+		client := e.Value.(*GodisClient)
+		e = e.Next() //freeClient会把client从链表中移除
+		if !filter.match(client, now) {
+			continue
+		}
+		if client == c {
+			if filter.skipme {
+				continue
+			}
+			closeMyself = true //先回复再关闭
+		} else {
+			server.freeClient(client)
+		}
+		killed++
+	}
+	if oldStyle {
+		if killed == 0 {
+			server.AddReplyStr(c, "-ERR No such client\r\n")
+		} else {
+			server.AddReplyStr(c, "+OK\r\n")
+		}
+	} else {
+		server.AddReplyStr(c, fmt.Sprintf(":%d\r\n", killed))
+	}
+	if closeMyself {
+		server.closeClientAfterReply(c)
+	}
+}
+
+// CLIENT PAUSE timeout [WRITE|ALL]
+func (server *GodisServer) clientPauseCommand(c *GodisClient) {
+	timeout, err := strconv.ParseInt(c.args[2].StrVal(), 10, 64)
+	if err != nil {
+		server.AddReplyStr(c, "-ERR timeout is not an integer or out of range\r\n")
+		return
+	}
+	if timeout < 0 {
+		server.AddReplyStr(c, "-ERR timeout is negative\r\n")
+		return
+	}
+	pauseType := PAUSE_ALL
+	if len(c.args) == 4 {
+		switch strings.ToLower(c.args[3].StrVal()) {
+		case "write":
+			pauseType = PAUSE_WRITE
+		case "all":
+			pauseType = PAUSE_ALL
+		default:
+			server.AddReplyStr(c, "-ERR CLIENT PAUSE mode must be WRITE or ALL\r\n")
+			return
+		}
+	}
+	server.pauseClients(pauseType, GetMsTime()+timeout)
+	server.AddReplyStr(c, "+OK\r\n")
+}
+
+// pauseClients 多次暂停时取更严格的类型和更晚的结束时间
+func (server *GodisServer) pauseClients(pauseType int, end int64) {
+	if pauseType > server.pauseType {
+		server.pauseType = pauseType
+	}
+	if end > server.pauseEndTime {
+		server.pauseEndTime = end
+	}
+}
+
+func (server *GodisServer) unpauseClients() {
+	server.pauseType = PAUSE_NONE
+	server.pauseEndTime = 0
+	paused := server.pausedClients
+	server.pausedClients = nil
+	for _, c := range paused {
+		if server.clients[c.fd] != c {
+			continue //被之前执行的命令关闭，如CLIENT KILL
+		}
+		c.flags &= ^CLIENT_BLOCKED
+		c.btype = BLOCKED_NONE
+		// 执行被推迟的命令，再处理缓冲区中剩下的命令
+		server.ProcessCommand(c)
+		if err := server.ProcessQueryBuf(c); err != nil {
+			server.freeClient(c)
+		}
+	}
+}
+
+func (server *GodisServer) checkClientPauseTimeout() {
+	if server.pauseType != PAUSE_NONE && GetMsTime() >= server.pauseEndTime {
+		server.unpauseClients()
+	}
+}
+
+// isPausedForCommand replica不会被暂停，PAUSE WRITE只暂停写命令
+func (server *GodisServer) isPausedForCommand(c *GodisClient, cmd *GodisCommand) bool {
+	if server.pauseType == PAUSE_NONE || c.flags&CLIENT_SLAVE != 0 {
+		return false
+	}
+	if server.pauseType == PAUSE_ALL || cmd.flags&CMD_WRITE != 0 {
+		return true
+	}
+	// 包含写命令的事务在EXEC时整体推迟
+	return cmd == server.execCmd && c.mstate.cmdFlags&CMD_WRITE != 0
+}
+
+// blockPostponeClient 保留已经解析的参数，暂停结束后再执行
+func (server *GodisServer) blockPostponeClient(c *GodisClient) {
+	c.flags |= CLIENT_BLOCKED
+	c.btype = BLOCKED_POSTPONE
+	server.pausedClients = append(server.pausedClients, c)
+}
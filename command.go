@@ -2,7 +2,11 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func (server *GodisServer) getCommand(c *GodisClient) {
@@ -24,35 +28,328 @@ func (server *GodisServer) setCommand(c *GodisClient) {
 	if val.Type != GSTR {
 		server.AddReplyStr(c, "-ERR: wrong type\r\n")
 	}
+	if server.db.data.Find(key) == nil {
+		server.notifyKeyspaceEvent(NOTIFY_NEW, "new", key.StrVal(), 0)
+	}
 	server.db.data.Set(key, val)
 	server.db.expire.Delete(key)
+	server.signalModifiedKey(c, c.db, key.StrVal())
+	server.notifyKeyspaceEvent(NOTIFY_STRING, "set", key.StrVal(), 0)
+	server.dirty++
 	server.AddReplyStr(c, "+OK\r\n")
 }
 
 func (server *GodisServer) expireCommand(c *GodisClient) {
+	server.expireGenericCommand(c, GetMsTime(), 1000)
+}
+
+// PEXPIREAT key milliseconds-timestamp
+func (server *GodisServer) pexpireatCommand(c *GodisClient) {
+	server.expireGenericCommand(c, 0, 1)
+}
+
+// expireGenericCommand 过期时间为basetime + 参数*unit毫秒，
+// 以PEXPIREAT的绝对时间传播，replica上的过期时间与master一致
+func (server *GodisServer) expireGenericCommand(c *GodisClient, basetime int64, unit int64) {
 	key := c.args[1]
 	val := c.args[2]
-	if val.Type != GSTR {
-		//TODO: extract shared.strings
-		server.AddReplyStr(c, "-ERR: wrong type\r\n")
+	when, err := strconv.ParseInt(val.StrVal(), 10, 64)
+	if err != nil {
+		server.AddReplyStr(c, "-ERR value is not an integer or out of range\r\n")
+		return
+	}
+	// key不存在时不通知、不传播
+	server.expireIfNeeded(key)
+	if server.db.data.Find(key) == nil {
+		server.AddReplyStr(c, ":0\r\n")
+		return
 	}
-	expire := GetMsTime() + (val.IntVal() * 1000)
+	expire := basetime + when*unit
 	expObj := CreateFromInt(expire)
 	server.db.expire.Set(key, expObj)
 	expObj.DecrRefCount()
-	server.AddReplyStr(c, "+OK\r\n")
+	server.signalModifiedKey(c, c.db, key.StrVal())
+	server.notifyKeyspaceEvent(NOTIFY_GENERIC, "expire", key.StrVal(), 0)
+	server.dirty++
+	rewriteClientCommandVector(c, CreateObject(GSTR, "PEXPIREAT"), CreateObject(GSTR, key.StrVal()), CreateFromInt(expire))
+	server.AddReplyStr(c, ":1\r\n")
+}
+
+// DEL key [key ...]
+func (server *GodisServer) delCommand(c *GodisClient) {
+	deleted := 0
+	for _, key := range c.args[1:] {
+		server.expireIfNeeded(key)
+		if server.db.data.Find(key) == nil {
+			continue
+		}
+		server.db.data.Delete(key)
+		server.db.expire.Delete(key)
+		server.signalModifiedKey(c, c.db, key.StrVal())
+		server.notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key.StrVal(), 0)
+		server.dirty++
+		deleted++
+	}
+	server.AddReplyStr(c, fmt.Sprintf(":%d\r\n", deleted))
 }
 
+// COMMAND [COUNT | INFO [name ...] | DOCS [name ...] | LIST [FILTERBY ...] | GETKEYS command [arg ...]]
 func (server *GodisServer) commandCommand(c *GodisClient) {
-	//c.AddReplyStr("*3\r\n$3\r\nset\r\n$3\r\nget\r\n$6\r\nexpire\r\n")
-	server.AddReplyStr(c, "+get\r\n")
-	//c.AddReplyStr("+OK\r\n")
-	//resetClient(c)
+	if len(c.args) == 1 {
+		server.AddReplyStr(c, commandInfoArray(server.sortedCommands()))
+		return
+	}
+	sub := strings.ToLower(c.args[1].StrVal())
+	switch {
+	case sub == "count" && len(c.args) == 2:
+		server.AddReplyStr(c, fmt.Sprintf(":%d\r\n", len(server.commands)))
+	case sub == "info":
+		cmds := server.sortedCommands()
+		if len(c.args) > 2 {
+			cmds = nil
+			for _, arg := range c.args[2:] {
+				cmds = append(cmds, server.lookupCommandByFullname(arg.StrVal()))
+			}
+		}
+		server.AddReplyStr(c, commandInfoArray(cmds))
+	case sub == "docs":
+		cmds := server.sortedCommands()
+		if len(c.args) > 2 {
+			cmds = nil
+			for _, arg := range c.args[2:] {
+				if cmd := server.lookupCommandByFullname(arg.StrVal()); cmd != nil {
+					cmds = append(cmds, cmd)
+				}
+			}
+		}
+		var reply strings.Builder
+		reply.WriteString(fmt.Sprintf("*%d\r\n", len(cmds)*2))
+		for _, cmd := range cmds {
+			reply.WriteString(bulkString(cmd.name))
+			reply.WriteString(server.commandDocString(cmd))
+		}
+		server.AddReplyStr(c, reply.String())
+	case sub == "list":
+		server.commandListCommand(c)
+	case sub == "getkeys" && len(c.args) >= 3:
+		server.commandGetKeysCommand(c)
+	default:
+		server.AddReplyStr(c, fmt.Sprintf("-ERR unknown subcommand or wrong number of arguments for '%s'. Try COMMAND HELP.\r\n", c.args[1].StrVal()))
+	}
+}
+
+func (server *GodisServer) sortedCommands() []*GodisCommand {
+	var names []string
+	for name := range server.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cmds := make([]*GodisCommand, len(names))
+	for i, name := range names {
+		cmds[i] = server.commands[name]
+	}
+	return cmds
+}
+
+// lookupCommandByFullname 支持 parent|sub 形式的子命令
+func (server *GodisServer) lookupCommandByFullname(name string) *GodisCommand {
+	parent, sub, isSub := strings.Cut(name, "|")
+	cmd := server.lookupCommand(parent)
+	if cmd == nil || !isSub {
+		return cmd
+	}
+	return cmd.lookupSubcommand(sub)
+}
+
+// commandInfoArray cmds中的nil回复空数组
+func commandInfoArray(cmds []*GodisCommand) string {
+	var reply strings.Builder
+	reply.WriteString(fmt.Sprintf("*%d\r\n", len(cmds)))
+	for _, cmd := range cmds {
+		if cmd == nil {
+			reply.WriteString("*-1\r\n")
+		} else {
+			reply.WriteString(commandInfoString(cmd))
+		}
+	}
+	return reply.String()
+}
+
+// commandInfoString 格式与redis 7的COMMAND INFO一致:
+// name arity flags first-key last-key step acl-categories tips key-specs subcommands
+func commandInfoString(cmd *GodisCommand) string {
+	var reply strings.Builder
+	reply.WriteString("*10\r\n")
+	reply.WriteString(bulkString(cmd.name))
+	reply.WriteString(fmt.Sprintf(":%d\r\n", cmd.arity))
+	var flags []string
+	for _, f := range commandFlagNames {
+		if cmd.flags&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	reply.WriteString(fmt.Sprintf("*%d\r\n", len(flags)))
+	for _, f := range flags {
+		reply.WriteString(fmt.Sprintf("+%s\r\n", f))
+	}
+	reply.WriteString(fmt.Sprintf(":%d\r\n:%d\r\n:%d\r\n", cmd.firstKey, cmd.lastKey, cmd.keyStep))
+	var cats []string
+	for _, cat := range aclCategoryNames {
+		if cmd.aclCategories&cat.flag != 0 {
+			cats = append(cats, cat.name)
+		}
+	}
+	reply.WriteString(fmt.Sprintf("*%d\r\n", len(cats)))
+	for _, cat := range cats {
+		reply.WriteString(fmt.Sprintf("+@%s\r\n", cat))
+	}
+	reply.WriteString("*0\r\n") //tips
+	reply.WriteString(keySpecString(cmd))
+	reply.WriteString(fmt.Sprintf("*%d\r\n", len(cmd.subcommands)))
+	for i := range cmd.subcommands {
+		reply.WriteString(commandInfoString(&cmd.subcommands[i]))
+	}
+	return reply.String()
+}
+
+// keySpecString 由first/last/step生成一个index+range类型的key spec
+func keySpecString(cmd *GodisCommand) string {
+	if cmd.firstKey == 0 {
+		return "*0\r\n"
+	}
+	flags := []string{"RO", "access"}
+	if cmd.flags&CMD_WRITE != 0 {
+		flags = []string{"RW", "update"}
+	}
+	lastKey := cmd.lastKey
+	if lastKey >= 0 {
+		lastKey -= cmd.firstKey //相对于begin_search的位置
+	}
+	var spec strings.Builder
+	spec.WriteString("*1\r\n*6\r\n$5\r\nflags\r\n")
+	spec.WriteString(fmt.Sprintf("*%d\r\n", len(flags)))
+	for _, f := range flags {
+		spec.WriteString(fmt.Sprintf("+%s\r\n", f))
+	}
+	spec.WriteString("$12\r\nbegin_search\r\n*4\r\n$4\r\ntype\r\n$5\r\nindex\r\n$4\r\nspec\r\n")
+	spec.WriteString(fmt.Sprintf("*2\r\n$5\r\nindex\r\n:%d\r\n", cmd.firstKey))
+	spec.WriteString("$9\r\nfind_keys\r\n*4\r\n$4\r\ntype\r\n$5\r\nrange\r\n$4\r\nspec\r\n")
+	spec.WriteString(fmt.Sprintf("*6\r\n$7\r\nlastkey\r\n:%d\r\n$7\r\nkeystep\r\n:%d\r\n$5\r\nlimit\r\n:0\r\n", lastKey, cmd.keyStep))
+	return spec.String()
+}
+
+func (server *GodisServer) commandDocString(cmd *GodisCommand) string {
+	// 文档按cmdTable中的名字查找，rename-command不影响
+	name, sub, isSub := strings.Cut(cmd.name, "|")
+	if orig, ok := server.commandOrigNames[name]; ok {
+		name = orig
+	}
+	if isSub {
+		name += "|" + sub
+	}
+	doc := commandDocs[name]
+	var reply strings.Builder
+	n := 6
+	if len(cmd.subcommands) > 0 {
+		n += 2
+	}
+	reply.WriteString(fmt.Sprintf("*%d\r\n", n))
+	for _, kv := range [][2]string{{"summary", doc.summary}, {"since", doc.since}, {"group", doc.group}} {
+		reply.WriteString(bulkString(kv[0]))
+		reply.WriteString(bulkString(kv[1]))
+	}
+	if len(cmd.subcommands) > 0 {
+		reply.WriteString(bulkString("subcommands"))
+		reply.WriteString(fmt.Sprintf("*%d\r\n", len(cmd.subcommands)*2))
+		for i := range cmd.subcommands {
+			reply.WriteString(bulkString(cmd.subcommands[i].name))
+			reply.WriteString(server.commandDocString(&cmd.subcommands[i]))
+		}
+	}
+	return reply.String()
+}
+
+// COMMAND LIST [FILTERBY MODULE module-name | ACLCAT category | PATTERN pattern]
+func (server *GodisServer) commandListCommand(c *GodisClient) {
+	filter := func(cmd *GodisCommand) bool { return true }
+	if len(c.args) == 5 && strings.ToLower(c.args[2].StrVal()) == "filterby" {
+		arg := c.args[4].StrVal()
+		switch strings.ToLower(c.args[3].StrVal()) {
+		case "module":
+			filter = func(cmd *GodisCommand) bool { return false } //不支持module
+		case "aclcat":
+			cat, ok := aclGetCategoryByName(arg)
+			filter = func(cmd *GodisCommand) bool { return ok && cmd.aclCategories&cat != 0 }
+		case "pattern":
+			filter = func(cmd *GodisCommand) bool { return stringMatch(arg, cmd.name, true) }
+		default:
+			server.AddReplyStr(c, "-ERR syntax error\r\n")
+			return
+		}
+	} else if len(c.args) != 2 {
+		server.AddReplyStr(c, "-ERR syntax error\r\n")
+		return
+	}
+	var names []string
+	for _, cmd := range server.sortedCommands() {
+		if filter(cmd) {
+			names = append(names, cmd.name)
+		}
+		for i := range cmd.subcommands {
+			if filter(&cmd.subcommands[i]) {
+				names = append(names, cmd.subcommands[i].name)
+			}
+		}
+	}
+	server.AddReplyStr(c, addReplyBulkArray(names))
+}
+
+// COMMAND GETKEYS command [arg ...]
+func (server *GodisServer) commandGetKeysCommand(c *GodisClient) {
+	args := c.args[2:]
+	cmd := server.lookupCommand(args[0].StrVal())
+	if cmd == nil {
+		server.AddReplyStr(c, "-ERR Invalid command specified\r\n")
+		return
+	}
+	if !cmd.checkArity(len(args)) {
+		server.AddReplyStr(c, "-ERR Invalid number of arguments specified for command\r\n")
+		return
+	}
+	keys := getKeysFromCommand(cmd, args)
+	if len(keys) == 0 {
+		server.AddReplyStr(c, "-ERR The command has no key arguments\r\n")
+		return
+	}
+	var names []string
+	for _, i := range keys {
+		names = append(names, args[i].StrVal())
+	}
+	server.AddReplyStr(c, addReplyBulkArray(names))
 }
 
 func (server *GodisServer) quitCommand(c *GodisClient) {
 	server.AddReplyStr(c, "+OK\r\n")
-	server.freeClient(c)
+	server.closeClientAfterReply(c)
+}
+
+// PING [message]，RESP2订阅模式下回复数组
+func (server *GodisServer) pingCommand(c *GodisClient) {
+	if len(c.args) > 2 {
+		server.AddReplyStr(c, "-ERR wrong number of arguments for 'ping' command\r\n")
+		return
+	}
+	msg := ""
+	if len(c.args) == 2 {
+		msg = c.args[1].StrVal()
+	}
+	if c.flags&CLIENT_PUBSUB != 0 && c.resp == 2 {
+		server.AddReplyStr(c, "*2\r\n$4\r\npong\r\n"+bulkString(msg))
+	} else if len(c.args) == 2 {
+		server.AddReplyBulk(c, msg)
+	} else {
+		server.AddReplyStr(c, "+PONG\r\n")
+	}
 }
 
 func (server *GodisServer) lpushCommand(c *GodisClient) {
@@ -64,6 +361,7 @@ func (server *GodisServer) lpushCommand(c *GodisClient) {
 	en := server.db.data.Find(key)
 	if en == nil {
 		en := server.db.data.AddNew(key)
+		server.notifyKeyspaceEvent(NOTIFY_NEW, "new", key.StrVal(), 0)
 		var relist List
 		relist.head = nil
 		relist.tail = nil
@@ -85,6 +383,9 @@ func (server *GodisServer) lpushCommand(c *GodisClient) {
 	// list.LPush(val)
 
 	//server.db.expire.Delete(key)
+	server.signalModifiedKey(c, c.db, key.StrVal())
+	server.notifyKeyspaceEvent(NOTIFY_LIST, "lpush", key.StrVal(), 0)
+	server.dirty++
 	server.AddReplyStr(c, "+OK\r\n")
 }
 
@@ -109,6 +410,9 @@ func (server *GodisServer) lpopCommand(c *GodisClient) {
 
 	str := ln.val.StrVal()
 	ln.val.DecrRefCount()
+	server.signalModifiedKey(c, c.db, key.StrVal())
+	server.notifyKeyspaceEvent(NOTIFY_LIST, "lpop", key.StrVal(), 0)
+	server.dirty++
 	server.AddReplyStr(c, fmt.Sprintf("$%d\r\n%v\r\n", len(str), str))
 }
 
@@ -122,6 +426,7 @@ func (server *GodisServer) zaddCommand(c *GodisClient) {
 	en := server.db.data.Find(key)
 	if en == nil {
 		en := server.db.data.AddNew(key)
+		server.notifyKeyspaceEvent(NOTIFY_NEW, "new", key.StrVal(), 0)
 
 		zsl := ZslCreate(ZsetType{LessFunc: GStrLess,
 			EqualFunc: GStrEqual,
@@ -140,23 +445,22 @@ func (server *GodisServer) zaddCommand(c *GodisClient) {
 		val.IncrRefCount()
 
 	}
+	server.signalModifiedKey(c, c.db, key.StrVal())
+	server.notifyKeyspaceEvent(NOTIFY_ZSET, "zadd", key.StrVal(), 0)
+	server.dirty++
 	server.AddReplyStr(c, "+OK\r\n")
 }
 
 func (server *GodisServer) zrangeCommand(c *GodisClient) {
-	if len(c.args) < 4 || len(c.args) > 5 {
-		server.AddReplyStr(c, "-ERR: args too less\r\n")
-		return
-	}
 	key := c.args[1]
 	start := c.args[2]
 	end := c.args[3]
 	withscore := false
-	if len(c.args) == 5 {
-		args5 := c.args[4].StrVal()
-		if strings.ToLower(args5) == "withscores" {
-			withscore = true
-		}
+	if len(c.args) == 5 && strings.ToLower(c.args[4].StrVal()) == "withscores" {
+		withscore = true
+	} else if len(c.args) >= 5 {
+		server.AddReplyStr(c, "-ERR syntax error\r\n")
+		return
 	}
 	en := server.db.data.Find(key)
 	if en == nil {
@@ -194,3 +498,49 @@ func (server *GodisServer) zrangeCommand(c *GodisClient) {
 	}
 
 }
+
+func (server *GodisServer) infoCommand(c *GodisClient) {
+	section := "default"
+	if len(c.args) == 2 {
+		section = strings.ToLower(c.args[1].StrVal())
+	} else if len(c.args) > 2 {
+		server.AddReplyStr(c, "-ERR: syntax error\r\n")
+		return
+	}
+	server.AddReplyBulk(c, server.genGodisInfoString(section))
+}
+
+func (server *GodisServer) genGodisInfoString(section string) string {
+	all := section == "all" || section == "default" || section == "everything"
+	var info strings.Builder
+	if all || section == "server" {
+		info.WriteString("# Server\r\n")
+		fmt.Fprintf(&info, "process_id:%d\r\n", os.Getpid())
+		fmt.Fprintf(&info, "tcp_port:%d\r\n", server.port)
+		fmt.Fprintf(&info, "uptime_in_seconds:%d\r\n", time.Now().Unix()-server.stat_starttime)
+	}
+	if all || section == "clients" {
+		if info.Len() > 0 {
+			info.WriteString("\r\n")
+		}
+		info.WriteString("# Clients\r\n")
+		fmt.Fprintf(&info, "connected_clients:%d\r\n", len(server.clients))
+		fmt.Fprintf(&info, "maxclients:%d\r\n", server.maxclients)
+	}
+	if all || section == "replication" {
+		if info.Len() > 0 {
+			info.WriteString("\r\n")
+		}
+		server.genReplicationInfoString(&info)
+	}
+	if all || section == "stats" {
+		if info.Len() > 0 {
+			info.WriteString("\r\n")
+		}
+		info.WriteString("# Stats\r\n")
+		fmt.Fprintf(&info, "rejected_connections:%d\r\n", server.stat_rejected_conn)
+		fmt.Fprintf(&info, "client_output_buffer_limit_disconnections:%d\r\n", server.stat_client_outbuf_limit_disconnections)
+		fmt.Fprintf(&info, "total_write_syscalls:%d\r\n", server.stat_net_write_syscalls)
+	}
+	return info.String()
+}
@@ -2,12 +2,52 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 )
 
 type Config struct {
-	Port int `json:"port"`
+	Port           int      `json:"port"`
+	Bind           []string `json:"bind"` //ipv4/ipv6 addrs, "-" prefix marks optional
+	UnixSocket     string   `json:"unixsocket"`
+	UnixSocketPerm int      `json:"unixsocketperm"` //octal digits, e.g. 700
+	TcpKeepAlive   *int     `json:"tcp-keepalive"`  //seconds, 0 disables, 300 if unset
+	Timeout        int64    `json:"timeout"`        //close idle clients after seconds, 0 disables
+	MaxClients     int      `json:"maxclients"`     //10000 if unset
+	TlsPort        int      `json:"tls-port"`       //0 disables tls
+	TlsCertFile    string   `json:"tls-cert-file"`
+	TlsKeyFile     string   `json:"tls-key-file"`
+	TlsCaCertFile  string   `json:"tls-ca-cert-file"`
+	TlsAuthClients string   `json:"tls-auth-clients"` //no, yes or optional
+	RequirePass    string   `json:"requirepass"`
+	AclFile        string   `json:"aclfile"`
+	AclLogMaxLen   *int     `json:"acllog-max-len"` //128 if unset
+	ProtectedMode  string   `json:"protected-mode"` //yes or no, yes if unset
+
+	TrackingTableMaxKeys *int `json:"tracking-table-max-keys"` //1000000 if unset, 0 means no limit
+
+	// keyspace event classes, e.g. "Ex", empty disables notifications
+	NotifyKeyspaceEvents string `json:"notify-keyspace-events"`
+
+	// command name -> new name, an empty new name disables the command
+	RenameCommand map[string]string `json:"rename-command"`
+
+	// "<class> <hard> <soft> <soft seconds>" repeated, class is normal, replica or pubsub
+	ClientOutputBufferLimit string `json:"client-output-buffer-limit"`
+
+	// replication backlog size for partial resync, e.g. "1mb", 1mb if unset
+	ReplBacklogSize string `json:"repl-backlog-size"`
+
+	// replication options are yes or no unless noted
+	ReplicaReadOnly       string `json:"replica-read-only"`        //yes if unset
+	ReplicaServeStaleData string `json:"replica-serve-stale-data"` //yes if unset
+	ReplDisklessSync      string `json:"repl-diskless-sync"`       //yes if unset
+	ReplDisklessLoad      string `json:"repl-diskless-load"`       //disabled, on-empty-db or swapdb, disabled if unset
+
+	DbFilename string `json:"dbfilename"` //dump.rdb if unset
 }
 
 func LoadConfig(path string) (config *Config, err error) {
@@ -28,3 +68,75 @@ func LoadConfig(path string) (config *Config, err error) {
 	}
 	return
 }
+
+// octalPerm reads a permission written as decimal digits (700) as the
+// octal mode it stands for (0700), the way redis.conf does.
+func octalPerm(perm int) (uint32, error) {
+	mode, err := strconv.ParseUint(strconv.Itoa(perm), 8, 32)
+	return uint32(mode), err
+}
+
+// parseYesNo 解析yes/no配置项，未设置时为def
+func parseYesNo(name, val string, def bool) (bool, error) {
+	switch strings.ToLower(val) {
+	case "":
+		return def, nil
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s must be yes or no, got %q", name, val)
+}
+
+// parseMemory 解析redis风格的内存大小: 1k=1000, 1kb=1024, 1m, 1mb, 1g, 1gb
+func parseMemory(str string) (int64, error) {
+	str = strings.ToLower(str)
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1},
+	}
+	mul := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(str, u.suffix) {
+			str = strings.TrimSuffix(str, u.suffix)
+			mul = u.mul
+			break
+		}
+	}
+	val, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("invalid memory size: %v", str)
+	}
+	return val * mul, nil
+}
+
+func parseClientOutputBufferLimit(str string, limits *[CLIENT_TYPE_COUNT]ClientBufferLimit) error {
+	args := strings.Fields(str)
+	if len(args)%4 != 0 {
+		return fmt.Errorf("wrong number of arguments in client-output-buffer-limit")
+	}
+	for i := 0; i < len(args); i += 4 {
+		class := getClientTypeByName(args[i])
+		if class == -1 {
+			return fmt.Errorf("invalid client class: %v", args[i])
+		}
+		hard, err := parseMemory(args[i+1])
+		if err != nil {
+			return err
+		}
+		soft, err := parseMemory(args[i+2])
+		if err != nil {
+			return err
+		}
+		seconds, err := strconv.ParseInt(args[i+3], 10, 64)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("invalid soft limit seconds: %v", args[i+3])
+		}
+		limits[class] = ClientBufferLimit{hardLimitBytes: hard, softLimitBytes: soft, softLimitSeconds: seconds}
+	}
+	return nil
+}
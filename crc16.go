@@ -0,0 +1,38 @@
+package main
+
+// CLUSTER_SLOTS 与redis cluster一致的hash slot数量
+const CLUSTER_SLOTS int = 16384
+
+// crc16 CRC16-CCITT (XMODEM)，多项式0x1021，初始值0
+func crc16(buf string) uint16 {
+	var crc uint16
+	for i := 0; i < len(buf); i++ {
+		crc ^= uint16(buf[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// keyHashSlot 有hash tag时只对第一个{}中的非空内容计算slot
+func keyHashSlot(key string) int {
+	s := 0
+	for s < len(key) && key[s] != '{' {
+		s++
+	}
+	if s < len(key) {
+		e := s + 1
+		for e < len(key) && key[e] != '}' {
+			e++
+		}
+		if e < len(key) && e != s+1 {
+			key = key[s+1 : e]
+		}
+	}
+	return int(crc16(key)) & (CLUSTER_SLOTS - 1)
+}
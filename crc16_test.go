@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyHashSlot(t *testing.T) {
+	assert.Equal(t, uint16(0x31C3), crc16("123456789"))
+	assert.Equal(t, 12182, keyHashSlot("foo"))
+	assert.Equal(t, keyHashSlot("user1000"), keyHashSlot("{user1000}.following"))
+	assert.Equal(t, keyHashSlot("user1000"), keyHashSlot("foo{user1000}{bar}"))
+	assert.Equal(t, keyHashSlot("foo{}{bar}"), int(crc16("foo{}{bar}"))&(CLUSTER_SLOTS-1))
+	assert.Equal(t, keyHashSlot("foo{"), int(crc16("foo{"))&(CLUSTER_SLOTS-1))
+}
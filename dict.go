@@ -304,6 +304,7 @@ func (dict *Dict) Delete(key *GObj) error {
 	for i >= 0 {
 		idx = hk & dict.hts[i].mask
 		entry = dict.hts[i].table[idx]
+		preEntry = nil
 		for entry != nil {
 			if dict.EqualFunc(entry.Key, key) {
 				if preEntry != nil {
@@ -313,6 +314,7 @@ func (dict *Dict) Delete(key *GObj) error {
 				}
 				//entry.next = nil
 				freeEntry(entry)
+				dict.hts[i].used--
 				return nil
 			}
 			preEntry = entry
@@ -380,3 +382,25 @@ func (dict *Dict) RandomGet() *Entry {
 	}
 	return entry
 }
+
+// ForEach 遍历所有entry，遍历过程中不能修改dict
+func (dict *Dict) ForEach(fn func(e *Entry)) {
+	for _, ht := range dict.hts {
+		if ht == nil {
+			continue
+		}
+		for _, entry := range ht.table {
+			for ; entry != nil; entry = entry.next {
+				fn(entry)
+			}
+		}
+	}
+}
+
+func (dict *Dict) Size() int64 {
+	size := dict.hts[0].used
+	if dict.hts[1] != nil {
+		size += dict.hts[1].used
+	}
+	return size
+}
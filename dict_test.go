@@ -23,8 +23,11 @@ func TestDict(t *testing.T) {
 	assert.Equal(t, 2, k1.refCount)
 	assert.Equal(t, 2, v1.refCount)
 
+	assert.Equal(t, int64(1), dict.Size())
+
 	e = dict.Delete(k1)
 	assert.Nil(t, e)
+	assert.Equal(t, int64(0), dict.Size())
 	entry = dict.Find(k1)
 	assert.Nil(t, entry)
 	assert.Equal(t, 1, k1.refCount)
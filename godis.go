@@ -3,19 +3,176 @@ package main
 import (
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var server GodisServer
 var cmdTable []GodisCommand = []GodisCommand{
-	{"quit", server.quitCommand, 1},
-	{"get", server.getCommand, 2},
-	{"set", server.setCommand, 3},
-	{"expire", server.expireCommand, 3},
-	{"command", server.commandCommand, 2},
-	{"lpush", server.lpushCommand, 3},
-	{"lpop", server.lpopCommand, 2},
-	{"zadd", server.zaddCommand, 4},
-	{"zrange", server.zrangeCommand, 0},
+	{"quit", server.quitCommand, -1, "noscript loading stale fast no_auth @connection", 0, 0, 0, nil, 0, 0},
+	{"auth", server.authCommand, -2, "noscript loading stale fast no_auth @connection", 0, 0, 0, nil, 0, 0},
+	{"hello", server.helloCommand, -1, "noscript loading stale fast no_auth @connection", 0, 0, 0, nil, 0, 0},
+	{"get", server.getCommand, 2, "readonly fast @string", 1, 1, 1, nil, 0, 0},
+	{"set", server.setCommand, 3, "write denyoom @string", 1, 1, 1, nil, 0, 0},
+	{"expire", server.expireCommand, 3, "write fast @keyspace", 1, 1, 1, nil, 0, 0},
+	{"pexpireat", server.pexpireatCommand, 3, "write fast @keyspace", 1, 1, 1, nil, 0, 0},
+	{"del", server.delCommand, -2, "write @keyspace", 1, -1, 1, nil, 0, 0},
+	{"command", server.commandCommand, -1, "loading stale @connection", 0, 0, 0, commandSubcommands, 0, 0},
+	{"lpush", server.lpushCommand, 3, "write denyoom fast @list", 1, 1, 1, nil, 0, 0},
+	{"lpop", server.lpopCommand, 2, "write fast @list", 1, 1, 1, nil, 0, 0},
+	{"zadd", server.zaddCommand, 4, "write denyoom fast @sortedset", 1, 1, 1, nil, 0, 0},
+	{"zrange", server.zrangeCommand, -4, "readonly @sortedset", 1, 1, 1, nil, 0, 0},
+	{"info", server.infoCommand, -1, "loading stale @dangerous", 0, 0, 0, nil, 0, 0},
+	{"client", server.clientCommand, -2, "admin noscript loading stale @connection", 0, 0, 0, clientSubcommands, 0, 0},
+	{"acl", server.aclCommand, -2, "admin noscript loading stale", 0, 0, 0, aclSubcommands, 0, 0},
+	{"multi", server.multiCommand, 1, "noscript loading stale fast @transaction", 0, 0, 0, nil, 0, 0},
+	{"exec", server.execCommand, 1, "noscript loading stale @transaction", 0, 0, 0, nil, 0, 0},
+	{"discard", server.discardCommand, 1, "noscript loading stale fast @transaction", 0, 0, 0, nil, 0, 0},
+	{"watch", server.watchCommand, -2, "noscript loading stale fast @transaction", 1, -1, 1, nil, 0, 0},
+	{"unwatch", server.unwatchCommand, 1, "noscript loading stale fast @transaction", 0, 0, 0, nil, 0, 0},
+	{"ping", server.pingCommand, -1, "fast @connection", 0, 0, 0, nil, 0, 0},
+	{"subscribe", server.subscribeCommand, -2, "pubsub noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"unsubscribe", server.unsubscribeCommand, -1, "pubsub noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"psubscribe", server.psubscribeCommand, -2, "pubsub noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"punsubscribe", server.punsubscribeCommand, -1, "pubsub noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"publish", server.publishCommand, 3, "pubsub loading stale fast", 0, 0, 0, nil, 0, 0},
+	{"ssubscribe", server.ssubscribeCommand, -2, "pubsub noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"sunsubscribe", server.sunsubscribeCommand, -1, "pubsub noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"spublish", server.spublishCommand, 3, "pubsub loading stale fast", 0, 0, 0, nil, 0, 0},
+	{"pubsub", server.pubsubCommand, -2, "pubsub loading stale", 0, 0, 0, pubsubSubcommands, 0, 0},
+	{"monitor", server.monitorCommand, 1, "admin noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"replicaof", server.replicaofCommand, 3, "admin noscript stale", 0, 0, 0, nil, 0, 0},
+	{"slaveof", server.replicaofCommand, 3, "admin noscript stale", 0, 0, 0, nil, 0, 0},
+	{"replconf", server.replconfCommand, -1, "admin noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"psync", server.psyncCommand, -3, "admin noscript", 0, 0, 0, nil, 0, 0},
+	{"wait", server.waitCommand, 3, "noscript @connection", 0, 0, 0, nil, 0, 0},
+}
+
+var commandSubcommands = []GodisCommand{
+	{"count", nil, 2, "loading stale @connection", 0, 0, 0, nil, 0, 0},
+	{"info", nil, -2, "loading stale @connection", 0, 0, 0, nil, 0, 0},
+	{"docs", nil, -2, "loading stale @connection", 0, 0, 0, nil, 0, 0},
+	{"list", nil, -2, "loading stale @connection", 0, 0, 0, nil, 0, 0},
+	{"getkeys", nil, -3, "loading stale @connection", 0, 0, 0, nil, 0, 0},
+}
+
+var clientSubcommands = []GodisCommand{
+	{"id", nil, 2, "noscript loading stale @connection", 0, 0, 0, nil, 0, 0},
+	{"info", nil, 2, "noscript loading stale @connection", 0, 0, 0, nil, 0, 0},
+	{"list", nil, -2, "admin noscript loading stale @connection", 0, 0, 0, nil, 0, 0},
+	{"setname", nil, 3, "noscript loading stale @connection", 0, 0, 0, nil, 0, 0},
+	{"getname", nil, 2, "noscript loading stale @connection", 0, 0, 0, nil, 0, 0},
+	{"kill", nil, -3, "admin noscript loading stale @connection", 0, 0, 0, nil, 0, 0},
+	{"pause", nil, -3, "admin noscript loading stale @connection", 0, 0, 0, nil, 0, 0},
+	{"unpause", nil, 2, "admin noscript loading stale @connection", 0, 0, 0, nil, 0, 0},
+	{"no-evict", nil, 3, "admin noscript loading stale @connection", 0, 0, 0, nil, 0, 0},
+	{"reply", nil, 3, "noscript loading stale @connection", 0, 0, 0, nil, 0, 0},
+	{"tracking", nil, -3, "noscript loading stale @connection", 0, 0, 0, nil, 0, 0},
+	{"caching", nil, 3, "noscript loading stale @connection", 0, 0, 0, nil, 0, 0},
+	{"getredir", nil, 2, "noscript loading stale @connection", 0, 0, 0, nil, 0, 0},
+}
+
+var aclSubcommands = []GodisCommand{
+	{"setuser", nil, -3, "admin noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"getuser", nil, 3, "admin noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"deluser", nil, -3, "admin noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"list", nil, 2, "admin noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"users", nil, 2, "admin noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"whoami", nil, 2, "noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"cat", nil, -2, "noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"dryrun", nil, -4, "admin noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"log", nil, -2, "admin noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"load", nil, 2, "admin noscript loading stale", 0, 0, 0, nil, 0, 0},
+	{"save", nil, 2, "admin noscript loading stale", 0, 0, 0, nil, 0, 0},
+}
+
+var pubsubSubcommands = []GodisCommand{
+	{"channels", nil, -2, "pubsub loading stale", 0, 0, 0, nil, 0, 0},
+	{"numsub", nil, -2, "pubsub loading stale", 0, 0, 0, nil, 0, 0},
+	{"numpat", nil, 2, "pubsub loading stale", 0, 0, 0, nil, 0, 0},
+	{"shardchannels", nil, -2, "pubsub loading stale", 0, 0, 0, nil, 0, 0},
+	{"shardnumsub", nil, -2, "pubsub loading stale", 0, 0, 0, nil, 0, 0},
+}
+
+type CommandDoc struct {
+	summary string
+	since   string
+	group   string
+}
+
+// commandDocs COMMAND DOCS的内容，子命令以 parent|sub 为key
+var commandDocs = map[string]CommandDoc{
+	"quit":                 {"Closes the connection.", "1.0.0", "connection"},
+	"auth":                 {"Authenticates the connection.", "1.0.0", "connection"},
+	"hello":                {"Handshakes with the server.", "6.0.0", "connection"},
+	"get":                  {"Returns the string value of a key.", "1.0.0", "string"},
+	"set":                  {"Sets the string value of a key, ignoring its type.", "1.0.0", "string"},
+	"expire":               {"Sets the expiration time of a key in seconds.", "1.0.0", "generic"},
+	"pexpireat":            {"Sets the expiration time of a key to a Unix milliseconds timestamp.", "2.6.0", "generic"},
+	"del":                  {"Deletes one or more keys.", "1.0.0", "generic"},
+	"command":              {"Returns detailed information about all commands.", "2.8.13", "server"},
+	"command|count":        {"Returns a count of commands.", "2.8.13", "server"},
+	"command|info":         {"Returns information about one, multiple or all commands.", "2.8.13", "server"},
+	"command|docs":         {"Returns documentary information about one, multiple or all commands.", "7.0.0", "server"},
+	"command|list":         {"Returns a list of command names.", "7.0.0", "server"},
+	"command|getkeys":      {"Extracts the key names from an arbitrary command.", "2.8.13", "server"},
+	"lpush":                {"Prepends an element to a list. Creates the key if it doesn't exist.", "1.0.0", "list"},
+	"lpop":                 {"Returns the first element of a list after removing it. Deletes the list if the last element was popped.", "1.0.0", "list"},
+	"zadd":                 {"Adds a member to a sorted set, or updates its score if it already exists.", "1.2.0", "sorted-set"},
+	"zrange":               {"Returns members in a sorted set within a range of indexes.", "1.2.0", "sorted-set"},
+	"info":                 {"Returns information and statistics about the server.", "1.0.0", "server"},
+	"client":               {"A container for client connection commands.", "2.4.0", "connection"},
+	"client|id":            {"Returns the unique client ID of the connection.", "5.0.0", "connection"},
+	"client|info":          {"Returns information about the connection.", "6.2.0", "connection"},
+	"client|list":          {"Lists open connections.", "2.4.0", "connection"},
+	"client|setname":       {"Sets the connection name.", "2.6.9", "connection"},
+	"client|getname":       {"Returns the name of the connection.", "2.6.9", "connection"},
+	"client|kill":          {"Terminates open connections.", "2.4.0", "connection"},
+	"client|pause":         {"Suspends commands processing.", "3.0.0", "connection"},
+	"client|unpause":       {"Resumes processing commands from paused clients.", "6.2.0", "connection"},
+	"client|no-evict":      {"Sets the client eviction mode of the connection.", "7.0.0", "connection"},
+	"client|reply":         {"Instructs the server whether to reply to commands.", "3.2.0", "connection"},
+	"client|tracking":      {"Controls server-assisted client-side caching for the connection.", "6.0.0", "connection"},
+	"client|caching":       {"Instructs the server whether to track the keys in the next request.", "6.0.0", "connection"},
+	"client|getredir":      {"Returns the client ID to which the connection's tracking notifications are redirected.", "6.0.0", "connection"},
+	"acl":                  {"A container for Access List Control commands.", "6.0.0", "server"},
+	"acl|setuser":          {"Creates and modifies an ACL user and its rules.", "6.0.0", "server"},
+	"acl|getuser":          {"Lists the ACL rules of a user.", "6.0.0", "server"},
+	"acl|deluser":          {"Deletes ACL users, and terminates their connections.", "6.0.0", "server"},
+	"acl|list":             {"Dumps the effective rules in ACL file format.", "6.0.0", "server"},
+	"acl|users":            {"Lists all ACL users.", "6.0.0", "server"},
+	"acl|whoami":           {"Returns the authenticated username of the current connection.", "6.0.0", "server"},
+	"acl|cat":              {"Lists the ACL categories, or the commands inside a category.", "6.0.0", "server"},
+	"acl|dryrun":           {"Simulates the execution of a command by a user, without executing the command.", "7.0.0", "server"},
+	"acl|log":              {"Lists recent security events generated due to ACL rules.", "6.0.0", "server"},
+	"acl|load":             {"Reloads the rules from the configured ACL file.", "6.0.0", "server"},
+	"acl|save":             {"Saves the effective ACL rules in the configured ACL file.", "6.0.0", "server"},
+	"multi":                {"Starts a transaction.", "1.2.0", "transactions"},
+	"exec":                 {"Executes all commands in a transaction.", "1.2.0", "transactions"},
+	"discard":              {"Discards a transaction.", "2.0.0", "transactions"},
+	"watch":                {"Monitors changes to keys to determine the execution of a transaction.", "2.2.0", "transactions"},
+	"unwatch":              {"Forgets about watched keys of a transaction.", "2.2.0", "transactions"},
+	"ping":                 {"Returns the server's liveliness response.", "1.0.0", "connection"},
+	"subscribe":            {"Listens for messages published to channels.", "2.0.0", "pubsub"},
+	"unsubscribe":          {"Stops listening to messages posted to channels.", "2.0.0", "pubsub"},
+	"psubscribe":           {"Listens for messages published to channels that match one or more patterns.", "2.0.0", "pubsub"},
+	"punsubscribe":         {"Stops listening to messages published to channels that match one or more patterns.", "2.0.0", "pubsub"},
+	"publish":              {"Posts a message to a channel.", "2.0.0", "pubsub"},
+	"ssubscribe":           {"Listens for messages published to shard channels.", "7.0.0", "pubsub"},
+	"sunsubscribe":         {"Stops listening to messages posted to shard channels.", "7.0.0", "pubsub"},
+	"spublish":             {"Post a message to a shard channel", "7.0.0", "pubsub"},
+	"pubsub":               {"A container for Pub/Sub commands.", "2.8.0", "pubsub"},
+	"pubsub|channels":      {"Returns the active channels.", "2.8.0", "pubsub"},
+	"pubsub|numsub":        {"Returns a count of subscribers to channels.", "2.8.0", "pubsub"},
+	"pubsub|numpat":        {"Returns a count of unique pattern subscriptions.", "2.8.0", "pubsub"},
+	"pubsub|shardchannels": {"Returns the active shard channels.", "7.0.0", "pubsub"},
+	"pubsub|shardnumsub":   {"Returns the count of subscribers of shard channels.", "7.0.0", "pubsub"},
+	"monitor":              {"Listens for all requests received by the server in real-time.", "1.0.0", "server"},
+	"replicaof":            {"Configures a server as replica of another, or promotes it to a master.", "5.0.0", "server"},
+	"slaveof":              {"Sets a Redis server as a replica of another, or promotes it to being a master.", "1.0.0", "server"},
+	"replconf":             {"An internal command for configuring the replication stream.", "3.0.0", "server"},
+	"psync":                {"An internal command used in replication.", "2.8.0", "server"},
+	"wait":                 {"Blocks until the asynchronous replication of all preceding write commands sent by the connection is completed.", "3.0.0", "generic"},
 }
 
 func main() {
@@ -30,11 +187,13 @@ func main() {
 	err = server.initServer(config)
 	if err != nil {
 		log.Printf("init server error: %v\n", err)
+		os.Exit(1)
 	}
 
-	server.cmd = cmdTable
-	server.aeloop.AddFileEvent(server.fd, AE_READABLE, server.AcceptHandler, nil)
+	server.sigCh = make(chan os.Signal, 1)
+	signal.Notify(server.sigCh, syscall.SIGINT, syscall.SIGTERM)
 	server.aeloop.AddTimeEvent(AE_NORMAL, 100, server.ServerCron, nil)
 	log.Println("godis server is up.")
 	server.aeloop.AeMain()
+	log.Println("godis server is down.")
 }
@@ -2,9 +2,13 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 )
 
 func ReadQuery(client *GodisClient, query string) {
@@ -76,9 +80,8 @@ func TestBulkBuf(t *testing.T) {
 func TestProcessQueryBuf(t *testing.T) {
 	var conf Config
 	server.initServer(&conf)
-	server.cmd = cmdTable
 	// just need real fd to support AddReply
-	client := server.CreateClient(server.fd)
+	client := server.CreateClient(server.ipfd[0])
 	ReadQuery(client, "*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$3\r\nval\r\n")
 	err := server.ProcessQueryBuf(client)
 	assert.Nil(t, err)
@@ -93,4 +96,666 @@ func TestProcessQueryBuf(t *testing.T) {
 	assert.Equal(t, 3, len(client.args))
 	val2 := server.db.data.Get(key)
 	assert.Equal(t, "val2", val2.StrVal())
+
+	// 命令不完整时保留已经解析的参数，等待后续数据
+	ReadQuery(client, "*3\r\n$3\r\nset\r\n$3\r\nkey\r\n")
+	err = server.ProcessQueryBuf(client)
+	assert.Nil(t, err)
+	assert.Equal(t, "val2", server.db.data.Get(key).StrVal())
+	ReadQuery(client, "$4\r\nval3\r\n")
+	err = server.ProcessQueryBuf(client)
+	assert.Nil(t, err)
+	assert.Equal(t, "val3", server.db.data.Get(key).StrVal())
+}
+
+func TestClientOutputBufferLimit(t *testing.T) {
+	var limits [CLIENT_TYPE_COUNT]ClientBufferLimit
+	err := parseClientOutputBufferLimit("normal 1kb 100 10 pubsub 32mb 8m 60", &limits)
+	assert.Nil(t, err)
+	assert.Equal(t, ClientBufferLimit{1024, 100, 10}, limits[CLIENT_TYPE_NORMAL])
+	assert.Equal(t, ClientBufferLimit{32 * 1024 * 1024, 8 * 1000 * 1000, 60}, limits[CLIENT_TYPE_PUBSUB])
+	assert.NotNil(t, parseClientOutputBufferLimit("master 0 0 0", &limits))
+	assert.NotNil(t, parseClientOutputBufferLimit("normal 0 0", &limits))
+
+	conf := Config{ClientOutputBufferLimit: "normal 1kb 100 10"}
+	server.initServer(&conf)
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	defer Close(fds[1])
+	client := server.CreateClient(fds[0])
+	server.clients[client.fd] = client
+
+	// soft limit只有持续超过设定时间才关闭
+	server.AddReplyStr(client, strings.Repeat("a", 200))
+	assert.Equal(t, int64(200), client.replyBytes)
+	assert.NotEqual(t, int64(0), client.obufSoftLimitReachedTime)
+	assert.Equal(t, 0, client.flags&CLIENT_CLOSE_ASAP)
+	client.obufSoftLimitReachedTime -= 11
+	server.AddReplyStr(client, "b")
+	assert.NotEqual(t, 0, client.flags&CLIENT_CLOSE_ASAP)
+	assert.Equal(t, int64(1), server.stat_client_outbuf_limit_disconnections)
+
+	// 即将关闭的客户端不再缓存回复，在beforeSleep中被释放
+	server.AddReplyStr(client, "c")
+	assert.Equal(t, int64(201), client.replyBytes)
+	server.beforeSleep(server.aeloop)
+	assert.Nil(t, server.clients[client.fd])
+	assert.Equal(t, 0, len(server.clientsToClose))
+
+	client = server.CreateClient(fds[1])
+	server.AddReplyStr(client, strings.Repeat("a", 1024))
+	assert.NotEqual(t, 0, client.flags&CLIENT_CLOSE_ASAP)
+	assert.Equal(t, int64(2), server.stat_client_outbuf_limit_disconnections)
+	freeReplyList(client)
+	server.clientsToClose = nil
+	assert.Contains(t, server.genGodisInfoString("stats"), "client_output_buffer_limit_disconnections:2\r\n")
+}
+
+func TestReplyCoalescing(t *testing.T) {
+	var conf Config
+	server.initServer(&conf)
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	defer Close(fds[1])
+	client := server.CreateClient(fds[0])
+	server.clients[client.fd] = client
+
+	big := strings.Repeat("b", 200*1024)
+	var expect strings.Builder
+	for _, str := range []string{"+OK\r\n", ":1\r\n", big, "$-1\r\n", "+OK\r\n"} {
+		server.AddReplyStr(client, str)
+		expect.WriteString(str)
+	}
+	// 前两个小回复被合并成一个节点，大回复不拷贝，最后两个在client.buf中
+	assert.Equal(t, 2, client.reply.Length())
+	assert.Equal(t, "+OK\r\n:1\r\n", client.reply.First().val.StrVal())
+	assert.Equal(t, "$-1\r\n+OK\r\n", string(client.buf))
+	assert.Equal(t, int64(expect.Len()), client.replyBytes)
+
+	// 收集的字节数不超过剩余的额度
+	total := 0
+	for _, buf := range client.collectReplyIov(100) {
+		total += len(buf)
+	}
+	assert.Equal(t, 100, total)
+
+	// 每次可写事件最多发送NET_MAX_WRITES_PER_EVENT字节
+	var got []byte
+	buf := make([]byte, 1024*1024)
+	for i := 0; client.hasPendingReplies(); i++ {
+		assert.Less(t, i, 100)
+		server.SendReplyToClient(server.aeloop, client.fd, client)
+		n, err := Read(fds[1], buf)
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, n, NET_MAX_WRITES_PER_EVENT)
+		got = append(got, buf[:n]...)
+	}
+	assert.Equal(t, expect.String(), string(got))
+	assert.Equal(t, int64(0), client.replyBytes)
+	assert.Equal(t, 0, client.reply.Length())
+}
+
+// sendReplyPerNode 按节点逐个write，即合并回复之前SendReplyToClient的做法
+func sendReplyPerNode(fd int, nodes []*GObj) int {
+	syscalls := 0
+	for _, o := range nodes {
+		buf := []byte(o.StrVal())
+		for len(buf) > 0 {
+			n, _ := Write(fd, buf)
+			syscalls++
+			buf = buf[n:]
+		}
+	}
+	return syscalls
+}
+
+// BenchmarkZrangeReply 对比zrange 100个元素(201个回复节点)两种发送方式的write次数
+func BenchmarkZrangeReply(b *testing.B) {
+	var conf Config
+	server.initServer(&conf)
+	fds, _ := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	defer Close(fds[1])
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			if _, err := Read(fds[1], buf); err != nil {
+				return
+			}
+		}
+	}()
+	var nodes []*GObj
+	nodes = append(nodes, CreateObject(GSTR, "*200\r\n"))
+	for i := 0; i < 100; i++ {
+		nodes = append(nodes, CreateObject(GSTR, fmt.Sprintf("$7\r\nmember%d\r\n", i%10)))
+		nodes = append(nodes, CreateObject(GSTR, fmt.Sprintf("$1\r\n%d\r\n", i%10)))
+	}
+
+	b.Run("per-node", func(b *testing.B) {
+		syscalls := 0
+		for i := 0; i < b.N; i++ {
+			syscalls += sendReplyPerNode(fds[0], nodes)
+		}
+		b.ReportMetric(float64(syscalls)/float64(b.N), "syscalls/op")
+	})
+	b.Run("coalesced", func(b *testing.B) {
+		client := server.CreateClient(fds[0])
+		server.stat_net_write_syscalls = 0
+		for i := 0; i < b.N; i++ {
+			for _, o := range nodes {
+				server.AddReply(client, o)
+			}
+			for client.hasPendingReplies() {
+				server.SendReplyToClient(server.aeloop, client.fd, client)
+			}
+		}
+		b.ReportMetric(float64(server.stat_net_write_syscalls)/float64(b.N), "syscalls/op")
+	})
+	Close(fds[0])
+}
+
+func TestClientTimeout(t *testing.T) {
+	conf := Config{Timeout: 10}
+	server.initServer(&conf)
+	var clients []*GodisClient
+	for i := 0; i < 3; i++ {
+		clients = append(clients, newTestClient(t, "", 0))
+	}
+	now := time.Now().Unix()
+	clients[0].lastinteraction = now - 11
+	clients[1].lastinteraction = now - 11
+	clients[1].flags |= CLIENT_PUBSUB
+	clients[2].lastinteraction = now - 5
+
+	server.clientsCron()
+	assert.Nil(t, server.clients[clients[0].fd])
+	assert.Equal(t, clients[1], server.clients[clients[1].fd])
+	assert.Equal(t, clients[2], server.clients[clients[2].fd])
+	assert.Equal(t, 2, server.clientList.Len())
+}
+
+func TestMaxClients(t *testing.T) {
+	var limit unix.Rlimit
+	assert.Nil(t, unix.Getrlimit(unix.RLIMIT_NOFILE, &limit))
+	// 硬限制为RLIM_INFINITY时任何maxclients都能满足，int(limit.Max)也会溢出
+	if limit.Max != unix.RLIM_INFINITY && limit.Max < math.MaxInt32 {
+		conf := Config{MaxClients: int(limit.Max) + 1000}
+		server.initServer(&conf)
+		assert.Equal(t, int(limit.Max)-MIN_RESERVED_FDS, server.maxclients)
+	}
+
+	conf := Config{MaxClients: 1}
+	server.initServer(&conf)
+	assert.Equal(t, 1, server.maxclients)
+	assert.NotNil(t, newTestClient(t, "", 0))
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	defer Close(fds[1])
+	assert.Nil(t, server.linkClient(fds[0], "127.0.0.1", 6000, false, nil))
+	buf := make([]byte, 64)
+	n, err := Read(fds[1], buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "-ERR max number of clients reached\r\n", string(buf[:n]))
+	n, err = Read(fds[1], buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n) //连接已关闭
+	assert.Equal(t, int64(1), server.stat_rejected_conn)
+	assert.Contains(t, server.genGodisInfoString("stats"), "rejected_connections:1\r\n")
+}
+
+// newTestClient 通过socketpair创建客户端，ip为空时作为unix socket连接，测试结束时关闭另一端
+func newTestClient(t *testing.T, ip string, port int) *GodisClient {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	t.Cleanup(func() { Close(fds[1]) })
+	return server.linkClient(fds[0], ip, port, ip == "", nil)
+}
+
+// takeReply 取出并清空客户端尚未发送的回复
+func takeReply(client *GodisClient) string {
+	var reply strings.Builder
+	for n := client.reply.First(); n != nil; n = n.next {
+		reply.WriteString(n.val.StrVal())
+	}
+	reply.Write(client.buf)
+	freeReplyList(client)
+	return reply.String()
+}
+
+func runQuery(t *testing.T, client *GodisClient, query string) string {
+	ReadQuery(client, query)
+	assert.Nil(t, server.ProcessQueryBuf(client))
+	return takeReply(client)
+}
+
+func TestClientCommand(t *testing.T) {
+	var conf Config
+	server.initServer(&conf)
+	var clients []*GodisClient
+	for i := 0; i < 3; i++ {
+		clients = append(clients, newTestClient(t, "127.0.0.1", 6000+i))
+	}
+	c := clients[0]
+
+	assert.Contains(t, runQuery(t, c, "client foo\r\n"), "-ERR unknown subcommand")
+	assert.Equal(t, fmt.Sprintf(":%d\r\n", c.id), runQuery(t, c, "client id\r\n"))
+	assert.Equal(t, "$-1\r\n", runQuery(t, c, "client getname\r\n"))
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "client setname conn0\r\n"))
+	assert.Contains(t, runQuery(t, c, "*3\r\n$6\r\nclient\r\n$7\r\nsetname\r\n$3\r\na b\r\n"), "-ERR Client names")
+	assert.Equal(t, "$5\r\nconn0\r\n", runQuery(t, c, "client getname\r\n"))
+
+	info := runQuery(t, c, "client info\r\n")
+	assert.Contains(t, info, fmt.Sprintf("id=%d addr=127.0.0.1:6000 ", c.id))
+	assert.Contains(t, info, " name=conn0 ")
+	assert.Contains(t, info, " flags=N ")
+	assert.Contains(t, info, " cmd=client user=default\n")
+
+	list := runQuery(t, c, "client list\r\n")
+	assert.Equal(t, 3, strings.Count(list, " addr="))
+	list = runQuery(t, c, fmt.Sprintf("client list id %d\r\n", clients[1].id))
+	assert.Contains(t, list, "addr=127.0.0.1:6001 ")
+	assert.Equal(t, 1, strings.Count(list, " addr="))
+	assert.Contains(t, runQuery(t, c, "client list type master\r\n"), "-ERR Unknown client type")
+
+	// CLIENT REPLY OFF/SKIP
+	assert.Equal(t, "", runQuery(t, c, "client reply skip\r\n"))
+	assert.Equal(t, "", runQuery(t, c, "set k v\r\n"))
+	assert.Equal(t, "$1\r\nv\r\n", runQuery(t, c, "get k\r\n"))
+	assert.Equal(t, "", runQuery(t, c, "client reply off\r\nget k\r\n"))
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "client reply on\r\n"))
+
+	// CLIENT KILL
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "client kill 127.0.0.1:6001\r\n"))
+	assert.Nil(t, server.clients[clients[1].fd])
+	assert.Equal(t, "-ERR No such client\r\n", runQuery(t, c, "client kill 127.0.0.1:6001\r\n"))
+	assert.Equal(t, ":1\r\n", runQuery(t, c, "client kill type normal\r\n"))
+	assert.Nil(t, server.clients[clients[2].fd])
+	assert.Equal(t, ":1\r\n", runQuery(t, c, fmt.Sprintf("client kill id %d skipme no\r\n", c.id)))
+	assert.NotEqual(t, 0, c.flags&CLIENT_CLOSE_AFTER_REPLY)
+	server.freeClient(c)
+}
+
+func TestClientPause(t *testing.T) {
+	var conf Config
+	server.initServer(&conf)
+	c := newTestClient(t, "", 0)
+	admin := newTestClient(t, "", 0)
+
+	assert.Equal(t, "-ERR timeout is negative\r\n", runQuery(t, admin, "client pause -1\r\n"))
+	assert.Equal(t, "+OK\r\n", runQuery(t, admin, "client pause 10000 write\r\n"))
+	// 读命令照常执行，写命令被推迟
+	assert.Equal(t, "$-1\r\n", runQuery(t, c, "get k\r\n"))
+	assert.Equal(t, "", runQuery(t, c, "set k v\r\nget k\r\n"))
+	assert.NotEqual(t, 0, c.flags&CLIENT_BLOCKED)
+	assert.Contains(t, runQuery(t, admin, "client list\r\n"), "flags=b ")
+
+	server.checkClientPauseTimeout()
+	assert.NotEqual(t, 0, c.flags&CLIENT_BLOCKED)
+	assert.Equal(t, "+OK\r\n", runQuery(t, admin, "client unpause\r\n"))
+	assert.Equal(t, 0, c.flags&CLIENT_BLOCKED)
+	assert.Equal(t, "+OK\r\n$1\r\nv\r\n", takeReply(c))
+
+	// 超时后自动恢复
+	assert.Equal(t, "+OK\r\n", runQuery(t, admin, "client pause 0 all\r\n"))
+	assert.Equal(t, "", runQuery(t, c, "get k\r\n"))
+	server.checkClientPauseTimeout()
+	assert.Equal(t, "$1\r\nv\r\n", takeReply(c))
+
+	// 被推迟的CLIENT KILL关闭了排在后面的被暂停客户端
+	victim := newTestClient(t, "", 0)
+	assert.Equal(t, "+OK\r\n", runQuery(t, admin, "client pause 100000 all\r\n"))
+	assert.Equal(t, "", runQuery(t, c, fmt.Sprintf("client kill id %d\r\n", victim.id)))
+	assert.Equal(t, "", runQuery(t, victim, "get k\r\n"))
+	server.unpauseClients()
+	assert.Equal(t, ":1\r\n", takeReply(c))
+	assert.Nil(t, server.clients[victim.fd])
+	server.freeClient(c)
+	server.freeClient(admin)
+}
+
+func TestAuth(t *testing.T) {
+	conf := Config{RequirePass: "foobared"}
+	server.initServer(&conf)
+	c := newTestClient(t, "127.0.0.1", 6000)
+
+	assert.Equal(t, "-NOAUTH Authentication required.\r\n", runQuery(t, c, "get k\r\n"))
+	assert.Contains(t, runQuery(t, c, "hello 2\r\n"), "-NOAUTH")
+	assert.Equal(t, "-WRONGPASS invalid username-password pair or user is disabled.\r\n", runQuery(t, c, "auth foo\r\n"))
+	assert.Contains(t, runQuery(t, c, "auth nobody foobared\r\n"), "-WRONGPASS")
+	assert.Equal(t, "-NOAUTH Authentication required.\r\n", runQuery(t, c, "get k\r\n"))
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "auth foobared\r\n"))
+	assert.Equal(t, "$-1\r\n", runQuery(t, c, "get k\r\n"))
+
+	c.authenticated = false
+	reply := runQuery(t, c, "hello 2 auth default foobared setname conn\r\n")
+	assert.Contains(t, reply, "$5\r\nproto\r\n:2\r\n")
+	assert.Equal(t, "conn", c.name)
+	assert.True(t, c.authenticated)
+	assert.Equal(t, "-NOPROTO unsupported protocol version\r\n", runQuery(t, c, "hello 4\r\n"))
+	reply = runQuery(t, c, "hello 3\r\n")
+	assert.True(t, strings.HasPrefix(reply, "%7\r\n"))
+	assert.Contains(t, reply, "$5\r\nproto\r\n:3\r\n")
+	assert.Equal(t, 3, c.resp)
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "quit\r\n"))
+	server.freeClient(c)
+
+	u := createAclUser("u")
+	assert.Nil(t, u.setRule(&server, ">foobared"))
+	assert.True(t, u.checkPassword("foobared"))
+	assert.False(t, u.checkPassword("foobare"))
+}
+
+func TestProtectedMode(t *testing.T) {
+	var conf Config
+	server.initServer(&conf)
+	assert.True(t, server.protectedMode)
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	defer Close(fds[1])
+	assert.Nil(t, server.linkClient(fds[0], "10.0.0.1", 6000, false, nil))
+	buf := make([]byte, 1024)
+	n, err := Read(fds[1], buf)
+	assert.Nil(t, err)
+	assert.Equal(t, PROTECTED_MODE_DENIED_MSG, string(buf[:n]))
+
+	for _, ip := range []string{"127.0.0.1", "::1"} {
+		assert.NotNil(t, newTestClient(t, ip, 6000))
+	}
+	assert.NotNil(t, newTestClient(t, "", 0))
+
+	// 设置了密码或关闭保护模式后接受外部连接
+	for _, conf := range []Config{{RequirePass: "foobared"}, {ProtectedMode: "no"}} {
+		server.initServer(&conf)
+		assert.NotNil(t, newTestClient(t, "10.0.0.1", 6000))
+	}
+	conf = Config{ProtectedMode: "maybe"}
+	assert.NotNil(t, server.initServer(&conf))
+}
+
+func TestRenameCommand(t *testing.T) {
+	conf := Config{RenameCommand: map[string]string{"SET": "set-secret", "info": ""}}
+	assert.Nil(t, server.initServer(&conf))
+	assert.Nil(t, server.lookupCommand("set"))
+	assert.Nil(t, server.lookupCommand("info"))
+	assert.NotNil(t, server.lookupCommand("set-secret"))
+	assert.Equal(t, "set", cmdTable[4].name)
+
+	c := newTestClient(t, "", 0)
+	assert.Equal(t, "-ERR unknown command 'set', with args beginning with: 'k' 'v' \r\n", runQuery(t, c, "set k v\r\n"))
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "set-secret k v\r\n"))
+	assert.Equal(t, "$1\r\nv\r\n", runQuery(t, c, "get k\r\n"))
+	server.freeClient(c)
+
+	// 改名后的命令仍有文档，子命令的全名使用新名字
+	conf = Config{RenameCommand: map[string]string{"client": "conn"}}
+	assert.Nil(t, server.initServer(&conf))
+	c = newTestClient(t, "", 0)
+	docs := mustParseResp(t, runQuery(t, c, "command docs conn\r\n")).([]interface{})
+	assert.Equal(t, "conn", docs[0])
+	connDocs := docs[1].([]interface{})
+	assert.Equal(t, "A container for client connection commands.", connDocs[1])
+	subDocs := connDocs[7].([]interface{})
+	assert.Equal(t, "conn|id", subDocs[0])
+	assert.Equal(t, "Returns the unique client ID of the connection.", subDocs[1].([]interface{})[1])
+	assert.Contains(t, mustParseResp(t, runQuery(t, c, "command list\r\n")), "conn|kill")
+	assert.Equal(t, fmt.Sprintf(":%d\r\n", c.id), runQuery(t, c, "conn id\r\n"))
+	server.freeClient(c)
+
+	conf = Config{RenameCommand: map[string]string{"nosuch": "x"}}
+	assert.NotNil(t, server.initServer(&conf))
+	conf = Config{RenameCommand: map[string]string{"set": "get"}}
+	assert.NotNil(t, server.initServer(&conf))
+}
+
+func TestCommandTable(t *testing.T) {
+	var conf Config
+	assert.Nil(t, server.initServer(&conf))
+	assert.Equal(t, len(cmdTable), len(server.commands))
+	get := server.lookupCommand("GET")
+	assert.Equal(t, get, server.lookupCommand("get"))
+	assert.Equal(t, CMD_READONLY|CMD_FAST, get.flags)
+	assert.Equal(t, ACL_CATEGORY_READ|ACL_CATEGORY_STRING|ACL_CATEGORY_FAST, get.aclCategories)
+	client := server.lookupCommand("client")
+	assert.NotEqual(t, 0, client.flags&CMD_ADMIN)
+	assert.Equal(t, ACL_CATEGORY_ADMIN|ACL_CATEGORY_DANGEROUS|ACL_CATEGORY_SLOW|ACL_CATEGORY_CONNECTION, client.aclCategories)
+
+	bad := GodisCommand{name: "bad", sflags: "write nosuchflag"}
+	assert.NotNil(t, bad.parseCommandFlags())
+	bad.sflags = "@nosuchcategory"
+	assert.NotNil(t, bad.parseCommandFlags())
+
+	zrange := server.lookupCommand("zrange")
+	assert.False(t, zrange.checkArity(3))
+	assert.True(t, zrange.checkArity(4))
+	assert.True(t, zrange.checkArity(5))
+	assert.False(t, get.checkArity(3))
+
+	c := newTestClient(t, "", 0)
+	assert.Equal(t, "-ERR wrong number of arguments for 'zrange' command\r\n", runQuery(t, c, "zrange z 0\r\n"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'get' command\r\n", runQuery(t, c, "get a b\r\n"))
+	assert.Equal(t, "-ERR syntax error\r\n", runQuery(t, c, "zrange z 0 -1 foo\r\n"))
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "zadd z 1 a\r\n"))
+	assert.Equal(t, "*2\r\n$1\r\na\r\n$1\r\n1\r\n", runQuery(t, c, "zrange z 0 -1 withscores\r\n"))
+	assert.Equal(t, server.lookupCommand("zrange"), c.lastcmd)
+
+	// 加载数据时只能执行带loading标记的命令
+	server.loading = true
+	assert.Equal(t, "-LOADING Godis is loading the dataset in memory\r\n", runQuery(t, c, "zrange z 0 -1\r\n"))
+	assert.Contains(t, runQuery(t, c, "info replication\r\n"), "role:master")
+	server.loading = false
+	server.freeClient(c)
+}
+
+// parseResp 解析一个完整的RESP2回复，数组解析为[]interface{}
+func parseResp(s string) (interface{}, string, error) {
+	idx := strings.Index(s, "\r\n")
+	if idx < 1 {
+		return nil, s, fmt.Errorf("incomplete reply %q", s)
+	}
+	line, rest := s[1:idx], s[idx+2:]
+	switch s[0] {
+	case '+', '-':
+		return line, rest, nil
+	case ':':
+		var n int64
+		_, err := fmt.Sscanf(line, "%d", &n)
+		return n, rest, err
+	case '$':
+		var n int
+		if _, err := fmt.Sscanf(line, "%d", &n); err != nil || n < 0 {
+			return nil, rest, err
+		}
+		if len(rest) < n+2 || rest[n:n+2] != "\r\n" {
+			return nil, rest, fmt.Errorf("bad bulk %q", s)
+		}
+		return rest[:n], rest[n+2:], nil
+	case '*':
+		var n int
+		if _, err := fmt.Sscanf(line, "%d", &n); err != nil || n < 0 {
+			return nil, rest, err
+		}
+		arr := []interface{}{}
+		for i := 0; i < n; i++ {
+			var v interface{}
+			var err error
+			if v, rest, err = parseResp(rest); err != nil {
+				return nil, rest, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, rest, nil
+	}
+	return nil, s, fmt.Errorf("unknown reply type %q", s)
+}
+
+func mustParseResp(t *testing.T, s string) interface{} {
+	v, rest, err := parseResp(s)
+	assert.Nil(t, err)
+	assert.Equal(t, "", rest)
+	return v
+}
+
+func TestCommandCommand(t *testing.T) {
+	var conf Config
+	assert.Nil(t, server.initServer(&conf))
+	c := newTestClient(t, "", 0)
+
+	assert.Equal(t, fmt.Sprintf(":%d\r\n", len(cmdTable)), runQuery(t, c, "command count\r\n"))
+	all := mustParseResp(t, runQuery(t, c, "command\r\n")).([]interface{})
+	assert.Equal(t, len(cmdTable), len(all))
+
+	info := mustParseResp(t, runQuery(t, c, "command info get nosuch client|kill\r\n")).([]interface{})
+	assert.Equal(t, 3, len(info))
+	assert.Equal(t, []interface{}{"get", int64(2), []interface{}{"readonly", "fast"}, int64(1), int64(1), int64(1),
+		[]interface{}{"@read", "@string", "@fast"}, []interface{}{},
+		[]interface{}{[]interface{}{"flags", []interface{}{"RO", "access"},
+			"begin_search", []interface{}{"type", "index", "spec", []interface{}{"index", int64(1)}},
+			"find_keys", []interface{}{"type", "range", "spec", []interface{}{"lastkey", int64(0), "keystep", int64(1), "limit", int64(0)}}}},
+		[]interface{}{}}, info[0])
+	assert.Nil(t, info[1])
+	kill := info[2].([]interface{})
+	assert.Equal(t, "client|kill", kill[0])
+	assert.Equal(t, int64(-3), kill[1])
+	assert.Contains(t, kill[6], "@admin")
+
+	client := mustParseResp(t, runQuery(t, c, "command info client\r\n")).([]interface{})[0].([]interface{})
+	assert.Equal(t, len(clientSubcommands), len(client[9].([]interface{})))
+
+	docs := mustParseResp(t, runQuery(t, c, "command docs get acl\r\n")).([]interface{})
+	assert.Equal(t, "get", docs[0])
+	assert.Equal(t, []interface{}{"summary", "Returns the string value of a key.", "since", "1.0.0", "group", "string"}, docs[1])
+	assert.Equal(t, "acl", docs[2])
+	aclDocs := docs[3].([]interface{})
+	assert.Equal(t, "subcommands", aclDocs[6])
+	assert.Equal(t, "acl|setuser", aclDocs[7].([]interface{})[0])
+	for name := range server.commands {
+		_, ok := commandDocs[name]
+		assert.True(t, ok, name)
+	}
+
+	list := mustParseResp(t, runQuery(t, c, "command list\r\n")).([]interface{})
+	assert.Contains(t, list, "client|id")
+	assert.Contains(t, list, "zadd")
+	assert.Equal(t, []interface{}{"zadd", "zrange"}, mustParseResp(t, runQuery(t, c, "command list filterby aclcat sortedset\r\n")))
+	assert.Equal(t, []interface{}{"client|setname", "client|getname"}, mustParseResp(t, runQuery(t, c, "command list filterby pattern client|?etname\r\n")))
+	assert.Equal(t, "*0\r\n", runQuery(t, c, "command list filterby module foo\r\n"))
+	assert.Equal(t, "-ERR syntax error\r\n", runQuery(t, c, "command list filterby foo bar\r\n"))
+
+	assert.Equal(t, "*1\r\n$3\r\nkey\r\n", runQuery(t, c, "command getkeys zrange key 0 -1\r\n"))
+	assert.Equal(t, "-ERR Invalid command specified\r\n", runQuery(t, c, "command getkeys nosuch key\r\n"))
+	assert.Equal(t, "-ERR Invalid number of arguments specified for command\r\n", runQuery(t, c, "command getkeys get\r\n"))
+	assert.Equal(t, "-ERR The command has no key arguments\r\n", runQuery(t, c, "command getkeys info all\r\n"))
+	server.freeClient(c)
+}
+
+func TestMulti(t *testing.T) {
+	var conf Config
+	assert.Nil(t, server.initServer(&conf))
+	c := newTestClient(t, "", 0)
+
+	assert.Equal(t, "-ERR EXEC without MULTI\r\n", runQuery(t, c, "exec\r\n"))
+	assert.Equal(t, "-ERR DISCARD without MULTI\r\n", runQuery(t, c, "discard\r\n"))
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "multi\r\n"))
+	assert.Equal(t, "-ERR MULTI calls can not be nested\r\n", runQuery(t, c, "multi\r\n"))
+	assert.Equal(t, "+QUEUED\r\n+QUEUED\r\n+QUEUED\r\n", runQuery(t, c, "set k v\r\nget k\r\nlpush k a\r\n"))
+	assert.Nil(t, server.db.data.Get(CreateObject(GSTR, "k")))
+	assert.Contains(t, runQuery(t, c, "client list\r\n"), "+QUEUED")
+	assert.Contains(t, catClientInfoString(c), " flags=x ")
+	assert.True(t, strings.HasPrefix(runQuery(t, c, "exec\r\n"), "*4\r\n+OK\r\n$1\r\nv\r\n-ERR: wrong type\r\n"))
+	assert.Equal(t, 0, c.flags&CLIENT_MULTI)
+	assert.Equal(t, "$1\r\nv\r\n", runQuery(t, c, "get k\r\n"))
+
+	// DISCARD丢弃排队的命令
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n+OK\r\n", runQuery(t, c, "multi\r\nset k v2\r\ndiscard\r\n"))
+	assert.Equal(t, "$1\r\nv\r\n", runQuery(t, c, "get k\r\n"))
+	assert.Equal(t, 0, len(c.mstate.commands))
+
+	// 排队时出错的事务整体不执行
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n", runQuery(t, c, "multi\r\nset k v3\r\n"))
+	assert.Contains(t, runQuery(t, c, "nosuch k\r\n"), "-ERR unknown command")
+	assert.Equal(t, "-ERR wrong number of arguments for 'get' command\r\n", runQuery(t, c, "get\r\n"))
+	assert.Equal(t, "-EXECABORT Transaction discarded because of previous errors.\r\n", runQuery(t, c, "exec\r\n"))
+	assert.Equal(t, "$1\r\nv\r\n", runQuery(t, c, "get k\r\n"))
+
+	// 包含写命令的事务在CLIENT PAUSE WRITE期间整体推迟
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n", runQuery(t, c, "multi\r\nset k v4\r\n"))
+	server.pauseClients(PAUSE_WRITE, GetMsTime()+10000)
+	assert.Equal(t, "", runQuery(t, c, "exec\r\n"))
+	server.unpauseClients()
+	assert.Equal(t, "*1\r\n+OK\r\n", takeReply(c))
+
+	k := CreateObject(GSTR, "k")
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n", runQuery(t, c, "multi\r\nget k\r\n"))
+	args := c.mstate.commands[0].args
+	assert.Equal(t, 1, args[0].refCount) //c.args已经释放，只被队列引用
+	server.freeClient(c)
+	assert.Equal(t, 0, args[0].refCount)
+	assert.Equal(t, "v4", server.db.data.Get(k).StrVal())
+}
+
+func TestDel(t *testing.T) {
+	var conf Config
+	assert.Nil(t, server.initServer(&conf))
+	c := newTestClient(t, "", 0)
+	runQuery(t, c, "set a 1\r\nset b 2\r\nexpire b 100\r\nlpush l x\r\nset e 3\r\n")
+	server.db.expire.Set(CreateObject(GSTR, "e"), CreateFromInt(GetMsTime()-1))
+	dirty := server.dirty
+	assert.Equal(t, ":3\r\n", runQuery(t, c, "del a b l e nokey\r\n"))
+	assert.Equal(t, dirty+3, server.dirty)
+	assert.Equal(t, int64(0), server.db.data.Size())
+	assert.Equal(t, int64(0), server.db.expire.Size())
+	assert.Equal(t, ":0\r\n", runQuery(t, c, "del a\r\n"))
+	server.freeClient(c)
+}
+
+func TestWatch(t *testing.T) {
+	var conf Config
+	assert.Nil(t, server.initServer(&conf))
+	c := newTestClient(t, "", 0)
+	other := newTestClient(t, "", 0)
+
+	// 没有被修改的key不影响EXEC
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "watch k l\r\n"))
+	assert.Equal(t, 1, server.db.watchedKeys["k"].Len())
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n*1\r\n+OK\r\n", runQuery(t, c, "multi\r\nset k v\r\nexec\r\n"))
+	assert.Equal(t, 0, len(server.db.watchedKeys))
+	assert.Nil(t, c.watchedKeys)
+
+	// 其他客户端修改了key，EXEC返回空数组
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "watch k\r\n"))
+	assert.Equal(t, "+OK\r\n", runQuery(t, other, "set k v2\r\n"))
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n*-1\r\n", runQuery(t, c, "multi\r\nset k v3\r\nexec\r\n"))
+	assert.Equal(t, "$2\r\nv2\r\n", runQuery(t, c, "get k\r\n"))
+
+	for _, query := range []string{"lpush l a\r\n", "lpop l\r\n", "zadd z 1 a\r\n", "expire k 100\r\n"} {
+		key := strings.Fields(query)[1]
+		assert.Equal(t, "+OK\r\n", runQuery(t, c, "watch "+key+"\r\n"))
+		runQuery(t, other, query)
+		assert.NotEqual(t, 0, c.flags&CLIENT_DIRTY_CAS, query)
+		assert.Equal(t, "+OK\r\n", runQuery(t, c, "unwatch\r\n"))
+		assert.Equal(t, 0, c.flags&CLIENT_DIRTY_CAS)
+	}
+
+	// WATCH之后过期的key
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "watch k\r\n"))
+	server.db.expire.Set(CreateObject(GSTR, "k"), CreateFromInt(GetMsTime()-1))
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n*-1\r\n", runQuery(t, c, "multi\r\nget k\r\nexec\r\n"))
+	assert.Equal(t, "$-1\r\n", runQuery(t, c, "get k\r\n"))
+
+	// ServerCron删除过期的key
+	assert.Equal(t, "+OK\r\n", runQuery(t, other, "set k v\r\n"))
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "watch k\r\n"))
+	server.db.expire.Set(CreateObject(GSTR, "k"), CreateFromInt(GetMsTime()-1))
+	server.ServerCron(server.aeloop, 0, nil)
+	assert.Nil(t, server.db.data.Get(CreateObject(GSTR, "k")))
+	assert.NotEqual(t, 0, c.flags&CLIENT_DIRTY_CAS)
+
+	assert.Equal(t, "+OK\r\n+OK\r\n", runQuery(t, c, "unwatch\r\nmulti\r\n"))
+	assert.Equal(t, "-ERR WATCH inside MULTI is not allowed\r\n", runQuery(t, c, "watch k\r\n"))
+	assert.Equal(t, "*0\r\n", runQuery(t, c, "exec\r\n"))
+
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "watch k\r\n"))
+	server.freeClient(c)
+	assert.Equal(t, 0, len(server.db.watchedKeys))
+	server.freeClient(other)
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const REDACTED_ARG string = "(redacted)"
+
+// MONITOR 之后客户端会收到服务器执行的每一条命令，admin命令除外
+func (server *GodisServer) monitorCommand(c *GodisClient) {
+	// 已经处于monitor模式时忽略
+	if c.flags&CLIENT_MONITOR != 0 {
+		return
+	}
+	c.flags |= CLIENT_MONITOR
+	server.monitors = append(server.monitors, c)
+	server.AddReplyStr(c, "+OK\r\n")
+}
+
+func (server *GodisServer) removeMonitor(c *GodisClient) {
+	for i, m := range server.monitors {
+		if m == c {
+			server.monitors = append(server.monitors[:i], server.monitors[i+1:]...)
+			break
+		}
+	}
+	c.flags &= ^CLIENT_MONITOR
+}
+
+// redactClientCommandArgument 密码等敏感参数不会出现在MONITOR的输出中
+func redactClientCommandArgument(c *GodisClient, i int) {
+	c.args[i].DecrRefCount()
+	c.args[i] = CreateObject(GSTR, REDACTED_ARG)
+}
+
+// catRepr 与redis的sdscatrepr一致，用双引号包裹并转义不可见字符
+func catRepr(b *strings.Builder, s string) {
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; ch {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case '\t':
+			b.WriteString("\\t")
+		case '\a':
+			b.WriteString("\\a")
+		case '\b':
+			b.WriteString("\\b")
+		default:
+			if ch >= 0x20 && ch < 0x7f {
+				b.WriteByte(ch)
+			} else {
+				fmt.Fprintf(b, "\\x%02x", ch)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
+
+// replicationFeedMonitors 格式与redis-cli monitor相同:
+// +<秒>.<微秒> [<db> <addr>] "arg" "arg" ...
+func (server *GodisServer) replicationFeedMonitors(c *GodisClient, args []*GObj) {
+	var b strings.Builder
+	now := time.Now()
+	fmt.Fprintf(&b, "+%d.%06d ", now.Unix(), now.Nanosecond()/1000)
+	if c.ip == "" {
+		fmt.Fprintf(&b, "[0 unix:%s] ", server.unixsocket)
+	} else {
+		fmt.Fprintf(&b, "[0 %s] ", c.addr)
+	}
+	for i, arg := range args {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		catRepr(&b, arg.StrVal())
+	}
+	b.WriteString("\r\n")
+	line := b.String()
+	for _, m := range server.monitors {
+		server.AddReplyStr(m, line)
+	}
+}
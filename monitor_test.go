@@ -0,0 +1,69 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonitor(t *testing.T) {
+	var conf Config
+	assert.Nil(t, server.initServer(&conf))
+	var clients []*GodisClient
+	for i := 0; i < 2; i++ {
+		clients = append(clients, newTestClient(t, "127.0.0.1", 7000+i))
+	}
+	mon, c := clients[0], clients[1]
+	lines := func() []string {
+		reply := takeReply(mon)
+		return strings.Split(strings.TrimSuffix(reply, "\r\n"), "\r\n")
+	}
+
+	assert.Equal(t, "+OK\r\n", runQuery(t, mon, "monitor\r\n"))
+	assert.Equal(t, "", runQuery(t, mon, "monitor\r\n"))
+	assert.Contains(t, runQuery(t, c, "client list\r\n"), "flags=O ")
+
+	runQuery(t, c, "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$5\r\na b\"\n\r\n")
+	got := lines()
+	assert.Equal(t, 1, len(got))
+	assert.Regexp(t, regexp.MustCompile(`^\+\d+\.\d{6} \[0 127\.0\.0\.1:7001\] "set" "k" "a b\\"\\n"$`), got[0])
+	ReadQuery(c, "*2\r\n$3\r\nget\r\n$3\r\n\x01\xff\t\r\n")
+	assert.Nil(t, server.ProcessQueryBuf(c))
+	assert.True(t, strings.HasSuffix(lines()[0], ` "get" "\x01\xff\t"`))
+
+	// admin命令不会出现在输出中
+	runQuery(t, c, "client setname foo\r\n")
+	assert.Equal(t, "", takeReply(mon))
+
+	// 事务中的命令在EXEC时输出
+	runQuery(t, c, "multi\r\nget k\r\nexec\r\n")
+	got = lines()
+	assert.Equal(t, 3, len(got))
+	assert.True(t, strings.HasSuffix(got[0], `] "multi"`))
+	assert.True(t, strings.HasSuffix(got[1], `] "get" "k"`))
+	assert.True(t, strings.HasSuffix(got[2], `] "exec"`))
+
+	// 密码被隐藏
+	runQuery(t, c, "auth secret\r\nauth user pass\r\nhello 2 auth default pwd setname bar\r\n")
+	got = lines()
+	assert.Equal(t, 3, len(got))
+	assert.True(t, strings.HasSuffix(got[0], `] "auth" "(redacted)"`))
+	assert.True(t, strings.HasSuffix(got[1], `] "auth" "(redacted)" "(redacted)"`))
+	assert.True(t, strings.HasSuffix(got[2], `] "hello" "2" "auth" "(redacted)" "(redacted)" "setname" "bar"`))
+
+	server.freeClient(mon)
+	assert.Equal(t, 0, len(server.monitors))
+	server.freeClient(c)
+}
+
+func TestMonitorUnixSocket(t *testing.T) {
+	var conf Config
+	assert.Nil(t, server.initServer(&conf))
+	server.unixsocket = "/tmp/godis.sock"
+	c := newTestClient(t, "", 0)
+	runQuery(t, c, "monitor\r\n")
+	assert.Regexp(t, `^\+PONG\r\n\+\d+\.\d{6} \[0 unix:/tmp/godis.sock\] "ping"\r\n$`, runQuery(t, c, "ping\r\n"))
+	server.freeClient(c)
+}
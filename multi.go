@@ -0,0 +1,201 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+)
+
+// queuedCmd MULTI之后排队的命令
+type queuedCmd struct {
+	cmd  *GodisCommand
+	args []*GObj
+}
+
+type multiState struct {
+	commands []queuedCmd
+	cmdFlags int //所有排队命令flags的并集
+}
+
+type watchedKey struct {
+	key     string
+	db      *GodisDB
+	expired bool //WATCH时key已经过期，之后才过期的key会让EXEC失败
+}
+
+func (server *GodisServer) queueMultiCommand(c *GodisClient, cmd *GodisCommand) {
+	// 出错的事务不会执行，没有必要继续排队
+	if c.flags&CLIENT_DIRTY_EXEC != 0 {
+		return
+	}
+	args := make([]*GObj, len(c.args))
+	for i, arg := range c.args {
+		arg.IncrRefCount() //resetClient会释放c.args
+		args[i] = arg
+	}
+	c.mstate.commands = append(c.mstate.commands, queuedCmd{cmd: cmd, args: args})
+	c.mstate.cmdFlags |= cmd.flags
+}
+
+func freeClientMultiState(c *GodisClient) {
+	for _, mc := range c.mstate.commands {
+		for _, arg := range mc.args {
+			arg.DecrRefCount()
+		}
+	}
+	c.mstate = multiState{}
+}
+
+func (server *GodisServer) discardTransaction(c *GodisClient) {
+	freeClientMultiState(c)
+	c.flags &= ^(CLIENT_MULTI | CLIENT_DIRTY_EXEC | CLIENT_DIRTY_CAS)
+	server.unwatchAllKeys(c)
+}
+
+// flagTransaction 排队时出错的命令让之后的EXEC失败
+func flagTransaction(c *GodisClient) {
+	if c.flags&CLIENT_MULTI != 0 {
+		c.flags |= CLIENT_DIRTY_EXEC
+	}
+}
+
+// isMultiControlCommand 事务中这些命令直接执行而不排队
+func (server *GodisServer) isMultiControlCommand(cmd *GodisCommand) bool {
+	return cmd == server.execCmd || cmd == server.discardCmd || cmd == server.multiCmd ||
+		cmd == server.quitCmd || cmd == server.watchCmd
+}
+
+func (server *GodisServer) multiCommand(c *GodisClient) {
+	if c.flags&CLIENT_MULTI != 0 {
+		server.AddReplyStr(c, "-ERR MULTI calls can not be nested\r\n")
+		return
+	}
+	c.flags |= CLIENT_MULTI
+	server.AddReplyStr(c, "+OK\r\n")
+}
+
+func (server *GodisServer) discardCommand(c *GodisClient) {
+	if c.flags&CLIENT_MULTI == 0 {
+		server.AddReplyStr(c, "-ERR DISCARD without MULTI\r\n")
+		return
+	}
+	server.discardTransaction(c)
+	server.AddReplyStr(c, "+OK\r\n")
+}
+
+// execCommand 依次执行排队的命令，回复为各命令回复组成的数组
+func (server *GodisServer) execCommand(c *GodisClient) {
+	if c.flags&CLIENT_MULTI == 0 {
+		server.AddReplyStr(c, "-ERR EXEC without MULTI\r\n")
+		return
+	}
+	if c.flags&CLIENT_DIRTY_EXEC != 0 {
+		server.AddReplyStr(c, "-EXECABORT Transaction discarded because of previous errors.\r\n")
+		server.discardTransaction(c)
+		return
+	}
+	if c.flags&CLIENT_DIRTY_CAS != 0 || server.isWatchedKeyExpired(c) {
+		server.AddReplyStr(c, "*-1\r\n")
+		server.discardTransaction(c)
+		return
+	}
+	// 执行期间自身的修改不应让事务失败
+	server.unwatchAllKeys(c)
+
+	origArgs := c.args
+	commands := c.mstate.commands
+	server.AddReplyStr(c, fmt.Sprintf("*%d\r\n", len(commands)))
+	server.inExec = true
+	for _, mc := range commands {
+		c.args = mc.args
+		// 排队之后用户的权限可能被修改，执行前再检查一次
+		if result, _ := server.aclCheckCommandPerm(c.user, mc.cmd, mc.args); result != ACL_OK {
+			server.AddReplyStr(c, aclDeniedReply(c.user, mc.cmd, result))
+			continue
+		}
+		server.call(c, mc.cmd)
+	}
+	c.args = origArgs
+	// 第一个写命令传播前已经传播了MULTI
+	if server.multiPropagated {
+		exec := CreateObject(GSTR, "EXEC")
+		server.replicationFeedSlaves([]*GObj{exec})
+		exec.DecrRefCount()
+	}
+	server.inExec = false
+	server.multiPropagated = false
+	server.discardTransaction(c)
+}
+
+// WATCH key [key ...]
+func (server *GodisServer) watchCommand(c *GodisClient) {
+	if c.flags&CLIENT_MULTI != 0 {
+		server.AddReplyStr(c, "-ERR WATCH inside MULTI is not allowed\r\n")
+		return
+	}
+	// 已经被修改过的事务必定失败，不用再WATCH
+	if c.flags&CLIENT_DIRTY_CAS == 0 {
+		for _, key := range c.args[1:] {
+			server.watchForKey(c, key)
+		}
+	}
+	server.AddReplyStr(c, "+OK\r\n")
+}
+
+func (server *GodisServer) unwatchCommand(c *GodisClient) {
+	server.unwatchAllKeys(c)
+	c.flags &= ^CLIENT_DIRTY_CAS
+	server.AddReplyStr(c, "+OK\r\n")
+}
+
+func (server *GodisServer) watchForKey(c *GodisClient, key *GObj) {
+	k := key.StrVal()
+	for _, wk := range c.watchedKeys {
+		if wk.db == c.db && wk.key == k {
+			return
+		}
+	}
+	clients := c.db.watchedKeys[k]
+	if clients == nil {
+		clients = list.New()
+		c.db.watchedKeys[k] = clients
+	}
+	clients.PushBack(c)
+	c.watchedKeys = append(c.watchedKeys, watchedKey{key: k, db: c.db, expired: server.keyIsExpired(key)})
+}
+
+func (server *GodisServer) unwatchAllKeys(c *GodisClient) {
+	for _, wk := range c.watchedKeys {
+		clients := wk.db.watchedKeys[wk.key]
+		for e := clients.Front(); e != nil; e = e.Next() {
+			if e.Value.(*GodisClient) == c {
+				clients.Remove(e)
+				break
+			}
+		}
+		if clients.Len() == 0 {
+			delete(wk.db.watchedKeys, wk.key)
+		}
+	}
+	c.watchedKeys = nil
+}
+
+// isWatchedKeyExpired WATCH之后过期但还没有被删除的key
+func (server *GodisServer) isWatchedKeyExpired(c *GodisClient) bool {
+	for _, wk := range c.watchedKeys {
+		if !wk.expired && server.keyIsExpired(CreateObject(GSTR, wk.key)) {
+			return true
+		}
+	}
+	return false
+}
+
+// touchWatchedKey 标记WATCH该key的客户端，它们的EXEC会失败
+func touchWatchedKey(db *GodisDB, key string) {
+	clients := db.watchedKeys[key]
+	if clients == nil {
+		return
+	}
+	for e := clients.Front(); e != nil; e = e.Next() {
+		e.Value.(*GodisClient).flags |= CLIENT_DIRTY_CAS
+	}
+}
@@ -1,38 +1,165 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"os"
+	"strconv"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
 const BACKLOG int = 64
 
-func Accept(fd int) (int, error) {
-	nfd, _, err := unix.Accept(fd)
-	return nfd, err
+func sockaddrToIpPort(sa unix.Sockaddr) (string, int) {
+	switch addr := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.IP(addr.Addr[:]).String(), addr.Port
+	case *unix.SockaddrInet6:
+		return net.IP(addr.Addr[:]).String(), addr.Port
+	}
+	return "", 0
 }
 
-func Connect(host [4]byte, port int) (int, error) {
-	s, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
-	// unix.AF_INET ipv4
+func ipPortToSockaddr(host string, port int) (int, unix.Sockaddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return -1, nil, fmt.Errorf("invalid ip address: %v", host)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		var addr unix.SockaddrInet4
+		copy(addr.Addr[:], ip4)
+		addr.Port = port
+		return unix.AF_INET, &addr, nil
+	}
+	var addr unix.SockaddrInet6
+	copy(addr.Addr[:], ip.To16())
+	addr.Port = port
+	return unix.AF_INET6, &addr, nil
+}
+
+// FormatAddr 与redis一致，ipv6地址加上方括号: [::1]:6767
+func FormatAddr(ip string, port int) string {
+	return net.JoinHostPort(ip, strconv.Itoa(port))
+}
+
+// Accept 返回新连接的fd以及对端的ip与端口, unix socket连接的ip为空
+func Accept(fd int) (int, string, int, error) {
+	nfd, sa, err := unix.Accept(fd)
+	if err != nil {
+		return nfd, "", 0, err
+	}
+	ip, port := sockaddrToIpPort(sa)
+	return nfd, ip, port, nil
+}
+
+// LocalAddr 返回fd的本端地址 ip:port
+func LocalAddr(fd int) string {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return ""
+	}
+	ip, port := sockaddrToIpPort(sa)
+	return FormatAddr(ip, port)
+}
+
+func Connect(host string, port int) (int, error) {
+	domain, addr, err := ipPortToSockaddr(host, port)
+	if err != nil {
+		log.Printf("connect addr err: %v\n", err)
+		return -1, err
+	}
+	s, err := unix.Socket(domain, unix.SOCK_STREAM, 0)
+	// unix.AF_INET ipv4, unix.AF_INET6 ipv6
 	// unix.SOCK_STREAM 流式协议，即tcp协议
 	// unix.SOCK_DGRAM 数据报协议，即udp协议
 	if err != nil {
 		log.Printf("init socket err: %v\n", err)
 		return -1, err
 	}
-	var addr unix.SockaddrInet4
-	addr.Addr = host
-	addr.Port = port
-	err = unix.Connect(s, &addr)
+	err = unix.Connect(s, addr)
 	if err != nil {
 		log.Printf("connect err: %v\n", err)
+		unix.Close(s)
 		return -1, err
 	}
 	return s, nil
 }
 
+// ConnectNonBlock 发起非阻塞连接，返回时连接可能还在进行中，
+// fd可写后通过GetSockError获取连接的结果
+func ConnectNonBlock(host string, port int) (int, error) {
+	domain, addr, err := ipPortToSockaddr(host, port)
+	if err != nil {
+		return -1, err
+	}
+	s, err := unix.Socket(domain, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return -1, err
+	}
+	if err := unix.SetNonblock(s, true); err != nil {
+		unix.Close(s)
+		return -1, err
+	}
+	err = unix.Connect(s, addr)
+	if err != nil && !errors.Is(err, unix.EINPROGRESS) {
+		unix.Close(s)
+		return -1, err
+	}
+	return s, nil
+}
+
+// GetSockError 返回fd上待处理的错误(SO_ERROR)，用于获取非阻塞连接的结果
+func GetSockError(fd int) error {
+	errno, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return unix.Errno(errno)
+	}
+	return nil
+}
+
+// IsTemporary 判断读写错误是否只是暂时的: 非阻塞fd上没有数据可读或缓冲区已满(EAGAIN)，
+// 或者系统调用被信号中断(EINTR)，这两种情况都不应关闭连接
+func IsTemporary(err error) bool {
+	return errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR)
+}
+
+func SetNonBlock(fd int) error {
+	return unix.SetNonblock(fd, true)
+}
+
+func SetTcpNoDelay(fd int) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1)
+}
+
+// SetKeepAlive 开启SO_KEEPALIVE, interval秒无数据后开始探测,
+// 与redis相同，探测间隔为interval/3，连续3次无响应则断开
+func SetKeepAlive(fd int, interval int) error {
+	err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1)
+	if err != nil {
+		return err
+	}
+	err = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, interval)
+	if err != nil {
+		return err
+	}
+	intvl := interval / 3
+	if intvl == 0 {
+		intvl = 1
+	}
+	err = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, intvl)
+	if err != nil {
+		return err
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, 3)
+}
+
 func Read(fd int, buf []byte) (int, error) {
 	return unix.Read(fd, buf)
 }
@@ -41,27 +168,48 @@ func Write(fd int, buf []byte) (int, error) {
 	return unix.Write(fd, buf)
 }
 
+func Writev(fd int, bufs [][]byte) (int, error) {
+	return unix.Writev(fd, bufs)
+}
+
+// strBytes 不拷贝地把string转为[]byte，返回值只能读
+func strBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
+
 func Close(fd int) error {
 	return unix.Close(fd)
 }
 
-func TcpServer(port int) (int, error) {
-	s, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+func TcpServer(host string, port int) (int, error) {
+	domain, addr, err := ipPortToSockaddr(host, port)
+	if err != nil {
+		log.Printf("bind addr err: %v\n", err)
+		return -1, err
+	}
+	s, err := unix.Socket(domain, unix.SOCK_STREAM, 0)
 	if err != nil {
 		log.Printf("init socket err: %v\n", err)
 		return -1, err
 	}
-	err = unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_REUSEPORT, port)
-	// unix.SO_REUSEPORT 允许重用本地端口
+	err = unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+	// unix.SO_REUSEADDR 允许重用处于TIME_WAIT的本地端口
 	if err != nil {
-		log.Printf("set SO_REUSEPORT err: %v\n", err)
+		log.Printf("set SO_REUSEADDR err: %v\n", err)
 		unix.Close(s)
 		return -1, err
 	}
+	if domain == unix.AF_INET6 {
+		// 只监听ipv6，使 :: 与 0.0.0.0 可以同时绑定同一端口
+		err = unix.SetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 1)
+		if err != nil {
+			log.Printf("set IPV6_V6ONLY err: %v\n", err)
+			unix.Close(s)
+			return -1, err
+		}
+	}
 
-	var addr unix.SockaddrInet4
-	addr.Port = port
-	err = unix.Bind(s, &addr)
+	err = unix.Bind(s, addr)
 	if err != nil {
 		log.Printf("bind addr err: %v\n", err)
 		unix.Close(s)
@@ -74,5 +222,61 @@ func TcpServer(port int) (int, error) {
 		unix.Close(s)
 		return -1, err
 	}
+	err = SetNonBlock(s)
+	if err != nil {
+		log.Printf("set nonblock err: %v\n", err)
+		unix.Close(s)
+		return -1, err
+	}
+	return s, nil
+}
+
+func UnixServer(path string, perm uint32) (int, error) {
+	// 清理上次异常退出遗留的socket文件
+	if err := RemoveUnixSocket(path); err != nil {
+		log.Printf("remove stale unix socket err: %v\n", err)
+		return -1, err
+	}
+	s, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		log.Printf("init unix socket err: %v\n", err)
+		return -1, err
+	}
+
+	err = unix.Bind(s, &unix.SockaddrUnix{Name: path})
+	if err != nil {
+		log.Printf("bind unix socket err: %v\n", err)
+		unix.Close(s)
+		return -1, err
+	}
+	if perm != 0 {
+		err = unix.Chmod(path, perm)
+		if err != nil {
+			log.Printf("chmod unix socket err: %v\n", err)
+			unix.Close(s)
+			return -1, err
+		}
+	}
+
+	err = unix.Listen(s, BACKLOG)
+	if err != nil {
+		log.Printf("listen unix socket err: %v\n", err)
+		unix.Close(s)
+		return -1, err
+	}
+	err = SetNonBlock(s)
+	if err != nil {
+		log.Printf("set nonblock err: %v\n", err)
+		unix.Close(s)
+		return -1, err
+	}
 	return s, nil
 }
+
+func RemoveUnixSocket(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -2,21 +2,25 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 )
 
 func EchoServer(s, c, e chan struct{}) {
-	sfd, err := TcpServer(6666)
+	sfd, err := TcpServer("0.0.0.0", 6666)
 	if err != nil {
 		fmt.Printf("tcp server error: %v\n", err)
 	}
 	fmt.Println("server started")
 	s <- struct{}{}
 	<-c
-	cfd, err := Accept(sfd)
+	cfd, _, _, err := Accept(sfd)
 	fmt.Printf("accepted cfd: %v\n", cfd)
 	if err != nil {
 		fmt.Printf("server accpet error: %v\n", err)
@@ -43,8 +47,7 @@ func useTestAeInstead(t *testing.T) {
 	e := make(chan struct{})
 	go EchoServer(s, c, e)
 	<-s
-	host := [4]byte{127, 0, 0, 1}
-	cfd, err := Connect(host, 6666)
+	cfd, err := Connect("127.0.0.1", 6666)
 	fmt.Printf("connected cfd: %v\n", cfd)
 	time.Sleep(100 * time.Millisecond)
 	c <- struct{}{}
@@ -60,3 +63,83 @@ func useTestAeInstead(t *testing.T) {
 	assert.Equal(t, 10, n)
 	assert.Equal(t, msg, string(buf))
 }
+
+func TestUnixServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godis.sock")
+	// stale socket file left by a crashed server
+	stale, err := os.Create(path)
+	assert.Nil(t, err)
+	stale.Close()
+
+	sfd, err := UnixServer(path, 0700)
+	assert.Nil(t, err)
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	conn, err := net.Dial("unix", path)
+	assert.Nil(t, err)
+	cfd, _, _, err := Accept(sfd)
+	assert.Nil(t, err)
+	msg := "helloworld"
+	_, err = conn.Write([]byte(msg))
+	assert.Nil(t, err)
+	buf := make([]byte, 10)
+	n, err := Read(cfd, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, string(buf[:n]))
+
+	conn.Close()
+	Close(cfd)
+	Close(sfd)
+	assert.Nil(t, RemoveUnixSocket(path))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTcpServerIPv6(t *testing.T) {
+	sfd, err := TcpServer("::1", 6668)
+	if err != nil {
+		t.Skipf("ipv6 loopback unavailable: %v", err)
+	}
+	defer Close(sfd)
+	// ipv4 listener on the same port must not conflict with IPV6_V6ONLY
+	sfd4, err := TcpServer("127.0.0.1", 6668)
+	assert.Nil(t, err)
+	defer Close(sfd4)
+
+	cfd, err := Connect("::1", 6668)
+	assert.Nil(t, err)
+	defer Close(cfd)
+	nfd, ip, port, err := Accept(sfd)
+	assert.Nil(t, err)
+	defer Close(nfd)
+	assert.Equal(t, "::1", ip)
+	assert.NotEqual(t, 0, port)
+	assert.Equal(t, fmt.Sprintf("[::1]:%d", port), FormatAddr(ip, port))
+
+	_, err = TcpServer("not-an-ip", 6668)
+	assert.NotNil(t, err)
+}
+
+func TestNonBlock(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	defer Close(fds[0])
+	defer Close(fds[1])
+	assert.Nil(t, SetNonBlock(fds[0]))
+
+	buf := make([]byte, 10)
+	_, err = Read(fds[0], buf)
+	assert.True(t, IsTemporary(err))
+
+	// fill the send buffer until the kernel pushes back
+	chunk := make([]byte, 4096)
+	for {
+		_, err = Write(fds[0], chunk)
+		if err != nil {
+			break
+		}
+	}
+	assert.True(t, IsTemporary(err))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// notify-keyspace-events的类型，与redis一致
+const (
+	NOTIFY_KEYSPACE int = 1 << 0  //K
+	NOTIFY_KEYEVENT int = 1 << 1  //E
+	NOTIFY_GENERIC  int = 1 << 2  //g
+	NOTIFY_STRING   int = 1 << 3  //$
+	NOTIFY_LIST     int = 1 << 4  //l
+	NOTIFY_SET      int = 1 << 5  //s
+	NOTIFY_HASH     int = 1 << 6  //h
+	NOTIFY_ZSET     int = 1 << 7  //z
+	NOTIFY_EXPIRED  int = 1 << 8  //x
+	NOTIFY_EVICTED  int = 1 << 9  //e
+	NOTIFY_STREAM   int = 1 << 10 //t
+	NOTIFY_KEY_MISS int = 1 << 11 //m，不包含在A中
+	NOTIFY_MODULE   int = 1 << 13 //d
+	NOTIFY_NEW      int = 1 << 14 //n，不包含在A中
+
+	NOTIFY_ALL int = NOTIFY_GENERIC | NOTIFY_STRING | NOTIFY_LIST | NOTIFY_SET | NOTIFY_HASH |
+		NOTIFY_ZSET | NOTIFY_EXPIRED | NOTIFY_EVICTED | NOTIFY_STREAM | NOTIFY_MODULE //A
+)
+
+var notifyFlagChars = []struct {
+	ch   byte
+	flag int
+}{
+	{'A', NOTIFY_ALL},
+	{'g', NOTIFY_GENERIC},
+	{'$', NOTIFY_STRING},
+	{'l', NOTIFY_LIST},
+	{'s', NOTIFY_SET},
+	{'h', NOTIFY_HASH},
+	{'z', NOTIFY_ZSET},
+	{'x', NOTIFY_EXPIRED},
+	{'e', NOTIFY_EVICTED},
+	{'t', NOTIFY_STREAM},
+	{'m', NOTIFY_KEY_MISS},
+	{'d', NOTIFY_MODULE},
+	{'n', NOTIFY_NEW},
+	{'K', NOTIFY_KEYSPACE},
+	{'E', NOTIFY_KEYEVENT},
+}
+
+// keyspaceEventsStringToFlags 把 "KEA" 这样的配置转为flags
+func keyspaceEventsStringToFlags(classes string) (int, error) {
+	flags := 0
+	for i := 0; i < len(classes); i++ {
+		found := false
+		for _, fc := range notifyFlagChars {
+			if fc.ch == classes[i] {
+				flags |= fc.flag
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid notify-keyspace-events class %q", classes[i])
+		}
+	}
+	return flags, nil
+}
+
+// keyspaceEventsFlagsToString 包含全部类型时输出A
+func keyspaceEventsFlagsToString(flags int) string {
+	var res strings.Builder
+	if flags&NOTIFY_ALL == NOTIFY_ALL {
+		res.WriteByte('A')
+		flags &= ^NOTIFY_ALL
+	}
+	for _, fc := range notifyFlagChars[1:] {
+		if flags&fc.flag != 0 {
+			res.WriteByte(fc.ch)
+		}
+	}
+	return res.String()
+}
+
+// notifyKeyspaceEvent 发布 __keyspace@<db>__:<key> 与 __keyevent@<db>__:<event> 消息
+func (server *GodisServer) notifyKeyspaceEvent(eventType int, event string, key string, dbid int) {
+	if server.notifyKeyspaceEvents&eventType == 0 {
+		return
+	}
+	if server.notifyKeyspaceEvents&NOTIFY_KEYSPACE != 0 {
+		server.pubsubPublishMessage(fmt.Sprintf("__keyspace@%d__:%s", dbid, key), event, false)
+	}
+	if server.notifyKeyspaceEvents&NOTIFY_KEYEVENT != 0 {
+		server.pubsubPublishMessage(fmt.Sprintf("__keyevent@%d__:%s", dbid, event), key, false)
+	}
+}
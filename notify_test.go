@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyspaceEventsFlags(t *testing.T) {
+	flags, err := keyspaceEventsStringToFlags("KEA")
+	assert.Nil(t, err)
+	assert.Equal(t, NOTIFY_KEYSPACE|NOTIFY_KEYEVENT|NOTIFY_ALL, flags)
+	assert.Equal(t, "AKE", keyspaceEventsFlagsToString(flags))
+	flags, err = keyspaceEventsStringToFlags("Ex$")
+	assert.Nil(t, err)
+	assert.Equal(t, "$xE", keyspaceEventsFlagsToString(flags))
+	flags, err = keyspaceEventsStringToFlags("")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, flags)
+	_, err = keyspaceEventsStringToFlags("KEq")
+	assert.NotNil(t, err)
+
+	conf := Config{NotifyKeyspaceEvents: "Kw"}
+	assert.NotNil(t, server.initServer(&conf))
+}
+
+func TestKeyspaceNotify(t *testing.T) {
+	conf := Config{NotifyKeyspaceEvents: "KEA"}
+	assert.Nil(t, server.initServer(&conf))
+	var clients []*GodisClient
+	for i := 0; i < 3; i++ {
+		clients = append(clients, newTestClient(t, "", 0))
+	}
+	space, event, c := clients[0], clients[1], clients[2]
+	runQuery(t, space, "psubscribe __keyspace@0__:*\r\n")
+	runQuery(t, event, "psubscribe __keyevent@0__:*\r\n")
+	spaceMsg := func(key, ev string) string {
+		ch := "__keyspace@0__:" + key
+		return "*4\r\n$8\r\npmessage\r\n$16\r\n__keyspace@0__:*\r\n" + bulkString(ch) + bulkString(ev)
+	}
+	eventMsg := func(key, ev string) string {
+		ch := "__keyevent@0__:" + ev
+		return "*4\r\n$8\r\npmessage\r\n$16\r\n__keyevent@0__:*\r\n" + bulkString(ch) + bulkString(key)
+	}
+
+	// n不包含在A中
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "set k v\r\n"))
+	assert.Equal(t, spaceMsg("k", "set"), takeReply(space))
+	assert.Equal(t, eventMsg("k", "set"), takeReply(event))
+
+	assert.Equal(t, ":1\r\n+OK\r\n$1\r\na\r\n+OK\r\n", runQuery(t, c, "expire k 100\r\nlpush l a\r\nlpop l\r\nzadd z 1 a\r\n"))
+	assert.Equal(t, spaceMsg("k", "expire")+spaceMsg("l", "lpush")+spaceMsg("l", "lpop")+spaceMsg("z", "zadd"), takeReply(space))
+	assert.Equal(t, eventMsg("k", "expire")+eventMsg("l", "lpush")+eventMsg("l", "lpop")+eventMsg("z", "zadd"), takeReply(event))
+
+	// key不存在时没有事件
+	dirty := server.dirty
+	assert.Equal(t, ":0\r\n", runQuery(t, c, "expire nosuch 100\r\n"))
+	assert.Equal(t, "", takeReply(space))
+	assert.Equal(t, dirty, server.dirty)
+
+	// 被动过期与主动过期
+	server.db.expire.Set(CreateObject(GSTR, "k"), CreateFromInt(GetMsTime()-1))
+	assert.Equal(t, "$-1\r\n", runQuery(t, c, "get k\r\n"))
+	assert.Equal(t, spaceMsg("k", "expired"), takeReply(space))
+	assert.Equal(t, eventMsg("k", "expired"), takeReply(event))
+	runQuery(t, c, "set k v\r\n")
+	takeReply(space)
+	takeReply(event)
+	server.db.expire.Set(CreateObject(GSTR, "k"), CreateFromInt(GetMsTime()-1))
+	server.ServerCron(server.aeloop, 0, nil)
+	assert.Equal(t, spaceMsg("k", "expired"), takeReply(space))
+
+	// 只订阅部分类型
+	server.notifyKeyspaceEvents, _ = keyspaceEventsStringToFlags("Enm")
+	takeReply(event)
+	runQuery(t, c, "set k v\r\nget nosuch\r\n")
+	assert.Equal(t, eventMsg("k", "new")+eventMsg("nosuch", "keymiss"), takeReply(event))
+	assert.Equal(t, "", takeReply(space))
+	for _, client := range clients {
+		server.freeClient(client)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type pubsubPattern struct {
+	client  *GodisClient
+	pattern string
+}
+
+// pubsubType 区分普通channel与sharded channel，两者的订阅互相独立
+type pubsubType struct {
+	shard          bool
+	subscribeMsg   string
+	unsubscribeMsg string
+	messageBulk    string
+}
+
+var (
+	pubsubTypeGlobal = pubsubType{false, "subscribe", "unsubscribe", "message"}
+	pubsubTypeShard  = pubsubType{true, "ssubscribe", "sunsubscribe", "smessage"}
+)
+
+// clientPubsubChannels 客户端订阅的channel -> 在服务端链表中的位置
+func clientPubsubChannels(c *GodisClient, t pubsubType) map[string]*list.Element {
+	if t.shard {
+		return c.pubsubShardChannels
+	}
+	return c.pubsubChannels
+}
+
+// serverPubsubChannels sharded channel按hash slot分桶，create为false时可能返回nil
+func (server *GodisServer) serverPubsubChannels(t pubsubType, channel string, create bool) map[string]*list.List {
+	if !t.shard {
+		return server.pubsubChannels
+	}
+	slot := keyHashSlot(channel)
+	if server.pubsubShardChannels[slot] == nil && create {
+		server.pubsubShardChannels[slot] = make(map[string]*list.List)
+	}
+	return server.pubsubShardChannels[slot]
+}
+
+// clientSubscriptionsCount SUBSCRIBE等命令回复中的订阅数
+func clientSubscriptionsCount(c *GodisClient, t pubsubType) int {
+	if t.shard {
+		return len(c.pubsubShardChannels)
+	}
+	return len(c.pubsubChannels) + len(c.pubsubPatterns)
+}
+
+// updatePubsubFlag 有任何订阅时进入订阅模式
+func updatePubsubFlag(c *GodisClient) {
+	if clientSubscriptionsCount(c, pubsubTypeGlobal)+clientSubscriptionsCount(c, pubsubTypeShard) > 0 {
+		c.flags |= CLIENT_PUBSUB
+	} else {
+		c.flags &= ^CLIENT_PUBSUB
+	}
+}
+
+// addReplyPush 推送的消息不受CLIENT REPLY OFF影响，RESP3使用push类型，RESP2使用数组
+func (server *GodisServer) addReplyPush(c *GodisClient, n int, body string) {
+	header := fmt.Sprintf("*%d\r\n", n)
+	if c.resp == 3 {
+		header = fmt.Sprintf(">%d\r\n", n)
+	}
+	c.flags |= CLIENT_PUSHING
+	server.AddReplyStr(c, header+body)
+	c.flags &= ^CLIENT_PUSHING
+}
+
+func (server *GodisServer) addReplyPubsubSubscribed(c *GodisClient, kind, channel string, count int) {
+	server.addReplyPush(c, 3, fmt.Sprintf("%s%s:%d\r\n", bulkString(kind), bulkString(channel), count))
+}
+
+// addReplyPubsubUnsubscribed none表示客户端没有任何订阅，channel回复为nil
+func (server *GodisServer) addReplyPubsubUnsubscribed(c *GodisClient, kind, channel string, none bool, count int) {
+	ch := bulkString(channel)
+	if none {
+		ch = "$-1\r\n"
+	}
+	server.addReplyPush(c, 3, fmt.Sprintf("%s%s:%d\r\n", bulkString(kind), ch, count))
+}
+
+// pubsubSubscribeChannel 返回是否是新的订阅
+func (server *GodisServer) pubsubSubscribeChannel(c *GodisClient, channel string, t pubsubType) bool {
+	subscribed := clientPubsubChannels(c, t)
+	if _, ok := subscribed[channel]; ok {
+		return false
+	}
+	channels := server.serverPubsubChannels(t, channel, true)
+	clients := channels[channel]
+	if clients == nil {
+		clients = list.New()
+		channels[channel] = clients
+	}
+	subscribed[channel] = clients.PushBack(c)
+	return true
+}
+
+func (server *GodisServer) pubsubUnsubscribeChannel(c *GodisClient, channel string, t pubsubType) bool {
+	subscribed := clientPubsubChannels(c, t)
+	e, ok := subscribed[channel]
+	if !ok {
+		return false
+	}
+	delete(subscribed, channel)
+	channels := server.serverPubsubChannels(t, channel, false)
+	clients := channels[channel]
+	clients.Remove(e)
+	if clients.Len() == 0 {
+		delete(channels, channel)
+		if t.shard && len(channels) == 0 {
+			server.pubsubShardChannels[keyHashSlot(channel)] = nil
+		}
+	}
+	return true
+}
+
+func (server *GodisServer) pubsubSubscribePattern(c *GodisClient, pattern string) bool {
+	for _, p := range c.pubsubPatterns {
+		if p == pattern {
+			return false
+		}
+	}
+	c.pubsubPatterns = append(c.pubsubPatterns, pattern)
+	server.pubsubPatterns.PushBack(&pubsubPattern{client: c, pattern: pattern})
+	return true
+}
+
+func (server *GodisServer) pubsubUnsubscribePattern(c *GodisClient, pattern string) bool {
+	found := false
+	for i, p := range c.pubsubPatterns {
+		if p == pattern {
+			c.pubsubPatterns = append(c.pubsubPatterns[:i], c.pubsubPatterns[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	for e := server.pubsubPatterns.Front(); e != nil; e = e.Next() {
+		pat := e.Value.(*pubsubPattern)
+		if pat.client == c && pat.pattern == pattern {
+			server.pubsubPatterns.Remove(e)
+			break
+		}
+	}
+	return true
+}
+
+// pubsubUnsubscribeAllChannels notify为false时不回复，用于freeClient
+func (server *GodisServer) pubsubUnsubscribeAllChannels(c *GodisClient, t pubsubType, notify bool) int {
+	subscribed := clientPubsubChannels(c, t)
+	channels := make([]string, 0, len(subscribed))
+	for channel := range subscribed {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	for _, channel := range channels {
+		server.pubsubUnsubscribeChannel(c, channel, t)
+		if notify {
+			server.addReplyPubsubUnsubscribed(c, t.unsubscribeMsg, channel, false, clientSubscriptionsCount(c, t))
+		}
+	}
+	if notify && len(channels) == 0 {
+		server.addReplyPubsubUnsubscribed(c, t.unsubscribeMsg, "", true, clientSubscriptionsCount(c, t))
+	}
+	return len(channels)
+}
+
+func (server *GodisServer) pubsubUnsubscribeAllPatterns(c *GodisClient, notify bool) int {
+	patterns := append([]string(nil), c.pubsubPatterns...)
+	for _, pattern := range patterns {
+		server.pubsubUnsubscribePattern(c, pattern)
+		if notify {
+			server.addReplyPubsubUnsubscribed(c, "punsubscribe", pattern, false, clientSubscriptionsCount(c, pubsubTypeGlobal))
+		}
+	}
+	if notify && len(patterns) == 0 {
+		server.addReplyPubsubUnsubscribed(c, "punsubscribe", "", true, clientSubscriptionsCount(c, pubsubTypeGlobal))
+	}
+	return len(patterns)
+}
+
+// freeClientPubsubState 释放客户端所有的订阅，不回复
+func (server *GodisServer) freeClientPubsubState(c *GodisClient) {
+	server.pubsubUnsubscribeAllChannels(c, pubsubTypeGlobal, false)
+	server.pubsubUnsubscribeAllChannels(c, pubsubTypeShard, false)
+	server.pubsubUnsubscribeAllPatterns(c, false)
+}
+
+// pubsubPublishMessage 返回收到消息的客户端数，sharded channel不匹配pattern
+func (server *GodisServer) pubsubPublishMessage(channel, message string, sharded bool) int {
+	t := pubsubTypeGlobal
+	if sharded {
+		t = pubsubTypeShard
+	}
+	receivers := 0
+	if clients := server.serverPubsubChannels(t, channel, false)[channel]; clients != nil {
+		msg := bulkString(t.messageBulk) + bulkString(channel) + bulkString(message)
+		for e := clients.Front(); e != nil; e = e.Next() {
+			server.addReplyPush(e.Value.(*GodisClient), 3, msg)
+			receivers++
+		}
+	}
+	if sharded {
+		return receivers
+	}
+	for e := server.pubsubPatterns.Front(); e != nil; e = e.Next() {
+		pat := e.Value.(*pubsubPattern)
+		if !stringMatch(pat.pattern, channel, false) {
+			continue
+		}
+		server.addReplyPush(pat.client, 4, "$8\r\npmessage\r\n"+bulkString(pat.pattern)+bulkString(channel)+bulkString(message))
+		receivers++
+	}
+	return receivers
+}
+
+// isSubscribeContextCommand RESP2订阅模式下只允许执行这些命令
+func (server *GodisServer) isSubscribeContextCommand(cmd *GodisCommand) bool {
+	return cmd == server.pingCmd || cmd == server.quitCmd ||
+		cmd == server.subscribeCmd || cmd == server.unsubscribeCmd ||
+		cmd == server.psubscribeCmd || cmd == server.punsubscribeCmd ||
+		cmd == server.ssubscribeCmd || cmd == server.sunsubscribeCmd
+}
+
+// getChannelsFromCommand 返回需要ACL检查的channel，以及它们是否是pattern
+func (server *GodisServer) getChannelsFromCommand(cmd *GodisCommand, args []*GObj) ([]*GObj, bool) {
+	switch cmd {
+	case server.publishCmd, server.spublishCmd:
+		return args[1:2], false
+	case server.subscribeCmd, server.ssubscribeCmd:
+		return args[1:], false
+	case server.psubscribeCmd:
+		return args[1:], true
+	}
+	return nil, false
+}
+
+// checkShardChannelsSlot sharded channel必须属于同一个slot
+func (server *GodisServer) checkShardChannelsSlot(c *GodisClient, channels []*GObj) bool {
+	for _, ch := range channels[1:] {
+		if keyHashSlot(ch.StrVal()) != keyHashSlot(channels[0].StrVal()) {
+			server.AddReplyStr(c, "-CROSSSLOT Keys in request don't hash to the same slot\r\n")
+			return false
+		}
+	}
+	return true
+}
+
+func (server *GodisServer) subscribeCommand(c *GodisClient) {
+	server.subscribeChannels(c, pubsubTypeGlobal)
+}
+
+func (server *GodisServer) unsubscribeCommand(c *GodisClient) {
+	server.unsubscribeChannels(c, pubsubTypeGlobal)
+}
+
+// SSUBSCRIBE shardchannel [shardchannel ...]
+func (server *GodisServer) ssubscribeCommand(c *GodisClient) {
+	if !server.checkShardChannelsSlot(c, c.args[1:]) {
+		return
+	}
+	server.subscribeChannels(c, pubsubTypeShard)
+}
+
+func (server *GodisServer) sunsubscribeCommand(c *GodisClient) {
+	server.unsubscribeChannels(c, pubsubTypeShard)
+}
+
+func (server *GodisServer) subscribeChannels(c *GodisClient, t pubsubType) {
+	for _, arg := range c.args[1:] {
+		server.pubsubSubscribeChannel(c, arg.StrVal(), t)
+		updatePubsubFlag(c)
+		server.addReplyPubsubSubscribed(c, t.subscribeMsg, arg.StrVal(), clientSubscriptionsCount(c, t))
+	}
+}
+
+func (server *GodisServer) unsubscribeChannels(c *GodisClient, t pubsubType) {
+	if len(c.args) == 1 {
+		server.pubsubUnsubscribeAllChannels(c, t, true)
+	} else {
+		for _, arg := range c.args[1:] {
+			server.pubsubUnsubscribeChannel(c, arg.StrVal(), t)
+			server.addReplyPubsubUnsubscribed(c, t.unsubscribeMsg, arg.StrVal(), false, clientSubscriptionsCount(c, t))
+		}
+	}
+	updatePubsubFlag(c)
+}
+
+func (server *GodisServer) psubscribeCommand(c *GodisClient) {
+	for _, arg := range c.args[1:] {
+		server.pubsubSubscribePattern(c, arg.StrVal())
+		updatePubsubFlag(c)
+		server.addReplyPubsubSubscribed(c, "psubscribe", arg.StrVal(), clientSubscriptionsCount(c, pubsubTypeGlobal))
+	}
+}
+
+func (server *GodisServer) punsubscribeCommand(c *GodisClient) {
+	if len(c.args) == 1 {
+		server.pubsubUnsubscribeAllPatterns(c, true)
+	} else {
+		for _, arg := range c.args[1:] {
+			server.pubsubUnsubscribePattern(c, arg.StrVal())
+			server.addReplyPubsubUnsubscribed(c, "punsubscribe", arg.StrVal(), false, clientSubscriptionsCount(c, pubsubTypeGlobal))
+		}
+	}
+	updatePubsubFlag(c)
+}
+
+// PUBLISH channel message
+func (server *GodisServer) publishCommand(c *GodisClient) {
+	receivers := server.pubsubPublishMessage(c.args[1].StrVal(), c.args[2].StrVal(), false)
+	server.AddReplyStr(c, fmt.Sprintf(":%d\r\n", receivers))
+}
+
+// SPUBLISH shardchannel message
+func (server *GodisServer) spublishCommand(c *GodisClient) {
+	receivers := server.pubsubPublishMessage(c.args[1].StrVal(), c.args[2].StrVal(), true)
+	server.AddReplyStr(c, fmt.Sprintf(":%d\r\n", receivers))
+}
+
+// pubsubChannelList matchAll为true时返回所有channel
+func pubsubChannelList(channels map[string]*list.List, pattern string, matchAll bool) []string {
+	var names []string
+	for channel := range channels {
+		if matchAll || stringMatch(pattern, channel, false) {
+			names = append(names, channel)
+		}
+	}
+	return names
+}
+
+func pubsubNumsubReply(args []*GObj, numsub func(channel string) int) string {
+	var reply strings.Builder
+	reply.WriteString(fmt.Sprintf("*%d\r\n", len(args)*2))
+	for _, arg := range args {
+		reply.WriteString(fmt.Sprintf("%s:%d\r\n", bulkString(arg.StrVal()), numsub(arg.StrVal())))
+	}
+	return reply.String()
+}
+
+// PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT
+// PUBSUB SHARDCHANNELS [pattern] | SHARDNUMSUB [shardchannel ...]
+func (server *GodisServer) pubsubCommand(c *GodisClient) {
+	sub := strings.ToLower(c.args[1].StrVal())
+	pattern := ""
+	if len(c.args) == 3 {
+		pattern = c.args[2].StrVal()
+	}
+	switch {
+	case sub == "channels" && (len(c.args) == 2 || len(c.args) == 3):
+		channels := pubsubChannelList(server.pubsubChannels, pattern, len(c.args) == 2)
+		sort.Strings(channels)
+		server.AddReplyStr(c, addReplyBulkArray(channels))
+	case sub == "numsub":
+		server.AddReplyStr(c, pubsubNumsubReply(c.args[2:], func(channel string) int {
+			if clients := server.pubsubChannels[channel]; clients != nil {
+				return clients.Len()
+			}
+			return 0
+		}))
+	case sub == "numpat" && len(c.args) == 2:
+		// 多个客户端订阅同一个pattern只算一个
+		patterns := make(map[string]bool)
+		for e := server.pubsubPatterns.Front(); e != nil; e = e.Next() {
+			patterns[e.Value.(*pubsubPattern).pattern] = true
+		}
+		server.AddReplyStr(c, fmt.Sprintf(":%d\r\n", len(patterns)))
+	case sub == "shardchannels" && (len(c.args) == 2 || len(c.args) == 3):
+		var channels []string
+		for _, slotChannels := range server.pubsubShardChannels {
+			channels = append(channels, pubsubChannelList(slotChannels, pattern, len(c.args) == 2)...)
+		}
+		sort.Strings(channels)
+		server.AddReplyStr(c, addReplyBulkArray(channels))
+	case sub == "shardnumsub":
+		server.AddReplyStr(c, pubsubNumsubReply(c.args[2:], func(channel string) int {
+			if clients := server.serverPubsubChannels(pubsubTypeShard, channel, false)[channel]; clients != nil {
+				return clients.Len()
+			}
+			return 0
+		}))
+	default:
+		server.AddReplyStr(c, fmt.Sprintf("-ERR unknown subcommand or wrong number of arguments for '%s'. Try PUBSUB HELP.\r\n", c.args[1].StrVal()))
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPubsub(t *testing.T) {
+	var conf Config
+	assert.Nil(t, server.initServer(&conf))
+	var clients []*GodisClient
+	for i := 0; i < 3; i++ {
+		clients = append(clients, newTestClient(t, "", 0))
+	}
+	sub, psub, pub := clients[0], clients[1], clients[2]
+
+	assert.Equal(t, "+PONG\r\n", runQuery(t, sub, "ping\r\n"))
+	assert.Equal(t, "*3\r\n$9\r\nsubscribe\r\n$2\r\nc1\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$2\r\nc2\r\n:2\r\n",
+		runQuery(t, sub, "subscribe c1 c2\r\n"))
+	assert.NotEqual(t, 0, sub.flags&CLIENT_PUBSUB)
+	assert.Equal(t, "*3\r\n$10\r\npsubscribe\r\n$2\r\nc*\r\n:1\r\n", runQuery(t, psub, "psubscribe c*\r\n"))
+
+	assert.Equal(t, ":2\r\n", runQuery(t, pub, "publish c1 hello\r\n"))
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$2\r\nc1\r\n$5\r\nhello\r\n", takeReply(sub))
+	assert.Equal(t, "*4\r\n$8\r\npmessage\r\n$2\r\nc*\r\n$2\r\nc1\r\n$5\r\nhello\r\n", takeReply(psub))
+	assert.Equal(t, ":1\r\n", runQuery(t, pub, "publish c3 hello\r\n"))
+	assert.Equal(t, ":0\r\n", runQuery(t, pub, "publish other hello\r\n"))
+	takeReply(psub)
+
+	// 订阅模式下只能执行订阅相关的命令
+	assert.Equal(t, "-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n",
+		runQuery(t, sub, "get k\r\n"))
+	assert.Equal(t, "*2\r\n$4\r\npong\r\n$0\r\n\r\n", runQuery(t, sub, "ping\r\n"))
+
+	// CLIENT REPLY OFF不影响消息推送
+	sub.flags |= CLIENT_REPLY_OFF
+	assert.Equal(t, ":2\r\n", runQuery(t, pub, "publish c2 world\r\n"))
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$2\r\nc2\r\n$5\r\nworld\r\n", takeReply(sub))
+	sub.flags &= ^CLIENT_REPLY_OFF
+	takeReply(psub)
+
+	assert.Equal(t, "*2\r\n$2\r\nc1\r\n$2\r\nc2\r\n", runQuery(t, pub, "pubsub channels\r\n"))
+	assert.Equal(t, "*1\r\n$2\r\nc2\r\n", runQuery(t, pub, "pubsub channels *2\r\n"))
+	assert.Equal(t, "*4\r\n$2\r\nc1\r\n:1\r\n$2\r\nc3\r\n:0\r\n", runQuery(t, pub, "pubsub numsub c1 c3\r\n"))
+	assert.Equal(t, ":1\r\n", runQuery(t, pub, "pubsub numpat\r\n"))
+
+	assert.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$2\r\nc1\r\n:1\r\n", runQuery(t, sub, "unsubscribe c1\r\n"))
+	assert.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$2\r\nc2\r\n:0\r\n", runQuery(t, sub, "unsubscribe\r\n"))
+	assert.Equal(t, 0, sub.flags&CLIENT_PUBSUB)
+	assert.Equal(t, "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n", runQuery(t, sub, "unsubscribe\r\n"))
+	assert.Equal(t, "$-1\r\n", runQuery(t, sub, "get k\r\n"))
+	assert.Equal(t, "*3\r\n$10\r\npsubscribe\r\n$2\r\nc*\r\n:1\r\n", runQuery(t, pub, "psubscribe c*\r\n"))
+	assert.Equal(t, 2, server.pubsubPatterns.Len())
+	assert.Equal(t, ":1\r\n", runQuery(t, sub, "pubsub numpat\r\n")) //多个客户端订阅同一个pattern只算一次
+	assert.Equal(t, "*3\r\n$12\r\npunsubscribe\r\n$2\r\nc*\r\n:0\r\n", runQuery(t, pub, "punsubscribe\r\n"))
+	assert.Equal(t, 0, pub.flags&CLIENT_PUBSUB)
+
+	// freeClient释放所有订阅
+	server.freeClient(psub)
+	assert.Equal(t, 0, server.pubsubPatterns.Len())
+	assert.Equal(t, 0, len(server.pubsubChannels))
+
+	// channel权限
+	assert.Equal(t, "+OK\r\n", runQuery(t, pub, "acl setuser alice on nopass +@all ~* &news.*\r\n"))
+	assert.Equal(t, "+OK\r\n", runQuery(t, sub, "auth alice x\r\n"))
+	assert.Equal(t, ":0\r\n", runQuery(t, sub, "publish news.1 hi\r\n"))
+	assert.Equal(t, "-NOPERM No permissions to access a channel\r\n", runQuery(t, sub, "publish sports hi\r\n"))
+	assert.Equal(t, "-NOPERM No permissions to access a channel\r\n", runQuery(t, sub, "psubscribe news.1*\r\n"))
+	assert.Equal(t, "*3\r\n$10\r\npsubscribe\r\n$6\r\nnews.*\r\n:1\r\n", runQuery(t, sub, "psubscribe news.*\r\n"))
+	assert.Equal(t, ACL_DENIED_CHANNEL, server.aclLog[0].reason)
+	assert.Equal(t, "news.1*", server.aclLog[0].object)
+	server.freeClient(sub)
+	server.freeClient(pub)
+}
+
+func TestShardPubsub(t *testing.T) {
+	var conf Config
+	assert.Nil(t, server.initServer(&conf))
+	var clients []*GodisClient
+	for i := 0; i < 2; i++ {
+		clients = append(clients, newTestClient(t, "", 0))
+	}
+	sub, pub := clients[0], clients[1]
+
+	assert.Equal(t, "-CROSSSLOT Keys in request don't hash to the same slot\r\n", runQuery(t, sub, "ssubscribe a b\r\n"))
+	assert.Equal(t, 0, sub.flags&CLIENT_PUBSUB)
+	assert.Equal(t, "*3\r\n$10\r\nssubscribe\r\n$6\r\n{u1}.a\r\n:1\r\n*3\r\n$10\r\nssubscribe\r\n$6\r\n{u1}.b\r\n:2\r\n",
+		runQuery(t, sub, "ssubscribe {u1}.a {u1}.b\r\n"))
+	assert.Equal(t, 2, len(server.pubsubShardChannels[keyHashSlot("u1")]))
+	// 普通订阅与sharded订阅分开计数
+	assert.Equal(t, "*3\r\n$9\r\nsubscribe\r\n$6\r\n{u1}.a\r\n:1\r\n", runQuery(t, sub, "subscribe {u1}.a\r\n"))
+
+	assert.Equal(t, ":1\r\n", runQuery(t, pub, "spublish {u1}.a hi\r\n"))
+	assert.Equal(t, "*3\r\n$8\r\nsmessage\r\n$6\r\n{u1}.a\r\n$2\r\nhi\r\n", takeReply(sub))
+	assert.Equal(t, ":1\r\n", runQuery(t, pub, "publish {u1}.a hi\r\n"))
+	assert.Equal(t, "*3\r\n$7\r\nmessage\r\n$6\r\n{u1}.a\r\n$2\r\nhi\r\n", takeReply(sub))
+	assert.Equal(t, "*3\r\n$10\r\npsubscribe\r\n$1\r\n*\r\n:1\r\n", runQuery(t, pub, "psubscribe *\r\n"))
+	assert.Equal(t, "*3\r\n$12\r\npunsubscribe\r\n$1\r\n*\r\n:0\r\n", runQuery(t, pub, "punsubscribe\r\n"))
+
+	assert.Equal(t, "*2\r\n$6\r\n{u1}.a\r\n$6\r\n{u1}.b\r\n", runQuery(t, pub, "pubsub shardchannels\r\n"))
+	assert.Equal(t, "*1\r\n$6\r\n{u1}.b\r\n", runQuery(t, pub, "pubsub shardchannels *b\r\n"))
+	assert.Equal(t, "*1\r\n$6\r\n{u1}.a\r\n", runQuery(t, pub, "pubsub channels\r\n"))
+	assert.Equal(t, "*4\r\n$6\r\n{u1}.a\r\n:1\r\n$1\r\nx\r\n:0\r\n", runQuery(t, pub, "pubsub shardnumsub {u1}.a x\r\n"))
+
+	assert.Equal(t, "*3\r\n$12\r\nsunsubscribe\r\n$6\r\n{u1}.a\r\n:1\r\n*3\r\n$12\r\nsunsubscribe\r\n$6\r\n{u1}.b\r\n:0\r\n",
+		runQuery(t, sub, "sunsubscribe\r\n"))
+	assert.Nil(t, server.pubsubShardChannels[keyHashSlot("u1")])
+	assert.NotEqual(t, 0, sub.flags&CLIENT_PUBSUB)
+	assert.Equal(t, "*3\r\n$12\r\nsunsubscribe\r\n$-1\r\n:0\r\n", runQuery(t, sub, "sunsubscribe\r\n"))
+
+	assert.Equal(t, "*3\r\n$10\r\nssubscribe\r\n$1\r\nc\r\n:1\r\n", runQuery(t, sub, "ssubscribe c\r\n"))
+	server.freeClient(sub)
+	assert.Nil(t, server.pubsubShardChannels[keyHashSlot("c")])
+	assert.Equal(t, 0, len(server.pubsubChannels))
+	server.freeClient(pub)
+}
@@ -1,39 +1,501 @@
 package main
 
-// import (
-// 	"errors"
-// 	"syscall"
-// 	"time"
-// )
-
-// const (
-// 	REDIS_RDB_TYPE_STRING int = 0
-// 	REDIS_RDB_TYPE_LIST   int = 1
-// 	REDIS_RDB_TYPE_SET    int = 2
-// 	REDIS_RDB_TYPE_ZSET   int = 3
-// 	REDIS_RDB_TYPE_HASH   int = 4
-// )
-
-// func (server *GodisServer) rdbSaveBackground() error {
-// 	if server.child_pid != -1 {
-// 		return errors.New("save error, has active child process")
-// 	}
-
-// 	server.stat_rdb_saves++
-// 	server.dirty_before_bgsave = server.dirty
-// 	server.last_bgsave_try = time.Now().UnixNano()
-// 	pid, _, err := syscall.RawSyscall(syscall.SYS_FORK, 0, 0, 0)
-// 	if err != 0 {
-// 		return errors.New("create pid faild")
-// 	}
-// 	childpid := int(pid)
-// 	if childpid == 0 { //子进程
-// 		retval := server.rdbSave()
-
-// 	}
-
-// }
-
-// func (server *GodisServer) rdbSave() int {
-
-// }
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// RDB格式与redis一致，只使用godis支持的类型的基本编码，
+// 生成的文件可以被redis加载
+const (
+	RDB_VERSION int = 9
+
+	RDB_TYPE_STRING int = 0
+	RDB_TYPE_LIST   int = 1
+	RDB_TYPE_ZSET   int = 3 //score以字符串存储，只在加载时支持
+	RDB_TYPE_ZSET_2 int = 5 //score以二进制double存储
+
+	RDB_OPCODE_IDLE          int = 248
+	RDB_OPCODE_FREQ          int = 249
+	RDB_OPCODE_AUX           int = 250
+	RDB_OPCODE_RESIZEDB      int = 251
+	RDB_OPCODE_EXPIRETIME_MS int = 252
+	RDB_OPCODE_EXPIRETIME    int = 253
+	RDB_OPCODE_SELECTDB      int = 254
+	RDB_OPCODE_EOF           int = 255
+
+	RDB_6BITLEN  byte = 0
+	RDB_14BITLEN byte = 1
+	RDB_32BITLEN byte = 0x80
+	RDB_64BITLEN byte = 0x81
+	RDB_ENCVAL   byte = 3
+
+	RDB_ENC_INT8  byte = 0
+	RDB_ENC_INT16 byte = 1
+	RDB_ENC_INT32 byte = 2
+	RDB_ENC_LZF   byte = 3
+
+	RDB_MAX_STRING_LEN uint64 = 512 * 1024 * 1024 //与redis的proto-max-bulk-len默认值相同
+)
+
+// redis使用的crc64(Jones多项式，反射，初值与结果都不取反)
+var crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+func crc64Update(crc uint64, p []byte) uint64 {
+	// hash/crc64在计算前后都会取反，这里抵消掉
+	return ^crc64.Update(^crc, crc64Table, p)
+}
+
+// rdbWriter 写入的同时计算校验和
+type rdbWriter struct {
+	w   io.Writer
+	crc uint64
+	err error
+}
+
+func (rdb *rdbWriter) write(p []byte) {
+	if rdb.err != nil {
+		return
+	}
+	rdb.crc = crc64Update(rdb.crc, p)
+	_, rdb.err = rdb.w.Write(p)
+}
+
+func (rdb *rdbWriter) saveType(typ int) {
+	rdb.write([]byte{byte(typ)})
+}
+
+func (rdb *rdbWriter) saveLen(n uint64) {
+	switch {
+	case n < 1<<6:
+		rdb.write([]byte{byte(n)})
+	case n < 1<<14:
+		rdb.write([]byte{RDB_14BITLEN<<6 | byte(n>>8), byte(n)})
+	case n <= math.MaxUint32:
+		buf := []byte{RDB_32BITLEN, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		rdb.write(buf)
+	default:
+		buf := []byte{RDB_64BITLEN, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(buf[1:], n)
+		rdb.write(buf)
+	}
+}
+
+func (rdb *rdbWriter) saveString(s string) {
+	rdb.saveLen(uint64(len(s)))
+	rdb.write([]byte(s))
+}
+
+func (rdb *rdbWriter) saveAux(key, val string) {
+	rdb.saveType(RDB_OPCODE_AUX)
+	rdb.saveString(key)
+	rdb.saveString(val)
+}
+
+func (rdb *rdbWriter) saveObject(o *GObj) {
+	switch o.Type {
+	case GSTR:
+		rdb.saveString(o.StrVal())
+	case GLIST:
+		list := o.ListVal()
+		rdb.saveLen(uint64(list.Length()))
+		for n := list.First(); n != nil; n = n.next {
+			rdb.saveString(n.val.StrVal())
+		}
+	case GZSET:
+		zsl := o.ZsetVal()
+		rdb.saveLen(uint64(zsl.length))
+		buf := make([]byte, 8)
+		for n := zsl.head.zslLevel[0].next; n != nil; n = n.zslLevel[0].next {
+			rdb.saveString(n.ele.StrVal())
+			binary.LittleEndian.PutUint64(buf, math.Float64bits(n.score))
+			rdb.write(buf)
+		}
+	}
+}
+
+func rdbObjectType(o *GObj) (int, error) {
+	switch o.Type {
+	case GSTR:
+		return RDB_TYPE_STRING, nil
+	case GLIST:
+		return RDB_TYPE_LIST, nil
+	case GZSET:
+		return RDB_TYPE_ZSET_2, nil
+	}
+	return 0, fmt.Errorf("unknown object type %v", o.Type)
+}
+
+// rdbSave 把数据库写入w
+func (server *GodisServer) rdbSave(w io.Writer) error {
+	rdb := &rdbWriter{w: w}
+	rdb.write([]byte(fmt.Sprintf("REDIS%04d", RDB_VERSION)))
+	rdb.saveAux("godis-ver", GODIS_VERSION)
+	rdb.saveAux("redis-bits", "64")
+	rdb.saveAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	rdb.saveType(RDB_OPCODE_SELECTDB)
+	rdb.saveLen(0)
+	rdb.saveType(RDB_OPCODE_RESIZEDB)
+	rdb.saveLen(uint64(server.db.data.Size()))
+	rdb.saveLen(uint64(server.db.expire.Size()))
+	var err error
+	server.db.data.ForEach(func(e *Entry) {
+		typ, terr := rdbObjectType(e.Val)
+		if terr != nil {
+			err = terr
+			return
+		}
+		if expire := server.db.expire.Get(e.Key); expire != nil {
+			buf := make([]byte, 8)
+			binary.LittleEndian.PutUint64(buf, uint64(expire.IntVal()))
+			rdb.saveType(RDB_OPCODE_EXPIRETIME_MS)
+			rdb.write(buf)
+		}
+		rdb.saveType(typ)
+		rdb.saveString(e.Key.StrVal())
+		rdb.saveObject(e.Val)
+	})
+	if err != nil {
+		return err
+	}
+	rdb.saveType(RDB_OPCODE_EOF)
+	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, rdb.crc)
+	rdb.write(checksum)
+	return rdb.err
+}
+
+// rdbSaveToBytes 在内存中生成RDB，用于全量同步
+func (server *GodisServer) rdbSaveToBytes() ([]byte, error) {
+	var buf bytes.Buffer
+	err := server.rdbSave(&buf)
+	return buf.Bytes(), err
+}
+
+// rdbSaveToFile 先写入临时文件，fsync之后rename，filename总是完整的RDB
+func (server *GodisServer) rdbSaveToFile(filename string) error {
+	tmpfile := filepath.Join(filepath.Dir(filename), fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = server.rdbSave(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile, filename)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+	}
+	return err
+}
+
+func (server *GodisServer) rdbLoadFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return server.rdbLoad(f)
+}
+
+// rdbReader 读取的同时计算校验和
+type rdbReader struct {
+	r      *bufio.Reader
+	crc    uint64
+	remain int64 //剩余的字节数，超过时说明数据被截断或者已损坏，不再分配内存
+}
+
+func (rdb *rdbReader) read(n int) ([]byte, error) {
+	if n < 0 || int64(n) > rdb.remain {
+		return nil, io.ErrUnexpectedEOF
+	}
+	rdb.remain -= int64(n)
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rdb.r, buf); err != nil {
+		return nil, err
+	}
+	rdb.crc = crc64Update(rdb.crc, buf)
+	return buf, nil
+}
+
+func (rdb *rdbReader) loadType() (int, error) {
+	buf, err := rdb.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return int(buf[0]), nil
+}
+
+// loadLen encoded为true时返回的是字符串的特殊编码类型
+func (rdb *rdbReader) loadLen() (n uint64, encoded bool, err error) {
+	buf, err := rdb.read(1)
+	if err != nil {
+		return 0, false, err
+	}
+	switch typ := buf[0] >> 6; {
+	case typ == RDB_ENCVAL:
+		return uint64(buf[0] & 0x3f), true, nil
+	case typ == RDB_6BITLEN:
+		return uint64(buf[0] & 0x3f), false, nil
+	case typ == RDB_14BITLEN:
+		next, err := rdb.read(1)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(buf[0]&0x3f)<<8 | uint64(next[0]), false, nil
+	case buf[0] == RDB_32BITLEN:
+		next, err := rdb.read(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(next)), false, nil
+	case buf[0] == RDB_64BITLEN:
+		next, err := rdb.read(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(next), false, nil
+	}
+	return 0, false, fmt.Errorf("unknown length encoding %d in rdb", buf[0])
+}
+
+func (rdb *rdbReader) loadString() (string, error) {
+	n, encoded, err := rdb.loadLen()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		if n > RDB_MAX_STRING_LEN {
+			return "", fmt.Errorf("invalid string length %d in rdb", n)
+		}
+		buf, err := rdb.read(int(n))
+		return string(buf), err
+	}
+	switch byte(n) {
+	case RDB_ENC_INT8:
+		buf, err := rdb.read(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(buf[0]))), nil
+	case RDB_ENC_INT16:
+		buf, err := rdb.read(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf)))), nil
+	case RDB_ENC_INT32:
+		buf, err := rdb.read(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf)))), nil
+	}
+	return "", fmt.Errorf("unsupported string encoding %d in rdb", n)
+}
+
+// loadDoubleValue RDB_TYPE_ZSET中的score: 253 nan, 254 +inf, 255 -inf，其余为字符串长度
+func (rdb *rdbReader) loadDoubleValue() (float64, error) {
+	buf, err := rdb.read(1)
+	if err != nil {
+		return 0, err
+	}
+	switch buf[0] {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	str, err := rdb.read(int(buf[0]))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(str), 64)
+}
+
+func (rdb *rdbReader) loadObject(typ int) (*GObj, error) {
+	switch typ {
+	case RDB_TYPE_STRING:
+		s, err := rdb.loadString()
+		if err != nil {
+			return nil, err
+		}
+		return CreateObject(GSTR, s), nil
+	case RDB_TYPE_LIST:
+		n, _, err := rdb.loadLen()
+		if err != nil {
+			return nil, err
+		}
+		o := CreateFromList()
+		for i := uint64(0); i < n; i++ {
+			s, err := rdb.loadString()
+			if err != nil {
+				return nil, err
+			}
+			o.ListVal().Append(CreateObject(GSTR, s))
+		}
+		return o, nil
+	case RDB_TYPE_ZSET, RDB_TYPE_ZSET_2:
+		n, _, err := rdb.loadLen()
+		if err != nil {
+			return nil, err
+		}
+		zsl := ZslCreate(ZsetType{LessFunc: GStrLess, EqualFunc: GStrEqual})
+		for i := uint64(0); i < n; i++ {
+			s, err := rdb.loadString()
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if typ == RDB_TYPE_ZSET {
+				score, err = rdb.loadDoubleValue()
+			} else {
+				var buf []byte
+				buf, err = rdb.read(8)
+				if err == nil {
+					score = math.Float64frombits(binary.LittleEndian.Uint64(buf))
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			zsl.ZslInsertNode(score, CreateObject(GSTR, s))
+		}
+		return CreateObject(GZSET, zsl), nil
+	}
+	return nil, fmt.Errorf("unsupported object type %d in rdb", typ)
+}
+
+// rdbLoad 从r加载RDB到当前数据库，调用前数据库应该是空的
+func (server *GodisServer) rdbLoad(r io.Reader) error {
+	server.loading = true
+	defer func() { server.loading = false }()
+	rdb := &rdbReader{r: bufio.NewReader(r), remain: math.MaxInt64}
+	switch v := r.(type) {
+	case *bytes.Reader:
+		rdb.remain = int64(v.Len())
+	case *os.File:
+		if st, err := v.Stat(); err == nil {
+			rdb.remain = st.Size()
+		}
+	}
+	header, err := rdb.read(9)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(header, []byte("REDIS")) {
+		return errors.New("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 {
+		return fmt.Errorf("can't handle RDB format version %s", header[5:])
+	}
+	var expire int64 = -1
+	for {
+		typ, err := rdb.loadType()
+		if err != nil {
+			return err
+		}
+		if typ == RDB_OPCODE_EOF {
+			break
+		}
+		switch typ {
+		case RDB_OPCODE_EXPIRETIME:
+			buf, err := rdb.read(4)
+			if err != nil {
+				return err
+			}
+			expire = int64(binary.LittleEndian.Uint32(buf)) * 1000
+		case RDB_OPCODE_EXPIRETIME_MS:
+			buf, err := rdb.read(8)
+			if err != nil {
+				return err
+			}
+			expire = int64(binary.LittleEndian.Uint64(buf))
+		case RDB_OPCODE_FREQ:
+			if _, err := rdb.read(1); err != nil {
+				return err
+			}
+		case RDB_OPCODE_IDLE:
+			if _, _, err := rdb.loadLen(); err != nil {
+				return err
+			}
+		case RDB_OPCODE_AUX:
+			if _, err := rdb.loadString(); err != nil {
+				return err
+			}
+			if _, err := rdb.loadString(); err != nil {
+				return err
+			}
+		case RDB_OPCODE_SELECTDB:
+			dbid, _, err := rdb.loadLen()
+			if err != nil {
+				return err
+			}
+			if dbid != 0 {
+				return fmt.Errorf("godis only supports db 0, got db %d in rdb", dbid)
+			}
+		case RDB_OPCODE_RESIZEDB:
+			if _, _, err := rdb.loadLen(); err != nil {
+				return err
+			}
+			if _, _, err := rdb.loadLen(); err != nil {
+				return err
+			}
+		default:
+			key, err := rdb.loadString()
+			if err != nil {
+				return err
+			}
+			val, err := rdb.loadObject(typ)
+			if err != nil {
+				return err
+			}
+			k := CreateObject(GSTR, key)
+			server.db.data.Set(k, val)
+			val.DecrRefCount()
+			if expire != -1 {
+				expObj := CreateFromInt(expire)
+				server.db.expire.Set(k, expObj)
+				expObj.DecrRefCount()
+			}
+			k.DecrRefCount()
+			expire = -1
+		}
+	}
+	if version >= 5 {
+		expected := rdb.crc
+		buf, err := rdb.read(8)
+		if err != nil {
+			return err
+		}
+		// 校验和为0表示生成时关闭了校验
+		if checksum := binary.LittleEndian.Uint64(buf); checksum != 0 && checksum != expected {
+			return errors.New("wrong RDB checksum")
+		}
+	}
+	return nil
+}
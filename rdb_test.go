@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCrc64(t *testing.T) {
+	// redis src/crc64.c中的测试数据
+	assert.Equal(t, uint64(0xe9c6d914c4b8d9ca), crc64Update(0, []byte("123456789")))
+	crc := crc64Update(0, []byte("1234"))
+	assert.Equal(t, uint64(0xe9c6d914c4b8d9ca), crc64Update(crc, []byte("56789")))
+}
+
+func TestRdbSaveLoad(t *testing.T) {
+	var conf Config
+	assert.Nil(t, server.initServer(&conf))
+	c := newTestClient(t, "", 0)
+	runQuery(t, c, "set s v\r\nset n 12345\r\nset e v\r\nexpire e 100\r\n")
+	runQuery(t, c, "lpush l a\r\nlpush l b\r\nzadd z 1.5 x\r\nzadd z -2 y\r\n")
+	big := string(bytes.Repeat([]byte("x"), 20000)) //长度需要32位编码
+	server.db.data.Set(CreateObject(GSTR, "big"), CreateObject(GSTR, big))
+	data, err := server.rdbSaveToBytes()
+	assert.Nil(t, err)
+	assert.Equal(t, "REDIS0009", string(data[:9]))
+	expire := server.db.expire.Get(CreateObject(GSTR, "e")).IntVal()
+
+	assert.Nil(t, server.initServer(&conf))
+	assert.Nil(t, server.rdbLoad(bytes.NewReader(data)))
+	assert.Equal(t, int64(6), server.db.data.Size())
+	assert.Equal(t, "v", server.db.data.Get(CreateObject(GSTR, "s")).StrVal())
+	assert.Equal(t, "12345", server.db.data.Get(CreateObject(GSTR, "n")).StrVal())
+	assert.Equal(t, big, server.db.data.Get(CreateObject(GSTR, "big")).StrVal())
+	assert.Equal(t, expire, server.db.expire.Get(CreateObject(GSTR, "e")).IntVal())
+	c = newTestClient(t, "", 0)
+	assert.Equal(t, "$1\r\nb\r\n$1\r\na\r\n", runQuery(t, c, "lpop l\r\nlpop l\r\n"))
+	assert.Equal(t, "*4\r\n$1\r\ny\r\n$2\r\n-2\r\n$1\r\nx\r\n$19\r\n1.50000000000000000\r\n", runQuery(t, c, "zrange z 0 -1 withscores\r\n"))
+
+	// 校验和错误
+	data[len(data)-1] ^= 0xff
+	assert.Equal(t, "wrong RDB checksum", server.rdbLoad(bytes.NewReader(data)).Error())
+	assert.NotNil(t, server.rdbLoad(bytes.NewReader([]byte("RDB"))))
+
+	// redis使用整数编码的字符串
+	assert.Nil(t, server.initServer(&conf))
+	data = []byte("REDIS0011\xfe\x00\x00\x01k\xc1\x39\x30\x00\x01n\xc0\xfe\xff\x00\x00\x00\x00\x00\x00\x00\x00")
+	assert.Nil(t, server.rdbLoad(bytes.NewReader(data)))
+	assert.Equal(t, "12345", server.db.data.Get(CreateObject(GSTR, "k")).StrVal())
+	assert.Equal(t, "-2", server.db.data.Get(CreateObject(GSTR, "n")).StrVal())
+
+	// 损坏的长度返回错误，不按长度分配内存
+	assert.Nil(t, server.initServer(&conf))
+	data = []byte("REDIS0009\xfe\x00\x00\x80\x00\x10\x00\x00k")
+	assert.Equal(t, io.ErrUnexpectedEOF, server.rdbLoad(bytes.NewReader(data)))
+	data = []byte("REDIS0009\xfe\x00\x00\x81\x7f\xff\xff\xff\xff\xff\xff\xffk")
+	assert.Equal(t, "invalid string length 9223372036854775807 in rdb", server.rdbLoad(bytes.NewReader(data)).Error())
+	data = []byte("REDIS0009\xfe\x00\x00\x81\x80\x00\x00\x00\x00\x00\x00\x00k")
+	assert.NotNil(t, server.rdbLoad(bytes.NewReader(data)))
+	assert.Equal(t, int64(0), server.db.data.Size())
+	server.freeClient(c)
+}
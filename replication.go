@@ -0,0 +1,1080 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// replica与master之间连接的状态
+const (
+	REPL_STATE_NONE                int = 0 //不是replica
+	REPL_STATE_CONNECT             int = 1 //需要连接master
+	REPL_STATE_CONNECTING          int = 2 //非阻塞连接进行中
+	REPL_STATE_RECEIVE_PING_REPLY  int = 3
+	REPL_STATE_RECEIVE_PORT_REPLY  int = 4
+	REPL_STATE_RECEIVE_CAPA_REPLY  int = 5
+	REPL_STATE_RECEIVE_PSYNC_REPLY int = 6
+	REPL_STATE_TRANSFER            int = 7 //接收RDB
+	REPL_STATE_CONNECTED           int = 8
+)
+
+const (
+	CONFIG_RUN_ID_SIZE       int   = 40
+	REPL_TIMEOUT             int64 = 60 //秒
+	REPL_PING_REPLICA_PERIOD int64 = 10 //秒
+
+	DEFAULT_REPL_BACKLOG_SIZE    int64 = 1024 * 1024
+	CONFIG_REPL_BACKLOG_MIN_SIZE int64 = 16 * 1024
+)
+
+// repl-diskless-load: replica如何加载master发来的RDB
+const (
+	REPL_DISKLESS_LOAD_DISABLED    int = 0 //先写入dbfilename再从文件加载
+	REPL_DISKLESS_LOAD_ON_EMPTY_DB int = 1 //数据库为空时直接从内存加载
+	REPL_DISKLESS_LOAD_SWAPDB      int = 2 //直接加载到新的数据库，失败时保留原来的数据
+)
+
+const DEFAULT_DBFILENAME string = "dump.rdb"
+
+// REPLCONF capa声明的replica能力
+const (
+	SLAVE_CAPA_NONE   int = 0
+	SLAVE_CAPA_EOF    int = 1 << 0 //可以解析以EOF标记结尾的RDB
+	SLAVE_CAPA_PSYNC2 int = 1 << 1 //可以处理+CONTINUE <replid>
+)
+
+func (server *GodisServer) initReplicationConfig(config *Config) error {
+	var err error
+	if server.replicaReadOnly, err = parseYesNo("replica-read-only", config.ReplicaReadOnly, true); err != nil {
+		return err
+	}
+	if server.replicaServeStaleData, err = parseYesNo("replica-serve-stale-data", config.ReplicaServeStaleData, true); err != nil {
+		return err
+	}
+	if server.replDisklessSync, err = parseYesNo("repl-diskless-sync", config.ReplDisklessSync, true); err != nil {
+		return err
+	}
+	switch strings.ToLower(config.ReplDisklessLoad) {
+	case "", "disabled":
+		server.replDisklessLoad = REPL_DISKLESS_LOAD_DISABLED
+	case "on-empty-db":
+		server.replDisklessLoad = REPL_DISKLESS_LOAD_ON_EMPTY_DB
+	case "swapdb":
+		server.replDisklessLoad = REPL_DISKLESS_LOAD_SWAPDB
+	default:
+		return fmt.Errorf("repl-diskless-load must be disabled, on-empty-db or swapdb, got %q", config.ReplDisklessLoad)
+	}
+	server.dbfilename = DEFAULT_DBFILENAME
+	if config.DbFilename != "" {
+		server.dbfilename = config.DbFilename
+	}
+	return nil
+}
+
+func genReplicationId() string {
+	buf := make([]byte, CONFIG_RUN_ID_SIZE/2)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// changeReplicationId 数据集与之前的历史不再连续时使用新的replid
+func (server *GodisServer) changeReplicationId() {
+	server.replid = genReplicationId()
+}
+
+func (server *GodisServer) clearReplicationId2() {
+	server.replid2 = strings.Repeat("0", CONFIG_RUN_ID_SIZE)
+	server.secondReplidOffset = -1
+}
+
+// shiftReplicationId replica成为master时使用新的replid，旧的replid保存为replid2，
+// 之前与它同属一个master的replica可以用旧的replid部分同步到secondReplidOffset为止
+func (server *GodisServer) shiftReplicationId() {
+	server.replid2 = server.replid
+	// replica从offset+1开始请求数据，所以secondReplidOffset是下一个字节的offset
+	server.secondReplidOffset = server.masterReplOffset + 1
+	server.changeReplicationId()
+	log.Printf("setting secondary replication ID to %v, valid up to offset: %v. New replication ID is %v\n",
+		server.replid2, server.secondReplidOffset, server.replid)
+}
+
+// createReplicationBacklog backlog是环形缓冲，保存最近的复制流用于部分同步
+func (server *GodisServer) createReplicationBacklog() {
+	server.replBacklog = make([]byte, server.replBacklogSize)
+	server.replBacklogIdx = 0
+	server.replBacklogHistlen = 0
+	// 之后写入的第一个字节的offset
+	server.replBacklogOff = server.masterReplOffset + 1
+}
+
+func (server *GodisServer) freeReplicationBacklog() {
+	server.replBacklog = nil
+}
+
+// feedReplicationBacklog 追加复制流到backlog，并增加masterReplOffset
+func (server *GodisServer) feedReplicationBacklog(p []byte) {
+	server.masterReplOffset += int64(len(p))
+	for len(p) > 0 {
+		n := copy(server.replBacklog[server.replBacklogIdx:], p)
+		server.replBacklogIdx += int64(n)
+		if server.replBacklogIdx == server.replBacklogSize {
+			server.replBacklogIdx = 0
+		}
+		server.replBacklogHistlen += int64(n)
+		p = p[n:]
+	}
+	if server.replBacklogHistlen > server.replBacklogSize {
+		server.replBacklogHistlen = server.replBacklogSize
+	}
+	server.replBacklogOff = server.masterReplOffset - server.replBacklogHistlen + 1
+}
+
+// addReplyReplicationBacklog 发送backlog中从offset开始的数据，返回发送的字节数
+func (server *GodisServer) addReplyReplicationBacklog(c *GodisClient, offset int64) int64 {
+	if server.replBacklogHistlen == 0 {
+		return 0
+	}
+	skip := offset - server.replBacklogOff
+	// backlog中最早的数据所在的位置
+	j := (server.replBacklogIdx + (server.replBacklogSize - server.replBacklogHistlen)) % server.replBacklogSize
+	j = (j + skip) % server.replBacklogSize
+	size := server.replBacklogHistlen - skip
+	left := size
+	for left > 0 {
+		n := server.replBacklogSize - j
+		if n > left {
+			n = left
+		}
+		server.AddReplyStr(c, string(server.replBacklog[j:j+n]))
+		left -= n
+		j = 0
+	}
+	return size
+}
+
+// multiBulkString 以RESP数组编码命令，用于复制流与发送给master的命令
+func multiBulkString(args []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		b.WriteString(bulkString(arg))
+	}
+	return b.String()
+}
+
+// replicationFeedSlaves 把写命令追加到复制流，没有backlog也没有replica时offset不增加，
+// replica只转发master的复制流
+func (server *GodisServer) replicationFeedSlaves(args []*GObj) {
+	if server.masterhost != "" || (server.replBacklog == nil && len(server.slaves) == 0) {
+		return
+	}
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = arg.StrVal()
+	}
+	server.replicationFeedStream(multiBulkString(strs))
+}
+
+func (server *GodisServer) replicationFeedStream(stream string) {
+	if server.replBacklog != nil {
+		server.feedReplicationBacklog([]byte(stream))
+	} else {
+		server.masterReplOffset += int64(len(stream))
+	}
+	for _, slave := range server.slaves {
+		server.AddReplyStr(slave, stream)
+	}
+}
+
+// propagate 执行成功的写命令传播给replica，事务中的命令以MULTI/EXEC包裹
+func (server *GodisServer) propagate(args []*GObj) {
+	if server.inExec && !server.multiPropagated {
+		multi := CreateObject(GSTR, "MULTI")
+		server.replicationFeedSlaves([]*GObj{multi})
+		multi.DecrRefCount()
+		server.multiPropagated = true
+	}
+	server.replicationFeedSlaves(args)
+}
+
+// replicationProxyMasterStream replica把已执行的master复制流原样写入backlog并转发给下级replica，
+// 这样各级replica的offset与master一致
+func (server *GodisServer) replicationProxyMasterStream(c *GodisClient) {
+	applied := c.reploff - server.masterReplOffset
+	if applied <= 0 {
+		return
+	}
+	server.replicationFeedStream(string(c.pendingStream[:applied]))
+	c.pendingStream = c.pendingStream[applied:]
+}
+
+// REPLCONF <option> <value> [<option> <value> ...]
+func (server *GodisServer) replconfCommand(c *GodisClient) {
+	if len(c.args)%2 == 0 {
+		server.AddReplyStr(c, "-ERR syntax error\r\n")
+		return
+	}
+	for i := 1; i < len(c.args); i += 2 {
+		opt := strings.ToLower(c.args[i].StrVal())
+		val := c.args[i+1].StrVal()
+		switch opt {
+		case "listening-port":
+			port, err := strconv.Atoi(val)
+			if err != nil {
+				server.AddReplyStr(c, "-ERR value is not an integer or out of range\r\n")
+				return
+			}
+			c.slaveListeningPort = port
+		case "capa":
+			switch strings.ToLower(val) {
+			case "eof":
+				c.slaveCapa |= SLAVE_CAPA_EOF
+			case "psync2":
+				c.slaveCapa |= SLAVE_CAPA_PSYNC2
+			}
+		case "ack":
+			// replica定期报告已经处理的offset，不需要回复
+			if c.flags&CLIENT_SLAVE == 0 {
+				return
+			}
+			offset, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return
+			}
+			if offset > c.replAckOff {
+				c.replAckOff = offset
+			}
+			c.replAckTime = time.Now().Unix()
+			return
+		case "getack":
+			// master要求立即报告offset
+			if server.master == c {
+				server.replicationSendAck()
+			}
+			return
+		default:
+			server.AddReplyStr(c, fmt.Sprintf("-ERR Unrecognized REPLCONF option: %s\r\n", c.args[i].StrVal()))
+			return
+		}
+	}
+	server.AddReplyStr(c, "+OK\r\n")
+}
+
+// masterTryPartialResynchronization replid与offset对应的数据还在backlog中时部分同步，
+// 回复+CONTINUE <replid>并发送backlog中offset之后的数据，否则返回false进行全量同步
+func (server *GodisServer) masterTryPartialResynchronization(c *GodisClient) bool {
+	replid := c.args[1].StrVal()
+	offset, err := strconv.ParseInt(c.args[2].StrVal(), 10, 64)
+	if err != nil {
+		return false
+	}
+	// replid2只在切换之前的offset范围内有效
+	if replid != server.replid && (replid != server.replid2 || offset > server.secondReplidOffset) {
+		if replid != "?" {
+			if replid != server.replid2 {
+				log.Printf("partial resynchronization not accepted: replication ID mismatch (replica asked for '%v', my replication IDs are '%v' and '%v')\n",
+					replid, server.replid, server.replid2)
+			} else {
+				log.Printf("partial resynchronization not accepted: requested offset for second ID was %v, but I can reply up to %v\n",
+					offset, server.secondReplidOffset)
+			}
+		}
+		return false
+	}
+	if server.replBacklog == nil || offset < server.replBacklogOff || offset > server.replBacklogOff+server.replBacklogHistlen {
+		log.Printf("unable to partial resync with replica %v for lack of backlog (replica request was: %v)\n", c.addr, offset)
+		return false
+	}
+	c.flags |= CLIENT_SLAVE
+	c.replAckTime = time.Now().Unix()
+	server.slaves = append(server.slaves, c)
+	// 旧的replica不认识+CONTINUE之后的replid
+	if c.slaveCapa&SLAVE_CAPA_PSYNC2 != 0 {
+		server.AddReplyStr(c, fmt.Sprintf("+CONTINUE %s\r\n", server.replid))
+	} else {
+		server.AddReplyStr(c, "+CONTINUE\r\n")
+	}
+	size := server.addReplyReplicationBacklog(c, offset)
+	log.Printf("partial resynchronization request from %v accepted. Sending %v bytes of backlog starting from offset %v\n",
+		c.addr, size, offset)
+	return true
+}
+
+// PSYNC <replid> <offset>，能部分同步时回复+CONTINUE，否则全量同步:
+// 回复+FULLRESYNC <replid> <offset>，之后以 $<len>\r\n<rdb> 发送快照，
+// 快照是在内存中同步生成的，之后的写命令都会进入该replica的复制流
+func (server *GodisServer) psyncCommand(c *GodisClient) {
+	if c.flags&CLIENT_SLAVE != 0 {
+		return
+	}
+	if server.masterhost != "" && server.replState != REPL_STATE_CONNECTED {
+		server.AddReplyStr(c, "-NOMASTERLINK Can't SYNC while not connected with my master\r\n")
+		return
+	}
+	if c.hasPendingReplies() {
+		server.AddReplyStr(c, "-ERR SYNC and PSYNC are invalid with pending output\r\n")
+		return
+	}
+	if server.masterTryPartialResynchronization(c) {
+		return
+	}
+	if server.replBacklog == nil {
+		// 没有backlog时的offset没有记录复制流，使用新的复制历史
+		server.changeReplicationId()
+		server.clearReplicationId2()
+		server.createReplicationBacklog()
+	}
+	// 不能解析EOF标记的replica只能使用磁盘上的RDB
+	var err error
+	if server.replDisklessSync && c.slaveCapa&SLAVE_CAPA_EOF != 0 {
+		err = server.replicationSendRdbDiskless(c)
+	} else {
+		err = server.replicationSendRdbFromDisk(c)
+	}
+	if err != nil {
+		log.Printf("generate rdb for replica %v err: %v\n", c.addr, err)
+		if c.hasPendingReplies() {
+			server.freeClientAsync(c) //已经发送了部分RDB
+		} else {
+			server.AddReplyStr(c, "-ERR can't generate the RDB for the replica\r\n")
+		}
+		return
+	}
+	c.flags |= CLIENT_SLAVE
+	c.replAckTime = time.Now().Unix()
+	server.slaves = append(server.slaves, c)
+}
+
+// replyWriter 写入的数据追加到客户端的回复中
+type replyWriter struct {
+	server *GodisServer
+	c      *GodisClient
+}
+
+func (w *replyWriter) Write(p []byte) (int, error) {
+	w.server.AddReplyStr(w.c, string(p))
+	return len(p), nil
+}
+
+// replicationSendRdbFromDisk 先把RDB写入dbfilename，再以 $<len>\r\n<rdb> 发送文件的内容
+func (server *GodisServer) replicationSendRdbFromDisk(c *GodisClient) error {
+	if err := server.rdbSaveToFile(server.dbfilename); err != nil {
+		return err
+	}
+	rdb, err := os.ReadFile(server.dbfilename)
+	if err != nil {
+		return err
+	}
+	log.Printf("replica %v asks for synchronization, full resync with %v bytes of rdb from disk\n", c.addr, len(rdb))
+	server.AddReplyStr(c, fmt.Sprintf("+FULLRESYNC %s %d\r\n", server.replid, server.masterReplOffset))
+	server.AddReplyStr(c, fmt.Sprintf("$%d\r\n", len(rdb)))
+	server.AddReplyStr(c, string(rdb))
+	return nil
+}
+
+// replicationSendRdbDiskless 不写磁盘，RDB直接写入replica的输出缓冲，
+// 长度事先未知，以 $EOF:<mark>\r\n<rdb><mark> 发送，mark是随机的40个字符
+func (server *GodisServer) replicationSendRdbDiskless(c *GodisClient) error {
+	mark := genReplicationId()
+	log.Printf("replica %v asks for synchronization, starting diskless full resync\n", c.addr)
+	server.AddReplyStr(c, fmt.Sprintf("+FULLRESYNC %s %d\r\n", server.replid, server.masterReplOffset))
+	server.AddReplyStr(c, fmt.Sprintf("$EOF:%s\r\n", mark))
+	w := bufio.NewWriterSize(&replyWriter{server: server, c: c}, GODIS_IO_BUF)
+	if err := server.rdbSave(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	server.AddReplyStr(c, mark)
+	return nil
+}
+
+// replicationCountAcksByOffset 已经确认收到offset之前的复制流的replica数量
+func (server *GodisServer) replicationCountAcksByOffset(offset int64) int {
+	count := 0
+	for _, slave := range server.slaves {
+		if slave.replAckOff >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+// replicationRequestAckFromSlaves 通过复制流发送REPLCONF GETACK *，replica收到后立即回复ACK
+func (server *GodisServer) replicationRequestAckFromSlaves() {
+	if server.masterhost != "" || len(server.slaves) == 0 {
+		return
+	}
+	server.replicationFeedStream(multiBulkString([]string{"REPLCONF", "GETACK", "*"}))
+}
+
+// WAIT numreplicas timeout
+// 阻塞直到至少numreplicas个replica确认了该连接之前的写命令，或者超时(毫秒，0表示一直等待)，
+// 回复确认的replica数量
+func (server *GodisServer) waitCommand(c *GodisClient) {
+	if server.masterhost != "" {
+		server.AddReplyStr(c, "-ERR WAIT cannot be used with replica instances. Please also note that writes to replicas are just local and are not propagated.\r\n")
+		return
+	}
+	numreplicas, err := strconv.Atoi(c.args[1].StrVal())
+	if err != nil {
+		server.AddReplyStr(c, "-ERR value is not an integer or out of range\r\n")
+		return
+	}
+	timeout, err := strconv.ParseInt(c.args[2].StrVal(), 10, 64)
+	if err != nil {
+		server.AddReplyStr(c, "-ERR timeout is not an integer or out of range\r\n")
+		return
+	}
+	if timeout < 0 {
+		server.AddReplyStr(c, "-ERR timeout is negative\r\n")
+		return
+	}
+	// 事务中不能阻塞，直接回复当前的数量
+	acks := server.replicationCountAcksByOffset(c.woff)
+	if acks >= numreplicas || c.flags&CLIENT_MULTI != 0 {
+		server.AddReplyStr(c, fmt.Sprintf(":%d\r\n", acks))
+		return
+	}
+	c.flags |= CLIENT_BLOCKED
+	c.btype = BLOCKED_WAIT
+	c.bpopTimeout = 0
+	if timeout > 0 {
+		c.bpopTimeout = GetMsTime() + timeout
+	}
+	c.bpopNumReplicas = numreplicas
+	c.bpopReploffset = c.woff
+	server.clientsWaitingAcks = append(server.clientsWaitingAcks, c)
+	server.getAckFromSlaves = true
+}
+
+// processClientsWaitingReplicas 在beforeSleep中执行，
+// 足够多的replica确认或者超时后回复并解除阻塞，之后继续处理缓冲区中的命令
+func (server *GodisServer) processClientsWaitingReplicas() {
+	now := GetMsTime()
+	waiting := server.clientsWaitingAcks
+	server.clientsWaitingAcks = nil
+	var unblocked []*GodisClient
+	for _, c := range waiting {
+		acks := server.replicationCountAcksByOffset(c.bpopReploffset)
+		if acks < c.bpopNumReplicas && (c.bpopTimeout == 0 || now < c.bpopTimeout) {
+			server.clientsWaitingAcks = append(server.clientsWaitingAcks, c)
+			continue
+		}
+		c.flags &= ^CLIENT_BLOCKED
+		c.btype = BLOCKED_NONE
+		server.AddReplyStr(c, fmt.Sprintf(":%d\r\n", acks))
+		unblocked = append(unblocked, c)
+	}
+	for _, c := range unblocked {
+		if server.clients[c.fd] != c {
+			continue //处理之前的客户端时被关闭
+		}
+		if err := server.ProcessQueryBuf(c); err != nil {
+			server.freeClient(c)
+		}
+	}
+}
+
+func (server *GodisServer) removeClientWaitingAcks(c *GodisClient) {
+	for i, w := range server.clientsWaitingAcks {
+		if w == c {
+			server.clientsWaitingAcks = append(server.clientsWaitingAcks[:i], server.clientsWaitingAcks[i+1:]...)
+			break
+		}
+	}
+}
+
+// REPLICAOF host port | REPLICAOF NO ONE
+func (server *GodisServer) replicaofCommand(c *GodisClient) {
+	host, portStr := c.args[1].StrVal(), c.args[2].StrVal()
+	if strings.ToLower(host) == "no" && strings.ToLower(portStr) == "one" {
+		if server.masterhost != "" {
+			server.replicationUnsetMaster()
+			log.Printf("MASTER MODE enabled (user request from %v)\n", c.addr)
+		}
+		server.AddReplyStr(c, "+OK\r\n")
+		return
+	}
+	if c.flags&CLIENT_SLAVE != 0 {
+		// replica连接上执行REPLICAOF会造成复制环
+		server.AddReplyStr(c, "-ERR Command is not valid when client is a replica.\r\n")
+		return
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		server.AddReplyStr(c, "-ERR Invalid master port\r\n")
+		return
+	}
+	if server.masterhost == host && server.masterport == port {
+		server.AddReplyStr(c, "+OK Already connected to specified master\r\n")
+		return
+	}
+	server.replicationSetMaster(host, port)
+	log.Printf("REPLICAOF %v enabled (user request from %v)\n", FormatAddr(host, port), c.addr)
+	server.AddReplyStr(c, "+OK\r\n")
+}
+
+func (server *GodisServer) replicationSetMaster(host string, port int) {
+	if server.masterhost == "" {
+		// 原来是master，用自己的复制历史尝试与新的master部分同步
+		server.replicationCacheMasterUsingMyself()
+	}
+	if server.master != nil {
+		server.freeClient(server.master)
+	}
+	server.cancelReplicationHandshake()
+	server.masterhost = host
+	server.masterport = port
+	server.replState = REPL_STATE_CONNECT
+	server.replDownSince = time.Now().Unix()
+	server.connectWithMaster()
+}
+
+// replicationUnsetMaster 成为master，保留复制历史，
+// 断开replica让它们重新同步以得知新的replid，它们可以用旧的replid部分同步
+func (server *GodisServer) replicationUnsetMaster() {
+	server.masterhost = ""
+	if server.master != nil {
+		server.freeClient(server.master)
+	}
+	server.replicationDiscardCachedMaster()
+	server.cancelReplicationHandshake()
+	server.shiftReplicationId()
+	server.disconnectSlaves()
+	server.replState = REPL_STATE_NONE
+}
+
+// replicationCacheMasterUsingMyself 数据集就是自己的复制历史，以此与新的master部分同步
+func (server *GodisServer) replicationCacheMasterUsingMyself() {
+	server.cachedMasterReplid = server.replid
+	server.cachedMasterReploff = server.masterReplOffset
+	if server.replBacklog == nil {
+		server.createReplicationBacklog()
+	}
+	log.Printf("before turning into a replica, using my own master parameters to synthesize a cached master: I may be able to synchronize with the new master with just a partial transfer\n")
+}
+
+// replicationDiscardCachedMaster 数据集与缓存的复制历史不再一致时丢弃
+func (server *GodisServer) replicationDiscardCachedMaster() {
+	server.cachedMasterReplid = ""
+	server.cachedMasterReploff = 0
+}
+
+func (server *GodisServer) disconnectSlaves() {
+	for len(server.slaves) > 0 {
+		server.freeClient(server.slaves[0])
+	}
+}
+
+// removeSlave replica断开时从server.slaves中移除
+func (server *GodisServer) removeSlave(c *GodisClient) {
+	for i, s := range server.slaves {
+		if s == c {
+			server.slaves = append(server.slaves[:i], server.slaves[i+1:]...)
+			break
+		}
+	}
+	log.Printf("connection with replica %v lost\n", c.addr)
+}
+
+// replicationHandleMasterDisconnection 与master断开后在replicationCron中重连，
+// 记录已经执行的offset，重连时尝试部分同步
+func (server *GodisServer) replicationHandleMasterDisconnection() {
+	c := server.master
+	server.master = nil
+	server.replicationProxyMasterStream(c)
+	if server.masterhost != "" {
+		server.cachedMasterReplid = server.replid
+		server.cachedMasterReploff = c.reploff
+		server.replState = REPL_STATE_CONNECT
+		server.replDownSince = time.Now().Unix()
+		log.Printf("connection with master lost\n")
+	}
+}
+
+// connectWithMaster 发起非阻塞连接，不阻塞事件循环，连接建立后由connectedWithMaster开始握手，
+// 连接超时由replicationCron根据replTransferLastio处理
+func (server *GodisServer) connectWithMaster() {
+	fd, err := ConnectNonBlock(server.masterhost, server.masterport)
+	if err != nil {
+		log.Printf("unable to connect to MASTER: %v\n", err)
+		return
+	}
+	SetTcpNoDelay(fd)
+	log.Printf("connecting to MASTER %v\n", FormatAddr(server.masterhost, server.masterport))
+	server.replTransferFd = fd
+	server.replTransferBuf = nil
+	server.replTransferSize = -1
+	server.replTransferLastio = time.Now().Unix()
+	server.replState = REPL_STATE_CONNECTING
+	server.aeloop.AddFileEvent(fd, AE_WRITABLE, server.connectedWithMaster, nil)
+}
+
+// connectedWithMaster fd可写表示连接已经有了结果，成功时发送PING开始握手，之后由syncWithMaster驱动
+func (server *GodisServer) connectedWithMaster(loop *AeLoop, fd int, extra interface{}) {
+	if server.replTransferFd != fd || server.replState != REPL_STATE_CONNECTING {
+		return
+	}
+	if err := GetSockError(fd); err != nil {
+		log.Printf("error condition on socket for SYNC: %v\n", err)
+		server.cancelReplicationHandshake()
+		return
+	}
+	server.aeloop.RemoveFileEvent(fd, AE_WRITABLE)
+	log.Printf("MASTER <-> REPLICA sync started\n")
+	server.replTransferLastio = time.Now().Unix()
+	server.replState = REPL_STATE_RECEIVE_PING_REPLY
+	server.aeloop.AddFileEvent(fd, AE_READABLE, server.syncWithMaster, nil)
+	server.sendCommandToMaster("PING")
+}
+
+// cancelReplicationHandshake 放弃正在进行的连接、握手或RDB传输
+func (server *GodisServer) cancelReplicationHandshake() {
+	if server.replTransferFd == -1 {
+		return
+	}
+	if server.replState == REPL_STATE_CONNECTING {
+		server.aeloop.RemoveFileEvent(server.replTransferFd, AE_WRITABLE)
+	} else {
+		server.aeloop.RemoveFileEvent(server.replTransferFd, AE_READABLE)
+	}
+	Close(server.replTransferFd)
+	server.replTransferFd = -1
+	server.replTransferBuf = nil
+	if server.masterhost != "" {
+		server.replState = REPL_STATE_CONNECT
+	}
+}
+
+// sendCommandToMaster 握手阶段的命令很短，直接写入socket
+func (server *GodisServer) sendCommandToMaster(args ...string) {
+	if _, err := Write(server.replTransferFd, []byte(multiBulkString(args))); err != nil {
+		log.Printf("write to MASTER err: %v\n", err)
+		server.cancelReplicationHandshake()
+	}
+}
+
+// readSyncLine 从握手的缓冲中读取一行，没有完整的行时返回false
+func (server *GodisServer) readSyncLine() (string, bool) {
+	idx := bytes.IndexByte(server.replTransferBuf, '\n')
+	if idx < 0 {
+		return "", false
+	}
+	line := strings.TrimSuffix(string(server.replTransferBuf[:idx]), "\r")
+	server.replTransferBuf = server.replTransferBuf[idx+1:]
+	return line, true
+}
+
+// syncWithMaster 处理握手各个阶段master的回复，以及RDB的接收
+func (server *GodisServer) syncWithMaster(loop *AeLoop, fd int, extra interface{}) {
+	buf := make([]byte, GODIS_IO_BUF)
+	n, err := Read(fd, buf)
+	if IsTemporary(err) {
+		return
+	}
+	if err != nil || n == 0 {
+		log.Printf("master link read error during sync: %v\n", err)
+		server.cancelReplicationHandshake()
+		return
+	}
+	server.replTransferLastio = time.Now().Unix()
+	server.replTransferBuf = append(server.replTransferBuf, buf[:n]...)
+	for server.replTransferFd == fd && server.replState != REPL_STATE_CONNECTED {
+		if !server.processSyncBuf(fd) {
+			break
+		}
+	}
+}
+
+// processSyncBuf 处理缓冲中的数据推进握手，数据不够时返回false
+func (server *GodisServer) processSyncBuf(fd int) bool {
+	if server.replState == REPL_STATE_TRANSFER {
+		return server.readSyncBulkPayload(fd)
+	}
+	line, ok := server.readSyncLine()
+	if !ok {
+		return false
+	}
+	switch server.replState {
+	case REPL_STATE_RECEIVE_PING_REPLY:
+		// 需要认证的master会回复NOAUTH，这里不处理，由之后的PSYNC报错
+		if strings.HasPrefix(line, "-") && !strings.HasPrefix(line, "-NOAUTH") &&
+			!strings.HasPrefix(line, "-NOPERM") && !strings.HasPrefix(line, "-ERR operation not permitted") {
+			log.Printf("error reply to PING from master: %v\n", line)
+			server.cancelReplicationHandshake()
+			return false
+		}
+		server.replState = REPL_STATE_RECEIVE_PORT_REPLY
+		server.sendCommandToMaster("REPLCONF", "listening-port", strconv.Itoa(server.port))
+	case REPL_STATE_RECEIVE_PORT_REPLY:
+		if strings.HasPrefix(line, "-") {
+			log.Printf("(non critical) master does not understand REPLCONF listening-port: %v\n", line)
+		}
+		server.replState = REPL_STATE_RECEIVE_CAPA_REPLY
+		server.sendCommandToMaster("REPLCONF", "capa", "eof", "capa", "psync2")
+	case REPL_STATE_RECEIVE_CAPA_REPLY:
+		if strings.HasPrefix(line, "-") {
+			log.Printf("(non critical) master does not understand REPLCONF capa: %v\n", line)
+		}
+		server.replState = REPL_STATE_RECEIVE_PSYNC_REPLY
+		server.slaveTryPartialResynchronization()
+	case REPL_STATE_RECEIVE_PSYNC_REPLY:
+		if line == "" {
+			return true //master准备RDB期间发送的换行
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "+CONTINUE" {
+			server.slaveContinueReplication(fd, fields)
+			return false
+		}
+		if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+			log.Printf("unexpected reply to PSYNC from master: %v\n", line)
+			server.cancelReplicationHandshake()
+			return false
+		}
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || len(fields[1]) != CONFIG_RUN_ID_SIZE {
+			log.Printf("bad FULLRESYNC reply from master: %v\n", line)
+			server.cancelReplicationHandshake()
+			return false
+		}
+		log.Printf("full resync from master: %v:%v\n", fields[1], offset)
+		// 数据集会被替换，之前的复制历史不再可用
+		server.replicationDiscardCachedMaster()
+		server.masterReplidPending = fields[1]
+		server.masterInitialOffset = offset
+		server.replState = REPL_STATE_TRANSFER
+		server.replTransferSize = -1
+	}
+	return server.replTransferFd == fd
+}
+
+// slaveTryPartialResynchronization 有缓存的复制历史时请求offset之后的数据，否则请求全量同步
+func (server *GodisServer) slaveTryPartialResynchronization() {
+	if server.cachedMasterReplid == "" {
+		server.sendCommandToMaster("PSYNC", "?", "-1")
+		return
+	}
+	offset := strconv.FormatInt(server.cachedMasterReploff+1, 10)
+	log.Printf("trying a partial resynchronization (request %v:%v)\n", server.cachedMasterReplid, offset)
+	server.sendCommandToMaster("PSYNC", server.cachedMasterReplid, offset)
+}
+
+// slaveContinueReplication 处理+CONTINUE [<replid>]，用缓存的offset继续接收复制流
+func (server *GodisServer) slaveContinueReplication(fd int, fields []string) {
+	if server.cachedMasterReplid == "" {
+		log.Printf("unexpected +CONTINUE from master without cached master\n")
+		server.cancelReplicationHandshake()
+		return
+	}
+	log.Printf("successful partial resynchronization with master\n")
+	if len(fields) > 1 && fields[1] != server.cachedMasterReplid && len(fields[1]) == CONFIG_RUN_ID_SIZE {
+		// master的replid变了(比如发生了切换)，之前的历史保存为replid2
+		server.replid2 = server.cachedMasterReplid
+		server.secondReplidOffset = server.masterReplOffset + 1
+		server.replid = fields[1]
+		log.Printf("master replication ID changed to %v\n", server.replid)
+		// 下级replica需要重新同步以得知新的replid
+		server.disconnectSlaves()
+	}
+	rest := server.replTransferBuf
+	reploff := server.cachedMasterReploff
+	server.aeloop.RemoveFileEvent(fd, AE_READABLE)
+	server.replTransferFd = -1
+	server.replTransferBuf = nil
+	server.replicationDiscardCachedMaster()
+	server.replicationCreateMasterClient(fd, rest, reploff)
+	log.Printf("MASTER <-> REPLICA sync: master accepted a partial resynchronization\n")
+}
+
+// readSyncBulkPayload 接收 $<len>\r\n<rdb> 或者 $EOF:<mark>\r\n<rdb><mark>，
+// 完整后加载并开始接收复制流
+func (server *GodisServer) readSyncBulkPayload(fd int) bool {
+	if server.replTransferSize == -1 {
+		line, ok := server.readSyncLine()
+		if !ok {
+			return false
+		}
+		if line == "" {
+			return true
+		}
+		if line[0] == '-' {
+			log.Printf("MASTER aborted replication with an error: %v\n", line)
+			server.cancelReplicationHandshake()
+			return false
+		}
+		if strings.HasPrefix(line, "$EOF:") && len(line) == 5+CONFIG_RUN_ID_SIZE {
+			server.replTransferEofMark = line[5:]
+			server.replTransferSize = 0
+			server.replTransferScanned = 0
+			log.Printf("MASTER <-> REPLICA sync: receiving streamed RDB from master\n")
+		} else {
+			size, err := strconv.ParseInt(line[1:], 10, 64)
+			if line[0] != '$' || err != nil || size < 0 {
+				log.Printf("bad protocol from MASTER, the first byte is not '$': %v\n", line)
+				server.cancelReplicationHandshake()
+				return false
+			}
+			server.replTransferEofMark = ""
+			server.replTransferSize = size
+			log.Printf("MASTER <-> REPLICA sync: receiving %v bytes from master\n", size)
+		}
+	}
+	var payload, rest []byte
+	if server.replTransferEofMark != "" {
+		// 标记只可能结束在新收到的数据中，向前多看CONFIG_RUN_ID_SIZE-1字节，避免每次都扫描整个RDB
+		start := server.replTransferScanned - (CONFIG_RUN_ID_SIZE - 1)
+		if start < 0 {
+			start = 0
+		}
+		idx := bytes.Index(server.replTransferBuf[start:], []byte(server.replTransferEofMark))
+		if idx < 0 {
+			server.replTransferScanned = len(server.replTransferBuf)
+			return false
+		}
+		idx += start
+		payload = server.replTransferBuf[:idx]
+		rest = server.replTransferBuf[idx+CONFIG_RUN_ID_SIZE:]
+	} else {
+		if int64(len(server.replTransferBuf)) < server.replTransferSize {
+			return false
+		}
+		payload = server.replTransferBuf[:server.replTransferSize]
+		rest = server.replTransferBuf[server.replTransferSize:]
+	}
+	server.aeloop.RemoveFileEvent(fd, AE_READABLE)
+	server.replTransferFd = -1
+	server.replTransferBuf = nil
+
+	if err := server.replicationLoadPayload(payload); err != nil {
+		log.Printf("failed trying to load the MASTER synchronization DB: %v\n", err)
+		Close(fd)
+		server.replState = REPL_STATE_CONNECT
+		return false
+	}
+	// 数据集已经改变，下级replica需要重新同步，backlog从master的offset开始
+	server.disconnectSlaves()
+	server.replid = server.masterReplidPending
+	server.clearReplicationId2()
+	server.masterReplOffset = server.masterInitialOffset
+	server.freeReplicationBacklog()
+	server.createReplicationBacklog()
+	server.replicationCreateMasterClient(fd, rest, server.masterInitialOffset)
+	log.Printf("MASTER <-> REPLICA sync: finished with success\n")
+	return false
+}
+
+// replicationLoadPayload 按repl-diskless-load加载master发来的RDB，
+// 除了swapdb之外，加载失败时数据库被清空
+func (server *GodisServer) replicationLoadPayload(payload []byte) error {
+	if server.replDisklessLoad == REPL_DISKLESS_LOAD_SWAPDB {
+		data, expire := server.db.data, server.db.expire
+		server.db.data = DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual})
+		server.db.expire = DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual})
+		if err := server.rdbLoad(bytes.NewReader(payload)); err != nil {
+			log.Printf("MASTER <-> REPLICA sync: discarding the loaded data, restoring the old one\n")
+			server.db.data, server.db.expire = data, expire
+			return err
+		}
+		// 原来的和新加载的key都可能变了
+		server.signalDictKeys(data)
+		server.signalDictKeys(server.db.data)
+		return nil
+	}
+	var err error
+	if server.replDisklessLoad == REPL_DISKLESS_LOAD_ON_EMPTY_DB && server.db.data.Size() == 0 {
+		log.Printf("MASTER <-> REPLICA sync: loading DB in memory\n")
+		server.emptyData()
+		err = server.rdbLoad(bytes.NewReader(payload))
+	} else {
+		err = server.replicationLoadPayloadFromDisk(payload)
+	}
+	if err != nil {
+		server.emptyData()
+	}
+	return err
+}
+
+// replicationLoadPayloadFromDisk 写入临时文件后rename为dbfilename，再从文件加载
+func (server *GodisServer) replicationLoadPayloadFromDisk(payload []byte) error {
+	tmpfile := filepath.Join(filepath.Dir(server.dbfilename), fmt.Sprintf("temp-%d.%d.rdb", time.Now().Unix(), os.Getpid()))
+	if err := os.WriteFile(tmpfile, payload, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpfile, server.dbfilename); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	log.Printf("MASTER <-> REPLICA sync: flushing old data\n")
+	server.emptyData()
+	log.Printf("MASTER <-> REPLICA sync: loading DB from disk\n")
+	return server.rdbLoadFile(server.dbfilename)
+}
+
+// replicationCreateMasterClient 之后master发来的复制流与普通客户端的命令一样执行，
+// reploff为已经执行的复制流的offset
+func (server *GodisServer) replicationCreateMasterClient(fd int, rest []byte, reploff int64) {
+	c := server.CreateClient(fd)
+	c.flags |= CLIENT_MASTER
+	c.authenticated = true
+	c.user = nil
+	c.ip = server.masterhost
+	c.port = server.masterport
+	c.addr = FormatAddr(server.masterhost, server.masterport)
+	c.laddr = LocalAddr(fd)
+	c.reploff = reploff
+	c.readReploff = reploff
+	server.clients[fd] = c
+	server.clientsByID[c.id] = c
+	c.node = server.clientList.PushBack(c)
+	server.master = c
+	server.replState = REPL_STATE_CONNECTED
+	server.aeloop.AddFileEvent(fd, AE_READABLE, server.ReadQueryFromClient, c)
+	if len(rest) == 0 {
+		return
+	}
+	// RDB之后已经读到的复制流
+	c.queryBuf = append(append([]byte{}, rest...), make([]byte, GODIS_IO_BUF)...)
+	c.queryLen = len(rest)
+	server.masterInputReceived(c, len(rest))
+	if err := server.ProcessQueryBuf(c); err != nil {
+		log.Printf("process master stream err: %v\n", err)
+		server.freeClient(c)
+		return
+	}
+	server.replicationProxyMasterStream(c)
+}
+
+// masterInputReceived 记录从master读到的n个字节，它们已经在querybuf的末尾
+func (server *GodisServer) masterInputReceived(c *GodisClient, n int) {
+	c.readReploff += int64(n)
+	c.pendingStream = append(c.pendingStream, c.queryBuf[c.queryLen-n:c.queryLen]...)
+}
+
+// replicationSendAck 向master报告已经处理的offset
+func (server *GodisServer) replicationSendAck() {
+	c := server.master
+	c.flags |= CLIENT_MASTER_FORCE_REPLY
+	server.AddReplyStr(c, multiBulkString([]string{"REPLCONF", "ACK", strconv.FormatInt(c.reploff, 10)}))
+	c.flags &= ^CLIENT_MASTER_FORCE_REPLY
+}
+
+// emptyData 清空数据库
+func (server *GodisServer) emptyData() {
+	server.signalDictKeys(server.db.data)
+	server.db.data = DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual})
+	server.db.expire = DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual})
+}
+
+// signalDictKeys WATCH这些key的事务会失败，缓存的key会失效
+func (server *GodisServer) signalDictKeys(d *Dict) {
+	var keys []string
+	d.ForEach(func(e *Entry) {
+		keys = append(keys, e.Key.StrVal())
+	})
+	for _, key := range keys {
+		server.signalModifiedKey(nil, server.db, key)
+	}
+}
+
+// replicationCron 每秒执行一次
+func (server *GodisServer) replicationCron() {
+	now := time.Now().Unix()
+	if server.masterhost != "" && server.replState > REPL_STATE_CONNECT && server.replState < REPL_STATE_CONNECTED &&
+		now-server.replTransferLastio > REPL_TIMEOUT {
+		log.Printf("timeout connecting to the MASTER\n")
+		server.cancelReplicationHandshake()
+	}
+	if server.master != nil && now-server.master.lastinteraction > REPL_TIMEOUT {
+		log.Printf("MASTER timeout: no data nor PING received\n")
+		server.freeClient(server.master)
+	}
+	if server.masterhost != "" && server.replState == REPL_STATE_CONNECT {
+		server.connectWithMaster()
+	}
+	if server.master != nil {
+		server.replicationSendAck()
+	}
+
+	// 定期PING，replica可以据此判断与master的连接是否超时，下级replica的复制流由上级转发
+	if server.masterhost == "" && len(server.slaves) > 0 && server.cronloops%(REPL_PING_REPLICA_PERIOD*int64(SERVER_CRON_HZ)) == 0 {
+		server.replicationFeedStream(multiBulkString([]string{"PING"}))
+	}
+	for i := 0; i < len(server.slaves); i++ {
+		slave := server.slaves[i]
+		if now-slave.replAckTime > REPL_TIMEOUT {
+			log.Printf("disconnecting timedout replica: %v\n", slave.addr)
+			server.freeClient(slave)
+			i--
+		}
+	}
+}
+
+func (server *GodisServer) genReplicationInfoString(info *strings.Builder) {
+	info.WriteString("# Replication\r\n")
+	if server.masterhost == "" {
+		info.WriteString("role:master\r\n")
+	} else {
+		info.WriteString("role:slave\r\n")
+		fmt.Fprintf(info, "master_host:%s\r\n", server.masterhost)
+		fmt.Fprintf(info, "master_port:%d\r\n", server.masterport)
+		linkStatus := "down"
+		if server.replState == REPL_STATE_CONNECTED {
+			linkStatus = "up"
+		}
+		fmt.Fprintf(info, "master_link_status:%s\r\n", linkStatus)
+		lastIO := int64(-1)
+		var readOffset, offset int64
+		if server.master != nil {
+			lastIO = time.Now().Unix() - server.master.lastinteraction
+			readOffset, offset = server.master.readReploff, server.master.reploff
+		} else if server.cachedMasterReplid != "" {
+			readOffset, offset = server.cachedMasterReploff, server.cachedMasterReploff
+		}
+		fmt.Fprintf(info, "master_last_io_seconds_ago:%d\r\n", lastIO)
+		syncing := 0
+		if server.replState == REPL_STATE_TRANSFER {
+			syncing = 1
+		}
+		fmt.Fprintf(info, "master_sync_in_progress:%d\r\n", syncing)
+		fmt.Fprintf(info, "slave_read_repl_offset:%d\r\n", readOffset)
+		fmt.Fprintf(info, "slave_repl_offset:%d\r\n", offset)
+		if server.replState != REPL_STATE_CONNECTED {
+			fmt.Fprintf(info, "master_link_down_since_seconds:%d\r\n", time.Now().Unix()-server.replDownSince)
+		}
+		readOnly := 0
+		if server.replicaReadOnly {
+			readOnly = 1
+		}
+		fmt.Fprintf(info, "slave_read_only:%d\r\n", readOnly)
+	}
+	fmt.Fprintf(info, "connected_slaves:%d\r\n", len(server.slaves))
+	now := time.Now().Unix()
+	for i, slave := range server.slaves {
+		fmt.Fprintf(info, "slave%d:ip=%s,port=%d,state=online,offset=%d,lag=%d\r\n",
+			i, slave.ip, slave.slaveListeningPort, slave.replAckOff, now-slave.replAckTime)
+	}
+	fmt.Fprintf(info, "master_replid:%s\r\n", server.replid)
+	fmt.Fprintf(info, "master_replid2:%s\r\n", server.replid2)
+	fmt.Fprintf(info, "master_repl_offset:%d\r\n", server.masterReplOffset)
+	fmt.Fprintf(info, "second_repl_offset:%d\r\n", server.secondReplidOffset)
+	active := 0
+	if server.replBacklog != nil {
+		active = 1
+	}
+	fmt.Fprintf(info, "repl_backlog_active:%d\r\n", active)
+	fmt.Fprintf(info, "repl_backlog_size:%d\r\n", server.replBacklogSize)
+	fmt.Fprintf(info, "repl_backlog_first_byte_offset:%d\r\n", server.replBacklogOff)
+	fmt.Fprintf(info, "repl_backlog_histlen:%d\r\n", server.replBacklogHistlen)
+}
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestReplicationMaster(t *testing.T) {
+	conf := Config{DbFilename: filepath.Join(t.TempDir(), "dump.rdb")}
+	assert.Nil(t, server.initServer(&conf))
+	var clients []*GodisClient
+	for i := 0; i < 2; i++ {
+		clients = append(clients, newTestClient(t, "127.0.0.1", 7100+i))
+	}
+	replica, c := clients[0], clients[1]
+	runQuery(t, c, "set k v\r\n")
+
+	// 没有replica时offset不增加
+	assert.Equal(t, int64(0), server.masterReplOffset)
+	assert.Equal(t, "+OK\r\n", runQuery(t, replica, "replconf listening-port 6380\r\n"))
+	assert.Equal(t, "+OK\r\n", runQuery(t, replica, "replconf capa eof capa psync2\r\n"))
+	reply := runQuery(t, replica, "psync ? -1\r\n")
+	header := fmt.Sprintf("+FULLRESYNC %s 0\r\n", server.replid)
+	assert.True(t, strings.HasPrefix(reply, header))
+	// 支持EOF标记的replica使用diskless同步
+	reply = reply[len(header):]
+	assert.True(t, strings.HasPrefix(reply, "$EOF:"))
+	mark := reply[5 : 5+CONFIG_RUN_ID_SIZE]
+	rdb := reply[5+CONFIG_RUN_ID_SIZE+2:]
+	assert.True(t, strings.HasSuffix(rdb, mark))
+	rdb = strings.TrimSuffix(rdb, mark)
+	assert.Equal(t, "REDIS0009", rdb[:9])
+	assert.Contains(t, rdb, "\x00\x01k\x01v")
+	assert.Nil(t, server.rdbLoad(strings.NewReader(rdb)))
+	assert.Equal(t, "S", getClientFlagsString(replica))
+	_, err := os.Stat(conf.DbFilename)
+	assert.True(t, os.IsNotExist(err))
+
+	// 只传播修改了数据的命令
+	runQuery(t, c, "set k v2\r\nget k\r\nlpush k x\r\nlpop nokey\r\n")
+	stream := "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$2\r\nv2\r\n"
+	assert.Equal(t, stream, takeReply(replica))
+	assert.Equal(t, int64(len(stream)), server.masterReplOffset)
+	runQuery(t, c, "multi\r\nget k\r\nset a 1\r\nzadd z 1 m\r\nexec\r\nmulti\r\nget k\r\nexec\r\n")
+	assert.Equal(t, "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n*4\r\n$4\r\nzadd\r\n$1\r\nz\r\n$1\r\n1\r\n$1\r\nm\r\n*1\r\n$4\r\nEXEC\r\n",
+		takeReply(replica))
+
+	// REPLCONF ACK不回复
+	assert.Equal(t, "", runQuery(t, replica, "replconf ack 30\r\n"))
+	info := runQuery(t, c, "info replication\r\n")
+	assert.Contains(t, info, "role:master\r\nconnected_slaves:1\r\nslave0:ip=127.0.0.1,port=6380,state=online,offset=30,lag=0\r\n")
+	assert.Contains(t, info, fmt.Sprintf("master_replid:%s\r\n", server.replid))
+	assert.Contains(t, info, fmt.Sprintf("master_repl_offset:%d\r\n", server.masterReplOffset))
+	assert.Equal(t, "-ERR Unrecognized REPLCONF option: foo\r\n", runQuery(t, c, "replconf foo bar\r\n"))
+
+	server.freeClient(replica)
+	assert.Equal(t, 0, len(server.slaves))
+	assert.Contains(t, runQuery(t, c, "info replication\r\n"), "connected_slaves:0\r\n")
+
+	// 不支持EOF标记时先写入dbfilename
+	replica = newTestClient(t, "127.0.0.1", 7102)
+	reply = runQuery(t, replica, "psync ? -1\r\n")
+	header = fmt.Sprintf("+FULLRESYNC %s %d\r\n", server.replid, server.masterReplOffset)
+	assert.True(t, strings.HasPrefix(reply, header))
+	data, err := os.ReadFile(conf.DbFilename)
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("$%d\r\n%s", len(data), data), reply[len(header):])
+	server.freeClient(replica)
+	server.freeClient(c)
+}
+
+// fakeMaster 在goroutine中模拟master的握手，收到的命令发送到cmds
+type fakeMaster struct {
+	conn net.Conn
+	r    *bufio.Reader
+	cmds chan []string
+}
+
+func (m *fakeMaster) readCommand() ([]string, error) {
+	line, err := m.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, err = m.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(m.r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// serveFakeMaster 依次接受replica的连接，完成握手后以replies中对应的数据回复PSYNC
+func serveFakeMaster(ln net.Listener, replies []string) (<-chan []string, <-chan net.Conn) {
+	psyncs := make(chan []string, len(replies))
+	conns := make(chan net.Conn, len(replies))
+	go func() {
+		for _, reply := range replies {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			master := &fakeMaster{conn: conn, r: bufio.NewReader(conn)}
+			for _, r := range []string{"+PONG\r\n", "+OK\r\n", "+OK\r\n"} {
+				master.readCommand()
+				conn.Write([]byte(r))
+			}
+			cmd, _ := master.readCommand()
+			psyncs <- cmd
+			conn.Write([]byte(reply))
+			conns <- conn
+		}
+	}()
+	return psyncs, conns
+}
+
+// processEventsUntil 驱动事件循环直到cond成立
+func processEventsUntil(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() && time.Now().Before(deadline) {
+		tes, fes := server.aeloop.AeWait()
+		server.aeloop.AeProcess(tes, fes)
+	}
+	assert.True(t, cond())
+}
+
+func TestReplicationReplica(t *testing.T) {
+	conf := Config{DbFilename: filepath.Join(t.TempDir(), "dump.rdb")}
+	assert.Nil(t, server.initServer(&conf))
+	c := newTestClient(t, "127.0.0.1", 7200)
+	// master的数据
+	runQuery(t, c, "set k1 v1\r\nlpush l a\r\n")
+	rdb, err := server.rdbSaveToBytes()
+	assert.Nil(t, err)
+	runQuery(t, c, "set old x\r\nwatch old\r\n")
+	myReplid := server.replid
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+	replid := strings.Repeat("a", CONFIG_RUN_ID_SIZE)
+	stream := "*3\r\n$3\r\nset\r\n$2\r\nk2\r\n$2\r\nv2\r\n"
+	handshake := make(chan [][]string, 1)
+	var master *fakeMaster
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		master = &fakeMaster{conn: conn, r: bufio.NewReader(conn), cmds: make(chan []string, 16)}
+		var cmds [][]string
+		for _, reply := range []string{"+PONG\r\n", "+OK\r\n", "+OK\r\n"} {
+			cmd, _ := master.readCommand()
+			cmds = append(cmds, cmd)
+			conn.Write([]byte(reply))
+		}
+		cmd, _ := master.readCommand()
+		cmds = append(cmds, cmd)
+		// RDB之后紧跟着复制流
+		conn.Write([]byte(fmt.Sprintf("+FULLRESYNC %s 100\r\n\n$%d\r\n%s%s", replid, len(rdb), rdb, stream)))
+		handshake <- cmds
+		for {
+			cmd, err := master.readCommand()
+			if err != nil {
+				close(master.cmds)
+				return
+			}
+			master.cmds <- cmd
+		}
+	}()
+
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, fmt.Sprintf("replicaof 127.0.0.1 %d\r\n", port)))
+	assert.Equal(t, "+OK Already connected to specified master\r\n", runQuery(t, c, fmt.Sprintf("replicaof 127.0.0.1 %d\r\n", port)))
+	processEventsUntil(t, func() bool { return server.replState == REPL_STATE_CONNECTED })
+	assert.Equal(t, [][]string{{"PING"}, {"REPLCONF", "listening-port", "0"}, {"REPLCONF", "capa", "eof", "capa", "psync2"}, {"PSYNC", myReplid, "1"}}, <-handshake)
+
+	// 加载了RDB并执行了之后的复制流，旧的数据被清空
+	assert.Equal(t, "$2\r\nv1\r\n$2\r\nv2\r\n$-1\r\n", runQuery(t, c, "get k1\r\nget k2\r\nget old\r\n"))
+	assert.Equal(t, "a", server.db.data.Get(CreateObject(GSTR, "l")).Val.(*List).First().val.StrVal())
+	// 默认先把RDB写入磁盘再加载
+	data, err := os.ReadFile(conf.DbFilename)
+	assert.Nil(t, err)
+	assert.Equal(t, rdb, data)
+	assert.NotEqual(t, 0, c.flags&CLIENT_DIRTY_CAS)
+	assert.Equal(t, "M", getClientFlagsString(server.master))
+	offset := int64(100 + len(stream))
+	assert.Equal(t, offset, server.master.reploff)
+	info := runQuery(t, c, "info replication\r\n")
+	assert.Contains(t, info, fmt.Sprintf("role:slave\r\nmaster_host:127.0.0.1\r\nmaster_port:%d\r\nmaster_link_status:up\r\n", port))
+	assert.Contains(t, info, fmt.Sprintf("slave_read_repl_offset:%d\r\nslave_repl_offset:%d\r\n", offset, offset))
+	assert.Contains(t, info, fmt.Sprintf("master_replid:%s\r\n", replid))
+	assert.Contains(t, info, fmt.Sprintf("master_repl_offset:%d\r\n", offset))
+
+	// 命令不回复，GETACK时报告offset
+	getack := "*3\r\n$8\r\nREPLCONF\r\n$6\r\nGETACK\r\n$1\r\n*\r\n"
+	master.conn.Write([]byte("*1\r\n$4\r\nPING\r\n" + getack))
+	offset += int64(len("*1\r\n$4\r\nPING\r\n")) //不包括GETACK本身
+	var ack []string
+	processEventsUntil(t, func() bool {
+		select {
+		case ack = <-master.cmds:
+		default:
+		}
+		return ack != nil
+	})
+	assert.Equal(t, []string{"REPLCONF", "ACK", strconv.FormatInt(offset, 10)}, ack)
+
+	// master断开后重连
+	master.conn.Close()
+	processEventsUntil(t, func() bool { return server.master == nil })
+	assert.Equal(t, REPL_STATE_CONNECT, server.replState)
+	assert.Contains(t, runQuery(t, c, "info replication\r\n"), "master_link_status:down\r\n")
+
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "replicaof no one\r\n"))
+	assert.Equal(t, REPL_STATE_NONE, server.replState)
+	assert.NotEqual(t, replid, server.replid)
+	assert.Contains(t, runQuery(t, c, "info replication\r\n"), "role:master\r\n")
+	server.freeClient(c)
+}
+
+func TestReplicationPartialResync(t *testing.T) {
+	conf := Config{ReplBacklogSize: "1kb", DbFilename: filepath.Join(t.TempDir(), "dump.rdb")}
+	assert.Nil(t, server.initServer(&conf))
+	assert.Equal(t, CONFIG_REPL_BACKLOG_MIN_SIZE, server.replBacklogSize)
+	var clients []*GodisClient
+	for i := 0; i < 2; i++ {
+		clients = append(clients, newTestClient(t, "127.0.0.1", 7300+i))
+	}
+	replica, c := clients[0], clients[1]
+	psync := func(args string) string {
+		assert.Equal(t, "+OK\r\n", runQuery(t, replica, "replconf capa eof capa psync2\r\n"))
+		return runQuery(t, replica, "psync "+args+"\r\n")
+	}
+	assert.True(t, strings.HasPrefix(psync("? -1"), "+FULLRESYNC"))
+	replid := server.replid
+	runQuery(t, c, "set a 1\r\n")
+	offset := server.masterReplOffset
+	server.freeClient(replica)
+
+	// 没有replica时复制流仍然写入backlog
+	runQuery(t, c, "set b 2\r\n")
+	stream := "*3\r\n$3\r\nset\r\n$1\r\nb\r\n$1\r\n2\r\n"
+	assert.Equal(t, offset+int64(len(stream)), server.masterReplOffset)
+	replica = newTestClient(t, "127.0.0.1", 7302)
+	assert.Equal(t, fmt.Sprintf("+CONTINUE %s\r\n%s", replid, stream), psync(fmt.Sprintf("%s %d", replid, offset+1)))
+	assert.Equal(t, "S", getClientFlagsString(replica))
+	server.freeClient(replica)
+	// 不支持psync2的replica
+	replica = newTestClient(t, "127.0.0.1", 7302)
+	assert.Equal(t, "+CONTINUE\r\n", runQuery(t, replica, fmt.Sprintf("psync %s %d\r\n", replid, server.masterReplOffset+1)))
+	server.freeClient(replica)
+
+	// replid不同或offset不在backlog中时全量同步
+	for _, args := range []string{
+		fmt.Sprintf("%s %d", strings.Repeat("b", CONFIG_RUN_ID_SIZE), offset+1),
+		fmt.Sprintf("%s %d", replid, server.masterReplOffset+2),
+		fmt.Sprintf("%s 0", replid),
+		fmt.Sprintf("%s x", replid),
+	} {
+		replica = newTestClient(t, "127.0.0.1", 7302)
+		assert.True(t, strings.HasPrefix(psync(args), "+FULLRESYNC "+replid))
+		server.freeClient(replica)
+	}
+	// 写入超过backlog大小的数据后，旧的offset不再可用
+	big := strings.Repeat("x", 1000)
+	for i := 0; i < 20; i++ {
+		c.queryBuf = append(c.queryBuf, make([]byte, len(big))...) //与ReadQueryFromClient一样扩展querybuf
+		runQuery(t, c, "set big "+big+"\r\n")
+	}
+	assert.Equal(t, CONFIG_REPL_BACKLOG_MIN_SIZE, server.replBacklogHistlen)
+	assert.Equal(t, server.masterReplOffset-CONFIG_REPL_BACKLOG_MIN_SIZE+1, server.replBacklogOff)
+	replica = newTestClient(t, "127.0.0.1", 7302)
+	assert.True(t, strings.HasPrefix(psync(fmt.Sprintf("%s %d", replid, offset+1)), "+FULLRESYNC"))
+	server.freeClient(replica)
+	replica = newTestClient(t, "127.0.0.1", 7302)
+	reply := psync(fmt.Sprintf("%s %d", replid, server.replBacklogOff))
+	assert.Equal(t, fmt.Sprintf("+CONTINUE %s\r\n", replid), reply[:len(replid)+12])
+	assert.True(t, strings.HasSuffix(reply, big+"\r\n"))
+	assert.Equal(t, int(CONFIG_REPL_BACKLOG_MIN_SIZE), len(reply)-len(replid)-12)
+	server.freeClient(replica)
+
+	// 成为replica再切换回master后，旧的replid在切换前的offset范围内仍可部分同步
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	runQuery(t, c, fmt.Sprintf("replicaof 127.0.0.1 %d\r\nreplicaof no one\r\n", port))
+	assert.NotEqual(t, replid, server.replid)
+	assert.Equal(t, replid, server.replid2)
+	offset = server.masterReplOffset
+	assert.Equal(t, offset+1, server.secondReplidOffset)
+	runQuery(t, c, "set b 2\r\n")
+	replica = newTestClient(t, "127.0.0.1", 7302)
+	assert.Equal(t, fmt.Sprintf("+CONTINUE %s\r\n%s", server.replid, stream), psync(fmt.Sprintf("%s %d", replid, offset+1)))
+	server.freeClient(replica)
+	replica = newTestClient(t, "127.0.0.1", 7302)
+	assert.True(t, strings.HasPrefix(psync(fmt.Sprintf("%s %d", replid, offset+2)), "+FULLRESYNC"))
+	info := runQuery(t, c, "info replication\r\n")
+	assert.Contains(t, info, fmt.Sprintf("master_replid2:%s\r\n", replid))
+	assert.Contains(t, info, fmt.Sprintf("second_repl_offset:%d\r\n", offset+1))
+	assert.Contains(t, info, "repl_backlog_active:1\r\nrepl_backlog_size:16384\r\n")
+	server.freeClient(replica)
+	server.freeClient(c)
+}
+
+func TestReplicationReplicaPartialResync(t *testing.T) {
+	conf := Config{DbFilename: filepath.Join(t.TempDir(), "dump.rdb")}
+	assert.Nil(t, server.initServer(&conf))
+	c := newTestClient(t, "127.0.0.1", 7400)
+	rdb, err := server.rdbSaveToBytes()
+	assert.Nil(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+	replid, newReplid := strings.Repeat("a", CONFIG_RUN_ID_SIZE), strings.Repeat("b", CONFIG_RUN_ID_SIZE)
+	multi := "*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nset\r\n$1\r\nx\r\n$1\r\n1\r\n"
+	psyncs, conns := serveFakeMaster(ln, []string{
+		fmt.Sprintf("+FULLRESYNC %s 100\r\n$%d\r\n%s*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n%s", replid, len(rdb), rdb, multi),
+		fmt.Sprintf("+CONTINUE %s\r\n%s*1\r\n$4\r\nEXEC\r\n", newReplid, multi),
+	})
+
+	runQuery(t, c, fmt.Sprintf("replicaof 127.0.0.1 %d\r\n", port))
+	processEventsUntil(t, func() bool { return server.replState == REPL_STATE_CONNECTED })
+	<-psyncs
+	conn := <-conns
+	// 事务还没有完整收到，不计入offset
+	offset := int64(100 + len("*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n"))
+	processEventsUntil(t, func() bool { return server.master.readReploff == offset+int64(len(multi)) })
+	assert.Equal(t, offset, server.master.reploff)
+	assert.Equal(t, offset, server.masterReplOffset)
+
+	conn.Close()
+	processEventsUntil(t, func() bool { return server.master == nil })
+	assert.Equal(t, replid, server.cachedMasterReplid)
+	assert.Equal(t, offset, server.cachedMasterReploff)
+	assert.Contains(t, runQuery(t, c, "info replication\r\n"), fmt.Sprintf("slave_repl_offset:%d\r\n", offset))
+	server.replicationCron()
+	processEventsUntil(t, func() bool { return server.replState == REPL_STATE_CONNECTED })
+	assert.Equal(t, []string{"PSYNC", replid, strconv.FormatInt(offset+1, 10)}, <-psyncs)
+	conn = <-conns
+	defer conn.Close()
+
+	// master的replid改变，旧的replid保存为replid2
+	assert.Equal(t, newReplid, server.replid)
+	assert.Equal(t, replid, server.replid2)
+	assert.Equal(t, offset+1, server.secondReplidOffset)
+	assert.Equal(t, "", server.cachedMasterReplid)
+	processEventsUntil(t, func() bool { return server.master.reploff == server.master.readReploff })
+	offset += int64(len(multi) + len("*1\r\n$4\r\nEXEC\r\n"))
+	assert.Equal(t, offset, server.masterReplOffset)
+	assert.Equal(t, "$1\r\nv\r\n$1\r\n1\r\n", runQuery(t, c, "get k\r\nget x\r\n"))
+	assert.Equal(t, offset-100, server.replBacklogHistlen)
+
+	runQuery(t, c, "replicaof no one\r\n")
+	assert.Equal(t, newReplid, server.replid2)
+	server.freeClient(c)
+}
+
+func TestWait(t *testing.T) {
+	conf := Config{DbFilename: filepath.Join(t.TempDir(), "dump.rdb")}
+	assert.Nil(t, server.initServer(&conf))
+	var clients []*GodisClient
+	for i := 0; i < 2; i++ {
+		clients = append(clients, newTestClient(t, "127.0.0.1", 7500+i))
+	}
+	replica, c := clients[0], clients[1]
+	assert.Equal(t, ":0\r\n", runQuery(t, c, "wait 0 0\r\n"))
+	runQuery(t, replica, "psync ? -1\r\n")
+	// 没有写过数据时不需要等待
+	assert.Equal(t, ":1\r\n", runQuery(t, c, "wait 1 0\r\n"))
+
+	// 写命令之后等待replica确认，阻塞期间不处理之后的命令
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "set k v\r\nwait 1 0\r\nget k\r\n"))
+	assert.Equal(t, "b", getClientFlagsString(c))
+	server.beforeSleep(server.aeloop)
+	stream := "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n"
+	assert.Equal(t, stream+"*3\r\n$8\r\nREPLCONF\r\n$6\r\nGETACK\r\n$1\r\n*\r\n", takeReply(replica))
+	runQuery(t, replica, fmt.Sprintf("replconf ack %d\r\n", len(stream)-1))
+	server.beforeSleep(server.aeloop)
+	assert.Equal(t, "", takeReply(c))
+	runQuery(t, replica, fmt.Sprintf("replconf ack %d\r\n", len(stream)))
+	server.beforeSleep(server.aeloop)
+	assert.Equal(t, ":1\r\n$1\r\nv\r\n", takeReply(c))
+	assert.Equal(t, "N", getClientFlagsString(c))
+	assert.Equal(t, 0, len(server.clientsWaitingAcks))
+
+	// 超时后回复已确认的数量
+	assert.Equal(t, "", runQuery(t, c, "wait 2 10\r\n"))
+	server.beforeSleep(server.aeloop)
+	assert.Equal(t, "", takeReply(c))
+	time.Sleep(20 * time.Millisecond)
+	server.beforeSleep(server.aeloop)
+	assert.Equal(t, ":1\r\n", takeReply(c))
+
+	// 事务中不阻塞
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n+OK\r\n:0\r\n", runQuery(t, c, "multi\r\nset k v2\r\nwait 1 0\r\nexec\r\n"))
+
+	assert.Equal(t, "", runQuery(t, c, "wait 1 0\r\n"))
+	server.freeClient(c)
+	assert.Equal(t, 0, len(server.clientsWaitingAcks))
+
+	c = newTestClient(t, "127.0.0.1", 7502)
+	assert.Equal(t, "-ERR value is not an integer or out of range\r\n", runQuery(t, c, "wait x 0\r\n"))
+	assert.Equal(t, "-ERR timeout is negative\r\n", runQuery(t, c, "wait 1 -1\r\n"))
+	server.masterhost = "127.0.0.1"
+	assert.True(t, strings.HasPrefix(runQuery(t, c, "wait 1 0\r\n"), "-ERR WAIT cannot be used with replica instances."))
+	server.masterhost = ""
+	server.freeClient(replica)
+	server.freeClient(c)
+}
+
+func TestReplicationDisklessLoad(t *testing.T) {
+	conf := Config{DbFilename: filepath.Join(t.TempDir(), "dump.rdb"), ReplDisklessLoad: "swapdb"}
+	assert.Nil(t, server.initServer(&conf))
+	c := newTestClient(t, "127.0.0.1", 7600)
+	runQuery(t, c, "set k1 v1\r\n")
+	rdb, err := server.rdbSaveToBytes()
+	assert.Nil(t, err)
+	runQuery(t, c, "set old x\r\n")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+	replid, mark := strings.Repeat("a", CONFIG_RUN_ID_SIZE), strings.Repeat("m", CONFIG_RUN_ID_SIZE)
+	stream := "*3\r\n$3\r\nset\r\n$2\r\nk2\r\n$2\r\nv2\r\n"
+	bad := append([]byte{}, rdb...)
+	bad[len(bad)-1] ^= 0xff
+	psyncs, conns := serveFakeMaster(ln, []string{
+		fmt.Sprintf("+FULLRESYNC %s 0\r\n$EOF:%s\r\n%s%s", replid, mark, bad, mark),
+		fmt.Sprintf("+FULLRESYNC %s 0\r\n$EOF:%s\r\n%s%s%s", replid, mark, rdb, mark, stream),
+	})
+
+	// swapdb加载失败时保留原来的数据
+	runQuery(t, c, fmt.Sprintf("replicaof 127.0.0.1 %d\r\n", port))
+	processEventsUntil(t, func() bool { return server.replState == REPL_STATE_CONNECT })
+	<-psyncs
+	conn := <-conns
+	defer conn.Close()
+	assert.Equal(t, "$1\r\nx\r\n", runQuery(t, c, "get old\r\n"))
+
+	// EOF标记之后紧跟着复制流
+	server.replicationCron()
+	processEventsUntil(t, func() bool { return server.replState == REPL_STATE_CONNECTED })
+	<-psyncs
+	conn = <-conns
+	defer conn.Close()
+	assert.Equal(t, "$2\r\nv1\r\n$2\r\nv2\r\n$-1\r\n", runQuery(t, c, "get k1\r\nget k2\r\nget old\r\n"))
+	assert.Equal(t, int64(len(stream)), server.master.reploff)
+	_, err = os.Stat(conf.DbFilename)
+	assert.True(t, os.IsNotExist(err))
+
+	// 标记被拆在两次读取中，已经查找过的数据不再重复扫描
+	runQuery(t, c, "replicaof no one\r\n")
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	defer Close(fds[1])
+	server.masterhost, server.masterport = "127.0.0.1", port
+	server.replState = REPL_STATE_TRANSFER
+	server.masterReplidPending = replid
+	server.replTransferFd = fds[0]
+	server.replTransferSize = -1
+	server.replTransferBuf = []byte(fmt.Sprintf("$EOF:%s\r\n%s%s", mark, rdb, mark[:20]))
+	assert.False(t, server.readSyncBulkPayload(fds[0]))
+	assert.Equal(t, len(rdb)+20, server.replTransferScanned)
+	server.replTransferBuf = append(server.replTransferBuf, mark[20:]+stream...)
+	assert.False(t, server.readSyncBulkPayload(fds[0]))
+	assert.Equal(t, REPL_STATE_CONNECTED, server.replState)
+	assert.Equal(t, "$2\r\nv2\r\n", runQuery(t, c, "get k2\r\n"))
+	runQuery(t, c, "replicaof no one\r\n")
+
+	// on-empty-db只在数据库为空时不使用磁盘
+	conf.ReplDisklessLoad = "on-empty-db"
+	assert.Nil(t, server.initServer(&conf))
+	assert.Nil(t, server.replicationLoadPayload(rdb))
+	_, err = os.Stat(conf.DbFilename)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, server.replicationLoadPayload(rdb))
+	_, err = os.Stat(conf.DbFilename)
+	assert.Nil(t, err)
+	assert.NotNil(t, server.replicationLoadPayload(bad))
+	assert.Equal(t, int64(0), server.db.data.Size())
+
+	conf.ReplDisklessLoad = "always"
+	assert.Equal(t, `repl-diskless-load must be disabled, on-empty-db or swapdb, got "always"`, server.initServer(&conf).Error())
+	server.freeClient(c)
+}
+
+func TestReplicaReadOnly(t *testing.T) {
+	conf := Config{DbFilename: filepath.Join(t.TempDir(), "dump.rdb")}
+	assert.Nil(t, server.initServer(&conf))
+	c := newTestClient(t, "127.0.0.1", 7700)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	runQuery(t, c, "set k v\r\nmulti\r\nset k v2\r\n")
+	admin := newTestClient(t, "127.0.0.1", 7701)
+	runQuery(t, admin, fmt.Sprintf("replicaof 127.0.0.1 %d\r\n", port))
+	server.freeClient(admin)
+	// 成为replica之前排队的写命令在EXEC时拒绝
+	assert.Equal(t, "-EXECABORT Transaction discarded because of: READONLY You can't write against a read only replica.\r\n", runQuery(t, c, "exec\r\n"))
+	assert.Equal(t, "-READONLY You can't write against a read only replica.\r\n", runQuery(t, c, "set k v2\r\n"))
+	assert.Equal(t, "+OK\r\n+QUEUED\r\n-READONLY You can't write against a read only replica.\r\n-EXECABORT Transaction discarded because of previous errors.\r\n",
+		runQuery(t, c, "multi\r\nget k\r\nlpush l a\r\nexec\r\n"))
+	// 默认与master断开时也可以读
+	assert.Equal(t, "$1\r\nv\r\n", runQuery(t, c, "get k\r\n"))
+	assert.Contains(t, runQuery(t, c, "info replication\r\n"), "slave_read_only:1\r\n")
+	runQuery(t, c, "replicaof no one\r\n")
+
+	conf.ReplicaReadOnly = "no"
+	conf.ReplicaServeStaleData = "no"
+	assert.Nil(t, server.initServer(&conf))
+	c = newTestClient(t, "127.0.0.1", 7700)
+	runQuery(t, c, fmt.Sprintf("replicaof 127.0.0.1 %d\r\n", port))
+	masterdown := "-MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.\r\n"
+	assert.Equal(t, masterdown, runQuery(t, c, "get k\r\n"))
+	assert.Equal(t, masterdown, runQuery(t, c, "ping\r\n"))
+	assert.Contains(t, runQuery(t, c, "info replication\r\n"), "slave_read_only:0\r\n")
+	// 连接上master之后可以写
+	server.replState = REPL_STATE_CONNECTED
+	assert.Equal(t, "+OK\r\n$1\r\nv\r\n", runQuery(t, c, "set k v\r\nget k\r\n"))
+	server.replState = REPL_STATE_CONNECT
+	runQuery(t, c, "replicaof no one\r\n")
+
+	conf.ReplDisklessSync = "maybe"
+	assert.Equal(t, `repl-diskless-sync must be yes or no, got "maybe"`, server.initServer(&conf).Error())
+	server.freeClient(c)
+}
+
+func TestReplicationExpire(t *testing.T) {
+	conf := Config{DbFilename: filepath.Join(t.TempDir(), "dump.rdb")}
+	assert.Nil(t, server.initServer(&conf))
+	var clients []*GodisClient
+	for i := 0; i < 3; i++ {
+		clients = append(clients, newTestClient(t, "127.0.0.1", 7800+i))
+	}
+	replica, c, mon := clients[0], clients[1], clients[2]
+	runQuery(t, replica, "psync ? -1\r\n")
+	runQuery(t, mon, "monitor\r\n")
+
+	// EXPIRE以绝对时间传播，MONITOR中仍是原来的命令
+	runQuery(t, c, "set k v\r\n")
+	takeReply(replica)
+	now := GetMsTime()
+	assert.Equal(t, ":1\r\n", runQuery(t, c, "expire k 100\r\n"))
+	stream := takeReply(replica)
+	assert.Regexp(t, `^\*3\r\n\$9\r\nPEXPIREAT\r\n\$1\r\nk\r\n\$13\r\n\d{13}\r\n$`, stream)
+	when, err := strconv.ParseInt(stream[len(stream)-15:len(stream)-2], 10, 64)
+	assert.Nil(t, err)
+	assert.True(t, when >= now+100000 && when <= GetMsTime()+100000)
+	assert.Equal(t, when, server.db.expire.Get(CreateObject(GSTR, "k")).IntVal())
+	assert.True(t, strings.HasSuffix(takeReply(mon), `"expire" "k" "100"`+"\r\n"))
+	assert.Equal(t, ":1\r\n", runQuery(t, c, fmt.Sprintf("pexpireat k %d\r\n", when+1)))
+	assert.Equal(t, when+1, server.db.expire.Get(CreateObject(GSTR, "k")).IntVal())
+	assert.Equal(t, "-ERR value is not an integer or out of range\r\n", runQuery(t, c, "expire k x\r\n"))
+	takeReply(replica)
+
+	// 被动与主动删除过期的key时传播DEL
+	del := "*2\r\n$3\r\nDEL\r\n$1\r\nk\r\n"
+	server.db.expire.Set(CreateObject(GSTR, "k"), CreateFromInt(GetMsTime()-1))
+	assert.Equal(t, "$-1\r\n", runQuery(t, c, "get k\r\n"))
+	assert.Equal(t, del, takeReply(replica))
+	runQuery(t, c, "set k v\r\n")
+	takeReply(replica)
+	server.db.expire.Set(CreateObject(GSTR, "k"), CreateFromInt(GetMsTime()-1))
+	server.ServerCron(server.aeloop, 0, nil)
+	assert.True(t, strings.HasSuffix(takeReply(replica), del)) //第一次ServerCron会PING replica
+	server.freeClient(mon)
+	server.freeClient(replica)
+
+	// replica上过期的key只是读不到，等待master传播的DEL
+	runQuery(t, c, "set k v\r\n")
+	server.db.expire.Set(CreateObject(GSTR, "k"), CreateFromInt(GetMsTime()-1))
+	server.masterhost = "127.0.0.1"
+	assert.Equal(t, "$-1\r\n", runQuery(t, c, "get k\r\n"))
+	server.ServerCron(server.aeloop, 0, nil)
+	assert.NotNil(t, server.db.data.Get(CreateObject(GSTR, "k")))
+	c.flags |= CLIENT_MASTER
+	runQuery(t, c, "del k\r\n")
+	c.flags &= ^CLIENT_MASTER
+	assert.Nil(t, server.db.data.Get(CreateObject(GSTR, "k")))
+	assert.Nil(t, server.db.expire.Get(CreateObject(GSTR, "k")))
+	server.masterhost = ""
+	server.freeClient(c)
+}
+
+func TestReplicationConnect(t *testing.T) {
+	conf := Config{DbFilename: filepath.Join(t.TempDir(), "dump.rdb")}
+	assert.Nil(t, server.initServer(&conf))
+	c := newTestClient(t, "127.0.0.1", 7900)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	// REPLICAOF不等待连接建立
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, fmt.Sprintf("replicaof 127.0.0.1 %d\r\n", port)))
+	assert.Equal(t, REPL_STATE_CONNECTING, server.replState)
+	fd := server.replTransferFd
+	assert.NotEqual(t, -1, fd)
+	// 连接超时后放弃，重新发起连接
+	server.replTransferLastio -= REPL_TIMEOUT + 1
+	server.replicationCron()
+	assert.Equal(t, REPL_STATE_CONNECTING, server.replState)
+	assert.GreaterOrEqual(t, server.replTransferLastio, time.Now().Unix()-1)
+	// 连接被拒绝
+	processEventsUntil(t, func() bool { return server.replState == REPL_STATE_CONNECT })
+	assert.Equal(t, -1, server.replTransferFd)
+
+	runQuery(t, c, "replicaof no one\r\n")
+	server.freeClient(c)
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"container/list"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"hash/fnv"
 	"log"
+	"net"
+	"os"
 	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 type CmdType = byte
@@ -21,33 +28,285 @@ const (
 	GODIS_IO_BUF     int = 1024 * 16
 	GODIS_MAX_BULK   int = 1024 * 4
 	GODIS_MAX_INLINE int = 1024 * 4
+
+	GODIS_REPLY_CHUNK_BYTES  int = 1024 * 16 //小于该长度的回复拷贝到client.buf合并发送
+	NET_MAX_WRITES_PER_EVENT int = 1024 * 64
+	IOV_MAX                  int = 1024
+)
+
+const (
+	CLIENT_SLAVE      int = 1 << 0 //replica连接
+	CLIENT_PUBSUB     int = 1 << 1 //处于订阅模式
+	CLIENT_CLOSE_ASAP int = 1 << 2 //在beforeSleep中异步关闭
+	CLIENT_BLOCKED    int = 1 << 3 //阻塞等待中，不受timeout限制
+
+	CLIENT_CLOSE_AFTER_REPLY int = 1 << 4 //回复发送完后关闭
+	CLIENT_REPLY_OFF         int = 1 << 5 //CLIENT REPLY OFF
+	CLIENT_REPLY_SKIP_NEXT   int = 1 << 6 //CLIENT REPLY SKIP，跳过下一条命令的回复
+	CLIENT_REPLY_SKIP        int = 1 << 7 //当前命令不回复
+	CLIENT_NO_EVICT          int = 1 << 8
+	CLIENT_MULTI             int = 1 << 9  //处于MULTI中，命令排队
+	CLIENT_DIRTY_EXEC        int = 1 << 10 //排队时有命令出错，EXEC会失败
+	CLIENT_DIRTY_CAS         int = 1 << 11 //WATCH的key被修改，EXEC会失败
+	CLIENT_PUSHING           int = 1 << 12 //正在推送订阅消息，不受CLIENT REPLY影响
+
+	CLIENT_TRACKING              int = 1 << 13 //CLIENT TRACKING ON
+	CLIENT_TRACKING_BROKEN_REDIR int = 1 << 14 //REDIRECT的客户端已经断开
+	CLIENT_TRACKING_BCAST        int = 1 << 15
+	CLIENT_TRACKING_OPTIN        int = 1 << 16
+	CLIENT_TRACKING_OPTOUT       int = 1 << 17
+	CLIENT_TRACKING_CACHING      int = 1 << 18 //CLIENT CACHING yes/no，只对下一条命令生效
+	CLIENT_TRACKING_NOLOOP       int = 1 << 19 //不通知自己修改的key
+	CLIENT_MONITOR               int = 1 << 20 //MONITOR，接收所有执行的命令
+	CLIENT_MASTER                int = 1 << 21 //replica到master的连接，命令不回复
+	CLIENT_MASTER_FORCE_REPLY    int = 1 << 22 //向master发送REPLCONF ACK
+)
+
+// 阻塞的原因
+const (
+	BLOCKED_NONE     int = 0
+	BLOCKED_POSTPONE int = 1 //CLIENT PAUSE期间推迟执行命令
+	BLOCKED_WAIT     int = 2 //WAIT等待replica确认offset
+)
+
+// CLIENT PAUSE 的类型
+const (
+	PAUSE_NONE  int = 0
+	PAUSE_WRITE int = 1
+	PAUSE_ALL   int = 2
+)
+
+// 命令的属性，在命令表中以sflags字符串声明
+const (
+	CMD_WRITE    int = 1 << 0
+	CMD_READONLY int = 1 << 1
+	CMD_NO_AUTH  int = 1 << 2 //未认证的客户端也可以执行
+	CMD_DENYOOM  int = 1 << 3 //可能增加内存占用，目前没有maxmemory，只作为COMMAND INFO的元数据
+	CMD_FAST     int = 1 << 4 //O(1)或O(log(N))，不会阻塞
+	CMD_ADMIN    int = 1 << 5
+	CMD_PUBSUB   int = 1 << 6
+	CMD_NOSCRIPT int = 1 << 7
+	CMD_LOADING  int = 1 << 8 //加载数据时允许执行
+	CMD_STALE    int = 1 << 9 //replica与master断开时允许执行
+)
+
+var commandFlagNames = []struct {
+	name string
+	flag int
+}{
+	{"write", CMD_WRITE},
+	{"readonly", CMD_READONLY},
+	{"denyoom", CMD_DENYOOM},
+	{"admin", CMD_ADMIN},
+	{"pubsub", CMD_PUBSUB},
+	{"noscript", CMD_NOSCRIPT},
+	{"loading", CMD_LOADING},
+	{"stale", CMD_STALE},
+	{"fast", CMD_FAST},
+	{"no_auth", CMD_NO_AUTH},
+}
+
+// 输出缓冲区限制按客户端类型区分
+const (
+	CLIENT_TYPE_NORMAL int = 0
+	CLIENT_TYPE_SLAVE  int = 1
+	CLIENT_TYPE_PUBSUB int = 2
+	CLIENT_TYPE_COUNT  int = 3
 )
 
+const DEFAULT_CLIENT_OUTPUT_BUFFER_LIMIT string = "normal 0 0 0 replica 256mb 64mb 60 pubsub 32mb 8mb 60"
+
+type ClientBufferLimit struct {
+	hardLimitBytes   int64
+	softLimitBytes   int64
+	softLimitSeconds int64
+}
+
 type GodisDB struct {
-	data   *Dict
-	expire *Dict
+	data        *Dict
+	expire      *Dict
+	watchedKeys map[string]*list.List //key -> WATCH该key的客户端。Dict与List只能保存*GObj，所以使用map与container/list
 }
 
 type GodisClient struct {
+	id       int64 //自增的唯一id
+	name     string
 	fd       int
+	laddr    string   //formatted local address
+	ip       string   //peer ip, empty for unix socket clients
+	port     int      //peer port
+	addr     string   //formatted peer address ip:port
+	tls      *TlsConn //nil for plaintext connections
 	db       *GodisDB
 	args     []*GObj
+	origArgs []*GObj //rewriteClientCommandVector之前的参数，call结束时恢复
 	reply    *List
-	sentLen  int
+	sentLen  int    //reply链表头节点已发送的字节数
+	buf      []byte //合并后的小回复，逻辑上位于reply链表之后
+	bufSent  int
 	queryBuf []byte //以byte存储读取到的命令
 	queryLen int    //读到命令长度
 	cmdTy    CmdType
 	bulkNum  int //有几个bulk
 	bulkLen  int //单个bulk有几个byte
+	flags    int
+	node     *list.Element //在server.clientList中的位置
+
+	user          *AclUser //nil表示不受ACL限制
+	authenticated bool
+	resp          int //协议版本，2或3
+
+	ctime                    int64 //连接建立的时间(秒)
+	lastinteraction          int64 //最近一次读写的时间(秒)，用于timeout
+	lastcmd                  *GodisCommand
+	mstate                   multiState //MULTI之后排队的命令
+	btype                    int        //阻塞的原因
+	replyBytes               int64      //reply链表中还未发送的字节数
+	obufSoftLimitReachedTime int64      //首次超过soft limit的时间(秒)，0表示未超过
+
+	watchedKeys []watchedKey //EXEC、DISCARD、UNWATCH时释放
+
+	pubsubChannels      map[string]*list.Element //channel -> 在server.pubsubChannels链表中的位置
+	pubsubPatterns      []string
+	pubsubShardChannels map[string]*list.Element
+
+	trackingRedirect int64 //接收失效通知的客户端id，0表示自己
+	trackingPrefixes []string
+
+	slaveListeningPort int    //replica: REPLCONF listening-port
+	slaveCapa          int    //replica: REPLCONF capa声明的能力
+	replAckOff         int64  //replica: 最近一次REPLCONF ACK报告的offset
+	replAckTime        int64  //replica: 最近一次REPLCONF ACK的时间(秒)
+	reploff            int64  //master: 已经执行的复制流offset
+	readReploff        int64  //master: 已经读取的复制流offset
+	pendingStream      []byte //master: 已读取但还未转发给下级replica的复制流
+
+	woff            int64 //最近一次写命令之后的复制offset，WAIT等待replica确认该offset
+	bpopTimeout     int64 //WAIT阻塞的截止时间(ms)，0表示一直等待
+	bpopNumReplicas int
+	bpopReploffset  int64
 }
 
 type GodisServer struct {
-	fd      int
-	port    int
-	db      *GodisDB
-	cmd     []GodisCommand
-	clients map[int]*GodisClient
-	aeloop  *AeLoop
+	ipfd       []int //one listening fd per bind address
+	bindaddr   []string
+	port       int
+	sofd       int //unix socket fd, -1 if disabled
+	unixsocket string
+	sigCh      chan os.Signal
+	tlsfd      []int //tls listening fds, empty if tls-port is 0
+	tlsConfig  *tls.Config
+	tlsDone    chan *tlsHandshake
+	tlsWakeFds [2]int //pipe waking the ae loop when a handshake finishes
+	tlsPending int    //handshakes in flight, counted against maxclients
+
+	tcpkeepalive int //seconds, 0 disables SO_KEEPALIVE
+	db           *GodisDB
+	commands     map[string]*GodisCommand //由cmdTable生成，已应用rename-command
+	// rename-command之后的名字 -> cmdTable中的名字，用于查找文档
+	commandOrigNames map[string]string
+
+	// 需要特殊处理的命令，rename-command之后依然有效
+	execCmd      *GodisCommand
+	multiCmd     *GodisCommand
+	discardCmd   *GodisCommand
+	quitCmd      *GodisCommand
+	watchCmd     *GodisCommand
+	clientCmd    *GodisCommand
+	pingCmd      *GodisCommand
+	clients      map[int]*GodisClient
+	clientList   *list.List //按连接顺序排列的客户端，clientsCron轮转遍历。List只能保存*GObj，所以使用container/list
+	aeloop       *AeLoop
+	maxidletime  int64 //timeout配置，秒，0表示不限制
+	maxclients   int
+	nextClientId int64
+	clientsByID  map[int64]*GodisClient
+
+	protectedMode        bool
+	notifyKeyspaceEvents int //NOTIFY_*的组合
+
+	trackingTable        map[string]map[int64]bool //key -> 读过该key的客户端id
+	trackingPrefixes     map[string]*bcastState    //BCAST模式的prefix
+	trackingClients      int
+	trackingTableMaxKeys int //0表示不限制
+
+	monitors []*GodisClient
+
+	replid           string //当前复制历史的id
+	masterReplOffset int64
+	slaves           []*GodisClient
+	inExec           bool //正在执行EXEC，写命令以MULTI/EXEC包裹传播
+	multiPropagated  bool
+	// replica与master的连接
+	masterhost          string //为空表示不是replica
+	masterport          int
+	master              *GodisClient
+	replState           int
+	replTransferFd      int //握手与接收RDB期间使用的连接，-1表示没有
+	replTransferBuf     []byte
+	replTransferSize    int64  //RDB的长度，-1表示还未读到
+	replTransferEofMark string //diskless同步时RDB结尾的标记，为空表示按长度读取
+	replTransferScanned int    //已经查找过标记的字节数，只在新收到的数据中查找
+	replTransferLastio  int64
+	replDownSince       int64
+	masterReplidPending string //FULLRESYNC回复中的replid，RDB加载完成后生效
+	masterInitialOffset int64
+	cronloops           int64
+
+	// PSYNC2: replid2在secondReplidOffset之前与replid的历史相同
+	replid2            string
+	secondReplidOffset int64
+	replBacklog        []byte //环形缓冲，nil表示没有backlog
+	replBacklogSize    int64
+	replBacklogIdx     int64 //下一个字节写入的位置
+	replBacklogHistlen int64 //backlog中有效数据的长度
+	replBacklogOff     int64 //backlog中第一个字节的offset
+	// 与master断开后保留的复制历史，重连时用于部分同步
+	cachedMasterReplid  string //为空表示没有
+	cachedMasterReploff int64
+
+	clientsWaitingAcks []*GodisClient //阻塞在WAIT的客户端
+	getAckFromSlaves   bool           //在beforeSleep中向replica发送GETACK
+
+	replicaReadOnly       bool
+	replicaServeStaleData bool //与master断开时是否执行普通命令
+	replDisklessSync      bool //master不写磁盘，直接把RDB发给replica
+	replDisklessLoad      int
+	dbfilename            string
+	loading               bool //正在加载RDB，只能执行带loading标记的命令
+
+	// 订阅者是*GodisClient，Dict与List只能保存*GObj，所以使用map与container/list
+	pubsubChannels      map[string]*list.List                //channel -> 订阅的客户端
+	pubsubPatterns      *list.List                           //*pubsubPattern
+	pubsubShardChannels [CLUSTER_SLOTS]map[string]*list.List //按hash slot分桶的sharded channel
+	// 订阅相关的命令，用于订阅模式的限制与channel的ACL检查
+	subscribeCmd    *GodisCommand
+	unsubscribeCmd  *GodisCommand
+	psubscribeCmd   *GodisCommand
+	punsubscribeCmd *GodisCommand
+	publishCmd      *GodisCommand
+	ssubscribeCmd   *GodisCommand
+	sunsubscribeCmd *GodisCommand
+	spublishCmd     *GodisCommand
+
+	users         map[string]*AclUser
+	defaultUser   *AclUser
+	aclfile       string
+	aclLog        []*AclLogEntry //最新的记录在前
+	aclLogMaxLen  int
+	aclLogEntryId int64
+
+	pauseType     int
+	pauseEndTime  int64 //ms
+	pausedClients []*GodisClient
+
+	clientObufLimits [CLIENT_TYPE_COUNT]ClientBufferLimit
+	clientsToClose   []*GodisClient
+
+	stat_starttime                          int64
+	stat_client_outbuf_limit_disconnections int64
+	stat_net_write_syscalls                 int64
+	stat_rejected_conn                      int64
 
 	child_pid           int
 	dirty               int64
@@ -59,42 +318,327 @@ type GodisServer struct {
 type CommandProc func(c *GodisClient)
 
 type GodisCommand struct {
-	name  string
-	proc  CommandProc
-	arity int //args length
+	name     string
+	proc     CommandProc
+	arity    int    //参数个数(包括命令名)，负数表示至少-arity个
+	sflags   string //以空格分隔的flag与ACL类别(@开头)
+	firstKey int    //第一个key参数的下标，0表示没有key
+	lastKey  int    //最后一个key参数的下标，负数表示从末尾倒数
+	keyStep  int
+
+	subcommands []GodisCommand //由父命令的proc处理，只用于COMMAND与ACL
+
+	// 由sflags解析得到
+	flags         int
+	aclCategories uint64
 }
 
-func (server *GodisServer) expireIfNeeded(key *GObj) {
-	entry := server.db.expire.Find(key)
-	if entry == nil {
-		return
+// expireIfNeeded 返回key是否已过期，CLIENT PAUSE WRITE期间过期的key不删除，
+// replica上过期的key由master传播的DEL删除，保证与master的数据一致
+func (server *GodisServer) expireIfNeeded(key *GObj) bool {
+	if !server.keyIsExpired(key) {
+		return false
 	}
-	when := entry.Val.IntVal()
-	if when > GetMsTime() {
-		return //没到时间
+	if server.pauseType != PAUSE_NONE || server.masterhost != "" {
+		return true
 	}
-	server.db.expire.Delete(key)
+	server.deleteExpiredKey(key)
+	return true
+}
+
+func (server *GodisServer) keyIsExpired(key *GObj) bool {
+	entry := server.db.expire.Find(key)
+	return entry != nil && entry.Val.IntVal() <= GetMsTime()
+}
+
+// deleteExpiredKey 主动或被动删除过期的key，并向replica传播DEL
+func (server *GodisServer) deleteExpiredKey(key *GObj) {
+	server.notifyKeyspaceEvent(NOTIFY_EXPIRED, "expired", key.StrVal(), 0)
+	server.signalModifiedKey(nil, server.db, key.StrVal())
+	del := []*GObj{CreateObject(GSTR, "DEL"), CreateObject(GSTR, key.StrVal())}
 	server.db.data.Delete(key)
+	server.db.expire.Delete(key)
+	server.propagate(del)
+	for _, arg := range del {
+		arg.DecrRefCount()
+	}
+}
+
+// signalModifiedKey key被修改时调用，WATCH该key的事务会失败，缓存了该key的客户端会收到失效通知
+// c为修改key的客户端，过期删除时为nil
+func (server *GodisServer) signalModifiedKey(c *GodisClient, db *GodisDB, key string) {
+	touchWatchedKey(db, key)
+	server.trackingInvalidateKey(c, key, true)
 }
 
 func (server *GodisServer) findKeyRead(key *GObj) *GObj {
-	server.expireIfNeeded(key)
-	return server.db.data.Get(key)
+	var val *GObj
+	if !server.expireIfNeeded(key) {
+		val = server.db.data.Get(key)
+	}
+	if val == nil {
+		server.notifyKeyspaceEvent(NOTIFY_KEY_MISS, "keymiss", key.StrVal(), 0)
+	}
+	return val
 }
 
 func (server *GodisServer) lookupCommand(cmdStr string) *GodisCommand {
-	for _, c := range server.cmd {
-		if c.name == cmdStr {
-			return &c
+	return server.commands[strings.ToLower(cmdStr)]
+}
+
+// parseCommandFlags 解析sflags，并像redis一样根据flag补充隐含的ACL类别
+func (cmd *GodisCommand) parseCommandFlags() error {
+	cmd.flags = 0
+	cmd.aclCategories = 0
+	for _, f := range strings.Fields(cmd.sflags) {
+		if strings.HasPrefix(f, "@") {
+			cat, ok := aclGetCategoryByName(f[1:])
+			if !ok {
+				return fmt.Errorf("unknown acl category %q in command %v", f, cmd.name)
+			}
+			cmd.aclCategories |= cat
+			continue
+		}
+		found := false
+		for _, fn := range commandFlagNames {
+			if fn.name == f {
+				cmd.flags |= fn.flag
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown flag %q in command %v", f, cmd.name)
+		}
+	}
+	if cmd.flags&CMD_WRITE != 0 {
+		cmd.aclCategories |= ACL_CATEGORY_WRITE
+	}
+	if cmd.flags&CMD_READONLY != 0 {
+		cmd.aclCategories |= ACL_CATEGORY_READ
+	}
+	if cmd.flags&CMD_ADMIN != 0 {
+		cmd.aclCategories |= ACL_CATEGORY_ADMIN | ACL_CATEGORY_DANGEROUS
+	}
+	if cmd.flags&CMD_PUBSUB != 0 {
+		cmd.aclCategories |= ACL_CATEGORY_PUBSUB
+	}
+	if cmd.flags&CMD_FAST != 0 {
+		cmd.aclCategories |= ACL_CATEGORY_FAST
+	} else {
+		cmd.aclCategories |= ACL_CATEGORY_SLOW
+	}
+	return nil
+}
+
+// populateCommandTable 由cmdTable生成命令字典，rename-command中新名字为空时禁用该命令
+func (server *GodisServer) populateCommandTable(renames map[string]string) error {
+	server.commands = make(map[string]*GodisCommand, len(cmdTable))
+	server.commandOrigNames = make(map[string]string)
+	for i := range cmdTable {
+		cmd := cmdTable[i] //拷贝一份，rename不影响cmdTable
+		if err := cmd.parseCommandFlags(); err != nil {
+			return err
+		}
+		subs := make([]GodisCommand, len(cmd.subcommands))
+		for j, sub := range cmd.subcommands {
+			sub.name = cmd.name + "|" + sub.name
+			if err := sub.parseCommandFlags(); err != nil {
+				return err
+			}
+			subs[j] = sub
+		}
+		cmd.subcommands = subs
+		server.commands[cmd.name] = &cmd
+	}
+	server.execCmd = server.commands["exec"]
+	server.multiCmd = server.commands["multi"]
+	server.discardCmd = server.commands["discard"]
+	server.quitCmd = server.commands["quit"]
+	server.watchCmd = server.commands["watch"]
+	server.clientCmd = server.commands["client"]
+	server.pingCmd = server.commands["ping"]
+	server.subscribeCmd = server.commands["subscribe"]
+	server.unsubscribeCmd = server.commands["unsubscribe"]
+	server.psubscribeCmd = server.commands["psubscribe"]
+	server.punsubscribeCmd = server.commands["punsubscribe"]
+	server.publishCmd = server.commands["publish"]
+	server.ssubscribeCmd = server.commands["ssubscribe"]
+	server.sunsubscribeCmd = server.commands["sunsubscribe"]
+	server.spublishCmd = server.commands["spublish"]
+	if len(renames) == 0 {
+		return nil
+	}
+	renamed := make(map[string]*GodisCommand)
+	for old, name := range renames {
+		old, name = strings.ToLower(old), strings.ToLower(name)
+		cmd := server.commands[old]
+		if cmd == nil {
+			return fmt.Errorf("rename-command: no such command %q", old)
+		}
+		delete(server.commands, old)
+		if name == "" {
+			log.Printf("command %v disabled by rename-command\n", old)
+			continue
+		}
+		if renamed[name] != nil {
+			return fmt.Errorf("rename-command: duplicate command name %q", name)
+		}
+		cmd.name = name
+		// 子命令的全名跟随父命令改名
+		for j := range cmd.subcommands {
+			_, sub, _ := strings.Cut(cmd.subcommands[j].name, "|")
+			cmd.subcommands[j].name = name + "|" + sub
+		}
+		server.commandOrigNames[name] = old
+		renamed[name] = cmd
+	}
+	for name, cmd := range renamed {
+		if server.commands[name] != nil {
+			return fmt.Errorf("rename-command: duplicate command name %q", name)
+		}
+		server.commands[name] = cmd
+	}
+	return nil
+}
+
+// lookupSubcommand 子命令的名字为 parent|sub
+func (cmd *GodisCommand) lookupSubcommand(sub string) *GodisCommand {
+	for i := range cmd.subcommands {
+		if _, name, _ := strings.Cut(cmd.subcommands[i].name, "|"); name == strings.ToLower(sub) {
+			return &cmd.subcommands[i]
 		}
 	}
 	return nil
 }
 
+// checkArity arity为负数时表示参数个数至少为-arity
+func (cmd *GodisCommand) checkArity(argc int) bool {
+	return (cmd.arity > 0 && cmd.arity == argc) || (cmd.arity < 0 && argc >= -cmd.arity)
+}
+
 func (server *GodisServer) AddReply(c *GodisClient, o *GObj) {
-	c.reply.Append(o)
-	o.IncrRefCount()
+	if c.flags&(CLIENT_CLOSE_ASAP|CLIENT_CLOSE_AFTER_REPLY) != 0 {
+		return //即将关闭的客户端不再缓存回复
+	}
+	if c.flags&(CLIENT_REPLY_OFF|CLIENT_REPLY_SKIP) != 0 && c.flags&CLIENT_PUSHING == 0 {
+		return
+	}
+	if c.flags&CLIENT_MASTER != 0 && c.flags&CLIENT_MASTER_FORCE_REPLY == 0 {
+		return //master不需要命令的回复
+	}
+	str := o.StrVal()
+	if len(c.buf)+len(str) > GODIS_REPLY_CHUNK_BYTES {
+		flushReplyBuf(c)
+	}
+	if len(str) < GODIS_REPLY_CHUNK_BYTES {
+		c.buf = append(c.buf, str...) //小的回复合并发送
+	} else {
+		c.reply.Append(o)
+		o.IncrRefCount()
+	}
+	c.replyBytes += int64(len(str))
 	server.aeloop.AddFileEvent(c.fd, AE_WRITABLE, server.SendReplyToClient, c)
+	server.closeClientOnOutputBufferLimitReached(c)
+}
+
+// flushReplyBuf 把client.buf中未发送的部分移到reply链表尾部
+func flushReplyBuf(c *GodisClient) {
+	if c.bufSent < len(c.buf) {
+		c.reply.Append(CreateObject(GSTR, string(c.buf[c.bufSent:])))
+	}
+	c.buf = c.buf[:0]
+	c.bufSent = 0
+}
+
+func getClientType(c *GodisClient) int {
+	if c.flags&CLIENT_SLAVE != 0 {
+		return CLIENT_TYPE_SLAVE
+	}
+	if c.flags&CLIENT_PUBSUB != 0 {
+		return CLIENT_TYPE_PUBSUB
+	}
+	return CLIENT_TYPE_NORMAL
+}
+
+func getClientTypeByName(name string) int {
+	switch strings.ToLower(name) {
+	case "normal":
+		return CLIENT_TYPE_NORMAL
+	case "replica", "slave":
+		return CLIENT_TYPE_SLAVE
+	case "pubsub":
+		return CLIENT_TYPE_PUBSUB
+	}
+	return -1
+}
+
+// checkClientOutputBufferLimits 超过hard limit，或持续超过soft limit达到设定时间时返回true
+func (server *GodisServer) checkClientOutputBufferLimits(c *GodisClient) bool {
+	limit := server.clientObufLimits[getClientType(c)]
+	used := c.replyBytes
+	hard := limit.hardLimitBytes != 0 && used >= limit.hardLimitBytes
+	soft := limit.softLimitBytes != 0 && used >= limit.softLimitBytes
+	if soft {
+		now := time.Now().Unix()
+		if c.obufSoftLimitReachedTime == 0 {
+			c.obufSoftLimitReachedTime = now
+			soft = false
+		} else if now-c.obufSoftLimitReachedTime <= limit.softLimitSeconds {
+			soft = false
+		}
+	} else {
+		c.obufSoftLimitReachedTime = 0
+	}
+	return hard || soft
+}
+
+func (server *GodisServer) closeClientOnOutputBufferLimitReached(c *GodisClient) {
+	if c.flags&CLIENT_CLOSE_ASAP != 0 || !server.checkClientOutputBufferLimits(c) {
+		return
+	}
+	log.Printf("client %v scheduled to be closed for reaching output buffer limits, omem: %v\n", c.addr, c.replyBytes)
+	server.stat_client_outbuf_limit_disconnections++
+	server.freeClientAsync(c)
+}
+
+// freeClientAsync 在命令执行过程中不能直接释放客户端，先标记，在beforeSleep中释放
+func (server *GodisServer) freeClientAsync(c *GodisClient) {
+	if c.flags&CLIENT_CLOSE_ASAP != 0 {
+		return
+	}
+	c.flags |= CLIENT_CLOSE_ASAP
+	server.clientsToClose = append(server.clientsToClose, c)
+}
+
+// closeClientAfterReply 发送完已有的回复后关闭客户端
+func (server *GodisServer) closeClientAfterReply(c *GodisClient) {
+	c.flags |= CLIENT_CLOSE_AFTER_REPLY
+	if !c.hasPendingReplies() {
+		server.freeClientAsync(c)
+	}
+}
+
+func (server *GodisServer) freeClientsInAsyncFreeQueue() {
+	for len(server.clientsToClose) > 0 {
+		c := server.clientsToClose[0]
+		server.clientsToClose = server.clientsToClose[1:]
+		c.flags &= ^CLIENT_CLOSE_ASAP
+		server.freeClient(c)
+	}
+	server.clientsToClose = nil
+}
+
+func (server *GodisServer) beforeSleep(loop *AeLoop) {
+	// 有客户端开始WAIT时请求replica尽快报告offset
+	if server.getAckFromSlaves {
+		server.replicationRequestAckFromSlaves()
+		server.getAckFromSlaves = false
+	}
+	if len(server.clientsWaitingAcks) > 0 {
+		server.processClientsWaitingReplicas()
+	}
+	server.trackingBroadcastInvalidationMessages()
+	server.freeClientsInAsyncFreeQueue()
 }
 
 func (server *GodisServer) AddReplyStr(c *GodisClient, str string) {
@@ -103,9 +647,29 @@ func (server *GodisServer) AddReplyStr(c *GodisClient, str string) {
 	o.DecrRefCount()
 }
 
+func (server *GodisServer) AddReplyBulk(c *GodisClient, str string) {
+	server.AddReplyStr(c, bulkString(str))
+}
+
+func bulkString(str string) string {
+	return fmt.Sprintf("$%d\r\n%v\r\n", len(str), str)
+}
+
+func addReplyBulkArray(strs []string) string {
+	var reply strings.Builder
+	reply.WriteString(fmt.Sprintf("*%d\r\n", len(strs)))
+	for _, s := range strs {
+		reply.WriteString(bulkString(s))
+	}
+	return reply.String()
+}
+
 func freeArgs(client *GodisClient) {
-	for _, v := range client.args {
-		v.DecrRefCount()
+	for i, v := range client.args {
+		if v != nil { //bulk命令可能只解析了一部分参数
+			v.DecrRefCount()
+			client.args[i] = nil //避免freeClient时重复释放
+		}
 	}
 }
 
@@ -115,22 +679,68 @@ func freeReplyList(client *GodisClient) {
 		client.reply.DelNode(n)
 		n.val.DecrRefCount()
 	}
+	client.buf = nil
+	client.bufSent = 0
+	client.sentLen = 0
+	client.replyBytes = 0
 }
 
 func (server *GodisServer) freeClient(client *GodisClient) {
+	if client.flags&CLIENT_CLOSE_ASAP != 0 {
+		for i, c := range server.clientsToClose {
+			if c == client {
+				server.clientsToClose = append(server.clientsToClose[:i], server.clientsToClose[i+1:]...)
+				break
+			}
+		}
+	}
+	if client.btype == BLOCKED_POSTPONE {
+		for i, c := range server.pausedClients {
+			if c == client {
+				server.pausedClients = append(server.pausedClients[:i], server.pausedClients[i+1:]...)
+				break
+			}
+		}
+	}
+	if client.btype == BLOCKED_WAIT {
+		server.removeClientWaitingAcks(client)
+	}
 	freeArgs(client)
+	freeClientMultiState(client)
+	server.unwatchAllKeys(client)
+	server.freeClientPubsubState(client)
+	server.disableTracking(client)
+	if client.flags&CLIENT_MONITOR != 0 {
+		server.removeMonitor(client)
+	}
+	if client.flags&CLIENT_SLAVE != 0 {
+		server.removeSlave(client)
+	}
+	if client == server.master {
+		server.replicationHandleMasterDisconnection()
+	}
 	delete(server.clients, client.fd)
+	delete(server.clientsByID, client.id)
+	if client.node != nil {
+		server.clientList.Remove(client.node)
+		client.node = nil
+	}
 	server.aeloop.RemoveFileEvent(client.fd, AE_READABLE)
 	server.aeloop.RemoveFileEvent(client.fd, AE_WRITABLE)
 	freeReplyList(client)
-	Close(client.fd)
+	client.close()
 }
 func resetClient(client *GodisClient) {
 	freeArgs(client)
 	client.cmdTy = COMMAND_UNKNOWN
 	client.bulkLen = 0
 	client.bulkNum = 0
-
+	// CLIENT REPLY SKIP 只对下一条命令生效
+	client.flags &= ^CLIENT_REPLY_SKIP
+	if client.flags&CLIENT_REPLY_SKIP_NEXT != 0 {
+		client.flags |= CLIENT_REPLY_SKIP
+		client.flags &= ^CLIENT_REPLY_SKIP_NEXT
+	}
 }
 
 func (server *GodisServer) ProcessCommand(c *GodisClient) {
@@ -142,23 +752,123 @@ func (server *GodisServer) ProcessCommand(c *GodisClient) {
 	// }
 	cmd := server.lookupCommand(cmdStr)
 	if cmd == nil {
-		server.AddReplyStr(c, "-ERR: unknow command\r\n")
-		resetClient(c)
+		server.rejectCommand(c, unknownCommandError(c.args))
+		return
+	}
+	if !cmd.checkArity(len(c.args)) {
+		server.rejectCommand(c, fmt.Sprintf("-ERR wrong number of arguments for '%s' command\r\n", cmd.name))
+		return
+	}
+	if server.authRequired(c) && cmd.flags&CMD_NO_AUTH == 0 {
+		server.rejectCommand(c, "-NOAUTH Authentication required.\r\n")
+		return
+	}
+	if result, object := server.aclCheckCommandPerm(c.user, cmd, c.args); result != ACL_OK {
+		server.addACLLogEntry(c, result, object, c.user.name)
+		server.rejectCommand(c, aclDeniedReply(c.user, cmd, result))
+		return
+	}
+	// 只读的replica不接受普通客户端的写命令，master发来的命令除外
+	if server.masterhost != "" && server.replicaReadOnly && c.flags&CLIENT_MASTER == 0 {
+		if cmd.flags&CMD_WRITE != 0 {
+			server.rejectCommand(c, "-READONLY You can't write against a read only replica.\r\n")
+			return
+		}
+		// 排队时还不是replica的写命令在EXEC时拒绝
+		if cmd == server.execCmd && c.flags&CLIENT_MULTI != 0 && c.mstate.cmdFlags&CMD_WRITE != 0 {
+			server.AddReplyStr(c, "-EXECABORT Transaction discarded because of: READONLY You can't write against a read only replica.\r\n")
+			server.discardTransaction(c)
+			resetClient(c)
+			return
+		}
+	}
+	if c.flags&CLIENT_PUBSUB != 0 && c.resp == 2 && !server.isSubscribeContextCommand(cmd) {
+		server.rejectCommand(c, fmt.Sprintf("-ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n", cmd.name))
+		return
+	}
+	// 与master断开且不提供旧数据时，只能执行带stale标记的命令
+	if server.masterhost != "" && server.replState != REPL_STATE_CONNECTED && !server.replicaServeStaleData &&
+		cmd.flags&CMD_STALE == 0 {
+		server.rejectCommand(c, "-MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.\r\n")
 		return
 	}
-	if cmd.arity == 0 {
-		goto deal
+	if server.loading && cmd.flags&CMD_LOADING == 0 {
+		server.rejectCommand(c, "-LOADING Godis is loading the dataset in memory\r\n")
+		return
 	}
-	if cmd.arity != len(c.args) {
-		server.AddReplyStr(c, "-ERR: wrong number of args\r\n")
-		resetClient(c)
+	if server.isPausedForCommand(c, cmd) {
+		server.blockPostponeClient(c)
 		return
 	}
-deal:
+	if server.trackingClients > 0 {
+		server.trackingLimitUsedSlots()
+	}
+	c.lastcmd = cmd
+	if c.flags&CLIENT_MULTI != 0 && !server.isMultiControlCommand(cmd) {
+		server.queueMultiCommand(c, cmd)
+		server.AddReplyStr(c, "+QUEUED\r\n")
+	} else {
+		server.call(c, cmd)
+		// CLIENT CACHING只对下一条命令(或下一个事务)生效
+		if c.flags&CLIENT_MULTI == 0 && cmd != server.clientCmd {
+			c.flags &= ^CLIENT_TRACKING_CACHING
+		}
+	}
+	resetClient(c)
+}
+
+// rewriteClientCommandVector 以args代替客户端的参数传播，
+// call结束时恢复原来的参数，MONITOR等看到的仍是客户端发送的命令
+func rewriteClientCommandVector(c *GodisClient, args ...*GObj) {
+	if c.origArgs == nil {
+		c.origArgs = c.args
+	} else {
+		freeArgs(c)
+	}
+	c.args = args
+}
+
+// call 执行命令，c.args为命令的参数
+func (server *GodisServer) call(c *GodisClient, cmd *GodisCommand) {
+	dirty := server.dirty
 	cmd.proc(c)
+	// 修改了数据的命令传播给replica，EXEC在execCommand中传播，master发来的命令原样转发
+	if server.dirty != dirty && cmd != server.execCmd && c.flags&CLIENT_MASTER == 0 {
+		server.propagate(c.args)
+		c.woff = server.masterReplOffset
+	}
+	if c.origArgs != nil {
+		freeArgs(c)
+		c.args = c.origArgs
+		c.origArgs = nil
+	}
+	if len(server.monitors) > 0 && cmd.flags&CMD_ADMIN == 0 {
+		server.replicationFeedMonitors(c, c.args)
+	}
+	if cmd.flags&CMD_READONLY != 0 && c.flags&CLIENT_TRACKING != 0 && c.flags&CLIENT_TRACKING_BCAST == 0 {
+		server.trackingRememberKeys(c, cmd, c.args)
+	}
+}
+
+// rejectCommand 回复错误，MULTI中出错时之后的EXEC会失败
+func (server *GodisServer) rejectCommand(c *GodisClient, msg string) {
+	flagTransaction(c)
+	server.AddReplyStr(c, msg)
 	resetClient(c)
 }
 
+// unknownCommandError 与redis一致，附带前几个参数方便排查
+func unknownCommandError(args []*GObj) string {
+	var b strings.Builder
+	for _, arg := range args[1:] {
+		if b.Len() >= 128 {
+			break
+		}
+		b.WriteString(fmt.Sprintf("'%.128s' ", arg.StrVal()))
+	}
+	return fmt.Sprintf("-ERR unknown command '%.128s', with args beginning with: %s\r\n", args[0].StrVal(), b.String())
+}
+
 func (client *GodisClient) findLineInQuery() (int, error) {
 	idx := strings.Index(string(client.queryBuf[:client.queryLen]), "\r\n")
 	if idx < 0 && client.queryLen > GODIS_MAX_INLINE {
@@ -253,6 +963,12 @@ func (server *GodisServer) ProcessQueryBuf(client *GodisClient) error {
 	//log.Println("\033[1;33m", string(client.queryBuf[:client.queryLen]), "\033[0m")
 
 	for client.queryLen > 0 {
+		if client.flags&(CLIENT_CLOSE_ASAP|CLIENT_CLOSE_AFTER_REPLY) != 0 {
+			break //即将关闭，不再处理后续命令
+		}
+		if client.flags&CLIENT_BLOCKED != 0 {
+			break //阻塞结束后再处理剩余的命令
+		}
 		if client.cmdTy == COMMAND_UNKNOWN {
 			if client.queryBuf[0] == '*' {
 				client.cmdTy = COMMAND_BULK
@@ -280,20 +996,66 @@ func (server *GodisServer) ProcessQueryBuf(client *GodisClient) error {
 			} else {
 				server.ProcessCommand(client)
 			}
+			if client.flags&(CLIENT_MASTER|CLIENT_MULTI) == CLIENT_MASTER {
+				// 只有执行完的命令才计入offset，事务中排队的命令在EXEC之后计入
+				client.reploff = client.readReploff - int64(client.queryLen)
+			}
 		} else {
-			resetClient(client) //
-			break
+			break //命令不完整，保留解析状态等待后续数据
 		}
 	}
 	return nil
 }
 
+func (client *GodisClient) read(buf []byte) (int, error) {
+	if client.tls != nil {
+		return client.tls.Read(buf)
+	}
+	return Read(client.fd, buf)
+}
+
+func (client *GodisClient) write(buf []byte) (int, error) {
+	if client.tls != nil {
+		return client.tls.Write(buf)
+	}
+	return Write(client.fd, buf)
+}
+
+func (client *GodisClient) writev(bufs [][]byte) (int, error) {
+	if client.tls != nil {
+		total := 0
+		for _, buf := range bufs {
+			n, err := client.tls.Write(buf)
+			total += n
+			if err != nil {
+				if total > 0 {
+					return total, nil
+				}
+				return 0, err
+			}
+		}
+		return total, nil
+	}
+	return Writev(client.fd, bufs)
+}
+
+func (client *GodisClient) close() error {
+	if client.tls != nil {
+		return client.tls.Close()
+	}
+	return Close(client.fd)
+}
+
 func (server *GodisServer) ReadQueryFromClient(loop *AeLoop, fd int, extra interface{}) {
 	client := extra.(*GodisClient)
 	if len(client.queryBuf)-client.queryLen < GODIS_MAX_BULK {
 		client.queryBuf = append(client.queryBuf, make([]byte, GODIS_MAX_BULK)...)
 	}
-	n, err := Read(fd, client.queryBuf[client.queryLen:])
+	readLen := len(client.queryBuf) - client.queryLen
+	n, err := client.read(client.queryBuf[client.queryLen:])
+	if IsTemporary(err) {
+		return //没有数据可读，等待下一次可读事件
+	}
 	if err != nil || n == 0 {
 		log.Printf("client %v read error: %v\n", n, err)
 		server.freeClient(client)
@@ -301,6 +1063,10 @@ func (server *GodisServer) ReadQueryFromClient(loop *AeLoop, fd int, extra inter
 	}
 
 	client.queryLen += n
+	client.lastinteraction = time.Now().Unix()
+	if client.flags&CLIENT_MASTER != 0 {
+		server.masterInputReceived(client, n)
+	}
 	//log.Printf("read %v bytes from client: %v\n", n, client.fd)
 	//log.Printf("ReadQueryFromClient, queryBuf: %v\n", string(client.queryBuf))
 	err = server.ProcessQueryBuf(client)
@@ -309,36 +1075,117 @@ func (server *GodisServer) ReadQueryFromClient(loop *AeLoop, fd int, extra inter
 		server.freeClient(client)
 		return
 	}
+	if client.flags&CLIENT_MASTER != 0 {
+		server.replicationProxyMasterStream(client)
+	}
+	// tls层可能还缓存着已解密的数据，fd不会再触发可读事件，需继续读取
+	if client.tls != nil && n == readLen && server.clients[fd] == client {
+		server.ReadQueryFromClient(loop, fd, extra)
+	}
+}
+
+// collectReplyIov 收集待发送的回复，最多IOV_MAX段、limit字节，
+// 大的bulk节点直接引用不拷贝，client.buf总是排在reply链表之后
+func (client *GodisClient) collectReplyIov(limit int) [][]byte {
+	var iov [][]byte
+	total := 0
+	for node := client.reply.First(); node != nil; node = node.next {
+		if len(iov) == IOV_MAX || total >= limit {
+			return iov
+		}
+		buf := strBytes(node.val.StrVal())
+		if node == client.reply.First() {
+			buf = buf[client.sentLen:]
+		}
+		if len(buf) > limit-total {
+			buf = buf[:limit-total]
+		}
+		if len(buf) == 0 {
+			continue
+		}
+		iov = append(iov, buf)
+		total += len(buf)
+	}
+	if client.bufSent < len(client.buf) && len(iov) < IOV_MAX && total < limit {
+		buf := client.buf[client.bufSent:]
+		if len(buf) > limit-total {
+			buf = buf[:limit-total]
+		}
+		iov = append(iov, buf)
+	}
+	return iov
+}
+
+// consumeReply 从reply链表与client.buf中移除已经发送的n个字节
+func (client *GodisClient) consumeReply(n int) {
+	client.replyBytes -= int64(n)
+	for n > 0 && client.reply.Length() > 0 {
+		rep := client.reply.First()
+		remain := len(rep.val.StrVal()) - client.sentLen
+		if n < remain {
+			client.sentLen += n
+			return
+		}
+		n -= remain
+		client.reply.DelNode(rep)
+		rep.val.DecrRefCount()
+		client.sentLen = 0
+	}
+	client.bufSent += n
+	if client.bufSent == len(client.buf) {
+		client.buf = client.buf[:0]
+		client.bufSent = 0
+	}
+}
+
+func (client *GodisClient) hasPendingReplies() bool {
+	return client.reply.Length() > 0 || client.bufSent < len(client.buf)
 }
 
 func (server *GodisServer) SendReplyToClient(loop *AeLoop, fd int, extra interface{}) {
 	client := extra.(*GodisClient)
 	log.Printf("SendReplyToClient, reply len: %v\n", client.reply.Length())
-	for client.reply.Length() > 0 {
-		rep := client.reply.First()
-		buf := []byte(rep.val.StrVal())
-		bufLen := len(buf)
-		if client.sentLen < bufLen {
-			n, err := Write(fd, buf[client.sentLen:])
-			if err != nil {
-				log.Printf("send reply err: %v\n", err)
-				server.freeClient(client)
-				return
-			}
-			client.sentLen += n
-			log.Printf("send %v bytes to client: %v\n", n, client.fd)
-			if client.sentLen == bufLen {
-				client.reply.DelNode(rep)
-				rep.val.DecrRefCount()
-				client.sentLen = 0
-			} else {
-				break
-			}
+	if client.tls != nil {
+		err := client.tls.Flush()
+		if err == unix.EAGAIN {
+			return
+		}
+		if err != nil {
+			log.Printf("send reply err: %v\n", err)
+			server.freeClient(client)
+			return
 		}
 	}
-	if client.reply.Length() == 0 {
+	// 每次可写事件最多写NET_MAX_WRITES_PER_EVENT字节，避免一个客户端饿死其他客户端
+	written := 0
+	for client.hasPendingReplies() && written < NET_MAX_WRITES_PER_EVENT {
+		iov := client.collectReplyIov(NET_MAX_WRITES_PER_EVENT - written)
+		n, err := client.writev(iov)
+		server.stat_net_write_syscalls++
+		if n > 0 {
+			written += n
+			client.consumeReply(n)
+			client.lastinteraction = time.Now().Unix()
+		}
+		if err == unix.EINTR {
+			continue
+		}
+		if err == unix.EAGAIN {
+			break //socket缓冲区已满，等待下一次可写事件
+		}
+		if err != nil {
+			log.Printf("send reply err: %v\n", err)
+			server.freeClient(client)
+			return
+		}
+	}
+	log.Printf("send %v bytes to client: %v\n", written, client.fd)
+	if !client.hasPendingReplies() && (client.tls == nil || !client.tls.Pending()) {
 		client.sentLen = 0
 		loop.RemoveFileEvent(fd, AE_WRITABLE)
+		if client.flags&CLIENT_CLOSE_AFTER_REPLY != 0 {
+			server.freeClient(client)
+		}
 	}
 }
 
@@ -369,48 +1216,404 @@ func (server *GodisServer) CreateClient(fd int) *GodisClient {
 	client.fd = fd
 	client.db = server.db
 	client.queryBuf = make([]byte, GODIS_IO_BUF)
+	client.ctime = time.Now().Unix()
+	client.lastinteraction = client.ctime
+	server.nextClientId++
+	client.id = server.nextClientId
 	client.reply = ListCreate(ListType{EqualFunc: GStrEqual})
+	client.user = server.defaultUser
+	client.resp = 2
+	client.pubsubChannels = make(map[string]*list.Element)
+	client.pubsubShardChannels = make(map[string]*list.Element)
 	return &client
 }
 
+// MAX_ACCEPTS_PER_CALL 每次可读事件最多accept的连接数，避免一直accept饿死其他事件
+const MAX_ACCEPTS_PER_CALL int = 1000
+
 func (server *GodisServer) AcceptHandler(loop *AeLoop, fd int, extra interface{}) {
-	cfd, err := Accept(fd)
-	if err != nil {
-		log.Printf("accept err: %v\n", err)
+	for i := 0; i < MAX_ACCEPTS_PER_CALL; i++ {
+		cfd, ip, port, err := Accept(fd)
+		if err != nil {
+			if err != unix.EAGAIN && err != unix.EINTR {
+				log.Printf("accept err: %v\n", err)
+			}
+			return
+		}
+		server.acceptCommonHandler(cfd, ip, port, fd == server.sofd)
+	}
+}
+
+func (server *GodisServer) acceptCommonHandler(cfd int, ip string, port int, isUnix bool) {
+	if err := server.setupClientSocket(cfd, isUnix); err != nil {
+		log.Printf("setup client socket err: %v\n", err)
+		Close(cfd)
 		return
 	}
+	server.linkClient(cfd, ip, port, isUnix, nil)
+}
+
+func (server *GodisServer) setupClientSocket(cfd int, isUnix bool) error {
+	if err := SetNonBlock(cfd); err != nil {
+		return err
+	}
+	if !isUnix {
+		if err := SetTcpNoDelay(cfd); err != nil {
+			log.Printf("set client nodelay err: %v\n", err)
+		}
+		if server.tcpkeepalive > 0 {
+			if err := SetKeepAlive(cfd, server.tcpkeepalive); err != nil {
+				log.Printf("set client keepalive err: %v\n", err)
+			}
+		}
+	}
+	return nil
+}
+
+// rejectConnection 尽力发送错误信息后关闭连接，不关心是否写完
+func rejectConnection(cfd int, tc *TlsConn, msg string) {
+	if tc != nil {
+		tc.Write([]byte(msg))
+		tc.Close()
+	} else {
+		Write(cfd, []byte(msg))
+		Close(cfd)
+	}
+}
+
+// isProtectedModeDenied 保护模式下default用户没有密码时只接受本机连接
+func (server *GodisServer) isProtectedModeDenied(ip string, isUnix bool) bool {
+	if !server.protectedMode || isUnix || !server.defaultUser.nopass {
+		return false
+	}
+	addr := net.ParseIP(ip)
+	return addr == nil || !addr.IsLoopback()
+}
+
+// linkClient 为新连接创建客户端，超过maxclients时回复错误后关闭连接并返回nil
+func (server *GodisServer) linkClient(cfd int, ip string, port int, isUnix bool, tc *TlsConn) *GodisClient {
+	if len(server.clients) >= server.maxclients {
+		rejectConnection(cfd, tc, "-ERR max number of clients reached\r\n")
+		server.stat_rejected_conn++
+		log.Printf("rejected client %v: max number of clients reached\n", FormatAddr(ip, port))
+		return nil
+	}
+	if server.isProtectedModeDenied(ip, isUnix) {
+		rejectConnection(cfd, tc, PROTECTED_MODE_DENIED_MSG)
+		log.Printf("rejected client %v: protected mode\n", FormatAddr(ip, port))
+		return nil
+	}
 	client := server.CreateClient(cfd)
+	client.ip = ip
+	client.port = port
+	client.tls = tc
+	if isUnix {
+		client.addr = FormatAddr(server.unixsocket, 0)
+		client.laddr = client.addr
+	} else {
+		client.addr = FormatAddr(ip, port)
+		client.laddr = LocalAddr(cfd)
+	}
 	server.clients[cfd] = client
+	server.clientsByID[client.id] = client
+	client.node = server.clientList.PushBack(client)
 	server.aeloop.AddFileEvent(cfd, AE_READABLE, server.ReadQueryFromClient, client)
-	log.Printf("accept client, fd: %v\n", cfd)
+	log.Printf("accept client %v, fd: %v\n", client.addr, cfd)
+	return client
 }
 
 const EXPIRE_CHECK_COUNT int = 100
 
+const (
+	SERVER_CRON_HZ              int = 10 //ServerCron每100ms执行一次
+	CLIENTS_CRON_MIN_ITERATIONS int = 5
+)
+
+const DEFAULT_BIND_ADDR string = "0.0.0.0"
+
+const PROTECTED_MODE_DENIED_MSG string = "-DENIED Godis is running in protected mode because protected mode is enabled and no password is set for the default user. " +
+	"In this mode connections are only accepted from the loopback interface. " +
+	"If you want to connect from external computers, you may set a password with the requirepass option or an aclfile, " +
+	"bind to the addresses you trust and set protected-mode to \"no\" in the config file, then restart the server.\r\n"
+
+const DEFAULT_TCP_KEEPALIVE int = 300
+
+const (
+	DEFAULT_MAX_CLIENTS   int = 10000
+	MIN_RESERVED_FDS      int = 32 //监听socket、epoll、日志等使用的fd
+	MIN_MAX_CLIENTS_LIMIT int = 1
+)
+
 func (server *GodisServer) ServerCron(loop *AeLoop, id int, extra interface{}) {
-	for i := 0; i < EXPIRE_CHECK_COUNT; i++ {
+	select {
+	case sig := <-server.sigCh:
+		log.Printf("received signal %v, shutting down\n", sig)
+		server.prepareForShutdown()
+		return
+	default:
+	}
+	server.clientsCron()
+	server.checkClientPauseTimeout()
+	if server.cronloops%int64(SERVER_CRON_HZ) == 0 {
+		server.replicationCron()
+	}
+	server.cronloops++
+	// replica不主动删除过期的key，等待master传播的DEL
+	for i := 0; i < EXPIRE_CHECK_COUNT && server.pauseType == PAUSE_NONE && server.masterhost == ""; i++ {
 		entry := server.db.expire.RandomGet()
 		if entry == nil {
 			break
 		}
-		if entry.Val.IntVal() < time.Now().Unix() {
-			server.db.data.Delete(entry.Key)
-			server.db.expire.Delete(entry.Key)
+		if entry.Val.IntVal() <= GetMsTime() {
+			server.deleteExpiredKey(entry.Key)
 		}
 	}
 }
 
+// clientsCron 每次只处理一部分客户端，约一秒遍历完所有客户端
+func (server *GodisServer) clientsCron() {
+	iterations := server.clientList.Len() / SERVER_CRON_HZ
+	if iterations < CLIENTS_CRON_MIN_ITERATIONS {
+		iterations = CLIENTS_CRON_MIN_ITERATIONS
+	}
+	now := time.Now().Unix()
+	for ; iterations > 0 && server.clientList.Len() > 0; iterations-- {
+		// 把头部的客户端移到尾部，下次从下一个开始处理
+		e := server.clientList.Front()
+		server.clientList.MoveToBack(e)
+		c := e.Value.(*GodisClient)
+		server.clientsCronHandleTimeout(c, now)
+	}
+}
+
+// clientsCronHandleTimeout 关闭空闲超过timeout的客户端，replica、master、monitor、阻塞中和订阅中的客户端除外
+func (server *GodisServer) clientsCronHandleTimeout(c *GodisClient, now int64) bool {
+	if server.maxidletime == 0 || c.flags&(CLIENT_SLAVE|CLIENT_MASTER|CLIENT_MONITOR|CLIENT_BLOCKED|CLIENT_PUBSUB) != 0 {
+		return false
+	}
+	if now-c.lastinteraction <= server.maxidletime {
+		return false
+	}
+	log.Printf("closing idle client %v\n", c.addr)
+	server.freeClient(c)
+	return true
+}
+
+// adjustOpenFilesLimit 保证RLIMIT_NOFILE能容纳maxclients个连接，
+// 无法提高时按照实际可用的fd数量降低maxclients
+func (server *GodisServer) adjustOpenFilesLimit() {
+	maxfiles := uint64(server.maxclients + MIN_RESERVED_FDS)
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit); err != nil {
+		log.Printf("unable to obtain the current NOFILE limit (%v), assuming 1024 and setting the max clients configuration accordingly.\n", err)
+		server.maxclients = 1024 - MIN_RESERVED_FDS
+		return
+	}
+	if limit.Cur >= maxfiles {
+		return
+	}
+	newLimit := limit
+	newLimit.Cur = maxfiles
+	if newLimit.Cur > limit.Max {
+		newLimit.Cur = limit.Max
+	}
+	if newLimit.Cur > limit.Cur {
+		if err := unix.Setrlimit(unix.RLIMIT_NOFILE, &newLimit); err != nil {
+			newLimit.Cur = limit.Cur
+		}
+	}
+	if newLimit.Cur >= maxfiles {
+		log.Printf("increased maximum number of open files to %v (it was originally set to %v).\n", newLimit.Cur, limit.Cur)
+		return
+	}
+	old := server.maxclients
+	server.maxclients = int(newLimit.Cur) - MIN_RESERVED_FDS
+	if server.maxclients < MIN_MAX_CLIENTS_LIMIT {
+		server.maxclients = MIN_MAX_CLIENTS_LIMIT
+	}
+	log.Printf("WARNING: you requested maxclients of %v requiring at least %v max file descriptors, "+
+		"but the NOFILE limit is %v. maxclients has been reduced to %v.\n", old, maxfiles, newLimit.Cur, server.maxclients)
+}
+
 func (server *GodisServer) initServer(config *Config) error {
 	server.port = config.Port
+	server.tcpkeepalive = DEFAULT_TCP_KEEPALIVE
+	if config.TcpKeepAlive != nil {
+		server.tcpkeepalive = *config.TcpKeepAlive
+	}
+	if err := parseClientOutputBufferLimit(DEFAULT_CLIENT_OUTPUT_BUFFER_LIMIT, &server.clientObufLimits); err != nil {
+		return err
+	}
+	if err := parseClientOutputBufferLimit(config.ClientOutputBufferLimit, &server.clientObufLimits); err != nil {
+		return err
+	}
 	server.clients = make(map[int]*GodisClient)
+	server.clientsByID = make(map[int64]*GodisClient)
+	server.clientList = list.New()
+	server.pubsubChannels = make(map[string]*list.List)
+	server.pubsubPatterns = list.New()
+	server.pubsubShardChannels = [CLUSTER_SLOTS]map[string]*list.List{}
+	server.trackingTable = make(map[string]map[int64]bool)
+	server.trackingPrefixes = make(map[string]*bcastState)
+	server.trackingClients = 0
+	server.monitors = nil
+	server.replid = genReplicationId()
+	server.masterReplOffset = 0
+	server.slaves = nil
+	server.masterhost = ""
+	server.master = nil
+	server.replState = REPL_STATE_NONE
+	server.replTransferFd = -1
+	server.cronloops = 0
+	server.clearReplicationId2()
+	server.replBacklog = nil
+	server.replBacklogSize = DEFAULT_REPL_BACKLOG_SIZE
+	if config.ReplBacklogSize != "" {
+		size, err := parseMemory(config.ReplBacklogSize)
+		if err != nil {
+			return err
+		}
+		server.replBacklogSize = size
+	}
+	if server.replBacklogSize < CONFIG_REPL_BACKLOG_MIN_SIZE {
+		server.replBacklogSize = CONFIG_REPL_BACKLOG_MIN_SIZE
+	}
+	server.replBacklogIdx = 0
+	server.replBacklogHistlen = 0
+	server.replBacklogOff = 0
+	server.replicationDiscardCachedMaster()
+	if err := server.initReplicationConfig(config); err != nil {
+		return err
+	}
+	server.clientsWaitingAcks = nil
+	server.getAckFromSlaves = false
+	server.trackingTableMaxKeys = DEFAULT_TRACKING_TABLE_MAX_KEYS
+	if config.TrackingTableMaxKeys != nil {
+		server.trackingTableMaxKeys = *config.TrackingTableMaxKeys
+	}
+	server.clientsToClose = nil
+	server.maxidletime = config.Timeout
+	server.maxclients = DEFAULT_MAX_CLIENTS
+	if config.MaxClients > 0 {
+		server.maxclients = config.MaxClients
+	}
+	server.adjustOpenFilesLimit()
 	server.db = &GodisDB{
-		data:   DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
-		expire: DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
+		data:        DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
+		expire:      DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
+		watchedKeys: make(map[string]*list.List),
 	}
-	var err error
+	if err := server.populateCommandTable(config.RenameCommand); err != nil {
+		return err
+	}
+	if err := server.initAcl(config); err != nil {
+		return err
+	}
+	protectedMode, err := parseYesNo("protected-mode", config.ProtectedMode, true)
+	if err != nil {
+		return err
+	}
+	server.protectedMode = protectedMode
+	notify, err := keyspaceEventsStringToFlags(config.NotifyKeyspaceEvents)
+	if err != nil {
+		return err
+	}
+	server.notifyKeyspaceEvents = notify
 	if server.aeloop, err = AeLoopCreate(); err != nil {
 		return err
 	}
-	server.fd, err = TcpServer(server.port)
-	return err
+	server.aeloop.SetBeforeSleepProc(server.beforeSleep)
+	server.stat_starttime = time.Now().Unix()
+	server.sofd = -1
+	server.unixsocket = config.UnixSocket
+	server.bindaddr = config.Bind
+	if len(server.bindaddr) == 0 {
+		server.bindaddr = []string{DEFAULT_BIND_ADDR}
+	}
+	if server.ipfd, err = server.listenToPort(server.port); err != nil {
+		return err
+	}
+	if server.unixsocket != "" {
+		perm, err := octalPerm(config.UnixSocketPerm)
+		if err != nil {
+			return err
+		}
+		server.sofd, err = UnixServer(server.unixsocket, perm)
+		if err != nil {
+			return err
+		}
+	}
+	if config.TlsPort != 0 {
+		if err = server.initTls(config); err != nil {
+			return err
+		}
+	}
+	server.createAcceptHandlers()
+	return nil
+}
+
+func (server *GodisServer) createAcceptHandlers() {
+	for _, fd := range server.ipfd {
+		server.aeloop.AddFileEvent(fd, AE_READABLE, server.AcceptHandler, nil)
+	}
+	if server.sofd != -1 {
+		server.aeloop.AddFileEvent(server.sofd, AE_READABLE, server.AcceptHandler, nil)
+	}
+	for _, fd := range server.tlsfd {
+		server.aeloop.AddFileEvent(fd, AE_READABLE, server.AcceptTlsHandler, nil)
+	}
+	if len(server.tlsfd) > 0 {
+		server.aeloop.AddFileEvent(server.tlsWakeFds[0], AE_READABLE, server.TlsHandshakeDoneHandler, nil)
+	}
+}
+
+// listenToPort 为每个bind地址创建一个监听fd, 以'-'开头的地址在
+// 本机不可用时(如未启用ipv6)跳过而不报错
+func (server *GodisServer) listenToPort(port int) ([]int, error) {
+	var fds []int
+	for _, addr := range server.bindaddr {
+		optional := strings.HasPrefix(addr, "-")
+		addr = strings.TrimPrefix(addr, "-")
+		fd, err := TcpServer(addr, port)
+		if err != nil {
+			if optional && (errors.Is(err, unix.EADDRNOTAVAIL) || errors.Is(err, unix.EAFNOSUPPORT)) {
+				log.Printf("skip unavailable bind addr: %v\n", addr)
+				continue
+			}
+			for _, fd := range fds {
+				Close(fd)
+			}
+			return nil, fmt.Errorf("listen on %v: %w", FormatAddr(addr, port), err)
+		}
+		fds = append(fds, fd)
+	}
+	if len(fds) == 0 {
+		return nil, errors.New("no bind addr available")
+	}
+	return fds, nil
+}
+
+func (server *GodisServer) closeListeningSockets() {
+	for _, fd := range server.ipfd {
+		Close(fd)
+	}
+	server.ipfd = nil
+	for _, fd := range server.tlsfd {
+		Close(fd)
+	}
+	server.tlsfd = nil
+	if server.sofd != -1 {
+		Close(server.sofd)
+		server.sofd = -1
+	}
+	if server.unixsocket != "" {
+		if err := RemoveUnixSocket(server.unixsocket); err != nil {
+			log.Printf("remove unix socket err: %v\n", err)
+		}
+	}
+}
+
+func (server *GodisServer) prepareForShutdown() {
+	server.closeListeningSockets()
+	server.aeloop.stop = true
 }
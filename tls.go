@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// crypto/tls的握手无法在EAGAIN后继续，所以握手阶段在单独的goroutine中以
+// poll阻塞的方式完成，结束后通过管道唤醒ae循环；握手完成后fdConn切换为
+// 非阻塞模式，所有读写都回到ae循环中进行
+
+// tempError 包装EAGAIN，crypto/tls对Temporary的读错误不会记为连接失败
+type tempError struct {
+	err error
+}
+
+func (e *tempError) Error() string   { return e.err.Error() }
+func (e *tempError) Unwrap() error   { return e.err }
+func (e *tempError) Timeout() bool   { return false }
+func (e *tempError) Temporary() bool { return true }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// fdConn 把非阻塞的fd适配为crypto/tls需要的net.Conn
+type fdConn struct {
+	fd       int
+	blocking bool      //握手阶段用poll等待读写就绪
+	deadline time.Time //blocking模式下的超时时间
+	pending  []byte    //非阻塞模式下未能写出的密文
+}
+
+func (c *fdConn) wait(events int16) error {
+	timeout := time.Until(c.deadline)
+	if timeout <= 0 {
+		return timeoutError{}
+	}
+	fds := []unix.PollFd{{Fd: int32(c.fd), Events: events}}
+	n, err := unix.Poll(fds, int(timeout/time.Millisecond)+1)
+	if err != nil && err != unix.EINTR {
+		return err
+	}
+	if n == 0 && time.Until(c.deadline) <= 0 {
+		return timeoutError{}
+	}
+	return nil
+}
+
+func (c *fdConn) Read(b []byte) (int, error) {
+	for {
+		n, err := Read(c.fd, b)
+		if err == nil && n == 0 {
+			return 0, io.EOF
+		}
+		if err == nil {
+			return n, nil
+		}
+		if !IsTemporary(err) {
+			return 0, err
+		}
+		if !c.blocking {
+			return 0, &tempError{err}
+		}
+		if err = c.wait(unix.POLLIN); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *fdConn) Write(b []byte) (int, error) {
+	if c.blocking {
+		written := 0
+		for written < len(b) {
+			n, err := Write(c.fd, b[written:])
+			if n > 0 {
+				written += n
+			}
+			if err != nil && !IsTemporary(err) {
+				return written, err
+			}
+			if err != nil {
+				if err = c.wait(unix.POLLOUT); err != nil {
+					return written, err
+				}
+			}
+		}
+		return written, nil
+	}
+	// 非阻塞模式下写不完的部分先缓存，由SendReplyToClient在可写时继续发送，
+	// 保证crypto/tls看不到EAGAIN
+	rest := b
+	if len(c.pending) == 0 {
+		n, err := Write(c.fd, b)
+		if err != nil && !IsTemporary(err) {
+			return 0, err
+		}
+		if n > 0 {
+			rest = b[n:]
+		}
+	}
+	c.pending = append(c.pending, rest...)
+	return len(b), nil
+}
+
+func (c *fdConn) flush() error {
+	for len(c.pending) > 0 {
+		n, err := Write(c.fd, c.pending)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		c.pending = c.pending[n:]
+	}
+	c.pending = nil
+	return nil
+}
+
+func (c *fdConn) Close() error                       { return Close(c.fd) }
+func (c *fdConn) LocalAddr() net.Addr                { return nil }
+func (c *fdConn) RemoteAddr() net.Addr               { return nil }
+func (c *fdConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fdConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fdConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type TlsConn struct {
+	raw  *fdConn
+	conn *tls.Conn
+}
+
+// Read 尽量读满buf，直到底层fd返回EAGAIN
+func (c *TlsConn) Read(b []byte) (int, error) {
+	total := 0
+	for total < len(b) {
+		n, err := c.conn.Read(b[total:])
+		total += n
+		if err != nil {
+			if total > 0 {
+				return total, nil //错误会在下一次Read时再次返回
+			}
+			var te *tempError
+			if errors.As(err, &te) {
+				return 0, te.err
+			}
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// Write 在上一次的密文还没发完时返回EAGAIN，否则整个buf都会被接收
+func (c *TlsConn) Write(b []byte) (int, error) {
+	if err := c.Flush(); err != nil {
+		return 0, err
+	}
+	return c.conn.Write(b)
+}
+
+func (c *TlsConn) Flush() error {
+	err := c.raw.flush()
+	if IsTemporary(err) {
+		return unix.EAGAIN
+	}
+	return err
+}
+
+func (c *TlsConn) Pending() bool {
+	return len(c.raw.pending) > 0
+}
+
+func (c *TlsConn) Close() error {
+	c.conn.Close()
+	return nil
+}
+
+type tlsHandshake struct {
+	fd   int
+	ip   string
+	port int
+	conn *TlsConn
+	err  error
+}
+
+func loadTlsConfig(config *Config) (*tls.Config, error) {
+	if config.TlsCertFile == "" || config.TlsKeyFile == "" {
+		return nil, errors.New("tls-cert-file and tls-key-file are required for tls-port")
+	}
+	cert, err := tls.LoadX509KeyPair(config.TlsCertFile, config.TlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch config.TlsAuthClients {
+	case "", "no":
+		tlsConfig.ClientAuth = tls.NoClientCert
+	case "yes":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("invalid tls-auth-clients: %v", config.TlsAuthClients)
+	}
+	if config.TlsCaCertFile != "" {
+		pem, err := os.ReadFile(config.TlsCaCertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", config.TlsCaCertFile)
+		}
+		tlsConfig.ClientCAs = pool
+	} else if tlsConfig.ClientAuth != tls.NoClientCert {
+		return nil, errors.New("tls-ca-cert-file is required to verify client certificates")
+	}
+	return tlsConfig, nil
+}
+
+func (server *GodisServer) initTls(config *Config) error {
+	var err error
+	if server.tlsConfig, err = loadTlsConfig(config); err != nil {
+		return err
+	}
+	if server.tlsfd, err = server.listenToPort(config.TlsPort); err != nil {
+		return err
+	}
+	if err = unix.Pipe2(server.tlsWakeFds[:], unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		return err
+	}
+	server.tlsDone = make(chan *tlsHandshake, BACKLOG)
+	server.tlsPending = 0
+	return nil
+}
+
+func (server *GodisServer) AcceptTlsHandler(loop *AeLoop, fd int, extra interface{}) {
+	for i := 0; i < MAX_ACCEPTS_PER_CALL; i++ {
+		cfd, ip, port, err := Accept(fd)
+		if err != nil {
+			if err != unix.EAGAIN && err != unix.EINTR {
+				log.Printf("accept err: %v\n", err)
+			}
+			return
+		}
+		if err = server.setupClientSocket(cfd, false); err != nil {
+			log.Printf("setup client socket err: %v\n", err)
+			Close(cfd)
+			continue
+		}
+		// 握手中的连接也计入maxclients，避免大量慢握手占用无限的goroutine与fd
+		if len(server.clients)+server.tlsPending >= server.maxclients {
+			Close(cfd)
+			server.stat_rejected_conn++
+			log.Printf("rejected client %v: max number of clients reached\n", FormatAddr(ip, port))
+			continue
+		}
+		server.tlsPending++
+		raw := &fdConn{fd: cfd, blocking: true, deadline: time.Now().Add(TLS_HANDSHAKE_TIMEOUT)}
+		tc := &TlsConn{raw: raw, conn: tls.Server(raw, server.tlsConfig)}
+		go server.tlsHandshake(&tlsHandshake{fd: cfd, ip: ip, port: port, conn: tc})
+	}
+}
+
+// tlsHandshake 在goroutine中执行，只访问自己的连接，结果交回ae循环处理
+func (server *GodisServer) tlsHandshake(hs *tlsHandshake) {
+	hs.err = hs.conn.conn.Handshake()
+	server.tlsDone <- hs
+	Write(server.tlsWakeFds[1], []byte{0})
+}
+
+func (server *GodisServer) TlsHandshakeDoneHandler(loop *AeLoop, fd int, extra interface{}) {
+	buf := make([]byte, 64)
+	for {
+		if _, err := Read(fd, buf); err != nil {
+			break
+		}
+	}
+	for {
+		select {
+		case hs := <-server.tlsDone:
+			server.tlsPending--
+			if hs.err != nil {
+				log.Printf("tls handshake with %v err: %v\n", FormatAddr(hs.ip, hs.port), hs.err)
+				Close(hs.fd)
+				continue
+			}
+			hs.conn.raw.blocking = false
+			server.linkClient(hs.fd, hs.ip, hs.port, false, hs.conn)
+		default:
+			return
+		}
+	}
+}
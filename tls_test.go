@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// genCert 生成证书，parent为nil时生成自签名的CA
+func genCert(t *testing.T, cn string, parent *testCert, isServer bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		if isServer {
+			tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+			tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		} else {
+			tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) writePem(t *testing.T, dir, name string) (string, string) {
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600))
+	assert.Nil(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certPath, keyPath
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTls(t *testing.T) {
+	dir := t.TempDir()
+	ca := genCert(t, "godis-ca", nil, false)
+	srv := genCert(t, "godis-server", ca, true)
+	cli := genCert(t, "godis-client", ca, false)
+	caPath, _ := ca.writePem(t, dir, "ca")
+	certPath, keyPath := srv.writePem(t, dir, "server")
+
+	conf := Config{
+		Bind:           []string{"127.0.0.1"},
+		TlsPort:        6670,
+		TlsCertFile:    certPath,
+		TlsKeyFile:     keyPath,
+		TlsCaCertFile:  caPath,
+		TlsAuthClients: "yes",
+	}
+	assert.Nil(t, server.initServer(&conf))
+	// 由事件循环自己设置stop，避免与AeMain并发读写
+	stop, done := make(chan struct{}), make(chan struct{})
+	server.aeloop.AddTimeEvent(AE_NORMAL, 10, func(loop *AeLoop, id int, extra interface{}) {
+		select {
+		case <-stop:
+			loop.stop = true
+		default:
+		}
+	}, nil)
+	go func() {
+		server.aeloop.AeMain()
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+		server.closeListeningSockets()
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// 没有客户端证书时握手失败
+	conn, err := tls.Dial("tcp", "127.0.0.1:6670", &tls.Config{RootCAs: roots})
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(time.Second))
+		_, err = conn.Write([]byte("get key\r\n"))
+		if err == nil {
+			_, err = bufio.NewReader(conn).ReadString('\n')
+		}
+		conn.Close()
+	}
+	assert.NotNil(t, err)
+
+	conn, err = tls.Dial("tcp", "127.0.0.1:6670", &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{cli.tlsCert()},
+	})
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	_, err = conn.Write([]byte("set key val\r\n"))
+	assert.Nil(t, err)
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "+OK\r\n", line)
+
+	// 大于一个tls record的请求和回复
+	val := strings.Repeat("v", GODIS_MAX_BULK-1)
+	for i := 0; i < 8; i++ {
+		_, err = conn.Write([]byte("*3\r\n$3\r\nset\r\n$3\r\nbig\r\n$4095\r\n" + val + "\r\n"))
+		assert.Nil(t, err)
+	}
+	_, err = conn.Write([]byte(strings.Repeat("get big\r\n", 32)))
+	assert.Nil(t, err)
+	for i := 0; i < 8; i++ {
+		line, err = reader.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "+OK\r\n", line)
+	}
+	for i := 0; i < 32; i++ {
+		line, err = reader.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "$4095\r\n", line)
+		line, err = reader.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, val+"\r\n", line)
+	}
+}
+
+func TestTlsHandshakeLimit(t *testing.T) {
+	dir := t.TempDir()
+	ca := genCert(t, "godis-ca", nil, false)
+	srv := genCert(t, "godis-server", ca, true)
+	certPath, keyPath := srv.writePem(t, dir, "server")
+	conf := Config{
+		Bind:        []string{"127.0.0.1"},
+		TlsPort:     6671,
+		TlsCertFile: certPath,
+		TlsKeyFile:  keyPath,
+	}
+	assert.Nil(t, server.initServer(&conf))
+	defer server.closeListeningSockets()
+	server.maxclients = 1
+
+	// 不发起握手的连接
+	slow, err := net.Dial("tcp", "127.0.0.1:6671")
+	assert.Nil(t, err)
+	processEventsUntil(t, func() bool { return server.tlsPending == 1 })
+	// 握手中的连接计入maxclients，新连接直接关闭
+	rejected := server.stat_rejected_conn
+	conn, err := net.Dial("tcp", "127.0.0.1:6671")
+	assert.Nil(t, err)
+	defer conn.Close()
+	processEventsUntil(t, func() bool { return server.stat_rejected_conn == rejected+1 })
+	conn.SetDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 1, server.tlsPending)
+
+	// 握手失败后释放名额
+	slow.Close()
+	processEventsUntil(t, func() bool { return server.tlsPending == 0 })
+	assert.Equal(t, 0, len(server.clients))
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	TRACKING_CHANNEL_NAME           string = "__redis__:invalidate"
+	DEFAULT_TRACKING_TABLE_MAX_KEYS int    = 1000000
+	TRACKING_EVICTION_EFFORT        int    = 100 //每次最多淘汰的key数量
+)
+
+// bcastState BCAST模式下一个prefix的订阅者，以及本轮事件循环中被修改的key
+type bcastState struct {
+	keys    map[string]*GodisClient //key -> 修改它的客户端，用于NOLOOP
+	clients map[*GodisClient]bool
+}
+
+func (server *GodisServer) lookupClientByID(id int64) *GodisClient {
+	return server.clientsByID[id]
+}
+
+// CLIENT TRACKING ON|OFF [REDIRECT id] [PREFIX prefix [PREFIX prefix ...]] [BCAST] [OPTIN] [OPTOUT] [NOLOOP]
+func (server *GodisServer) clientTrackingCommand(c *GodisClient) {
+	var redirect int64
+	var prefixes []string
+	options := 0
+	for i := 3; i < len(c.args); i++ {
+		opt := strings.ToLower(c.args[i].StrVal())
+		moreArgs := i+1 < len(c.args)
+		switch {
+		case opt == "redirect" && moreArgs:
+			if redirect != 0 {
+				server.AddReplyStr(c, "-ERR A client can only redirect to a single other client\r\n")
+				return
+			}
+			id, err := strconv.ParseInt(c.args[i+1].StrVal(), 10, 64)
+			if err != nil {
+				server.AddReplyStr(c, "-ERR value is not an integer or out of range\r\n")
+				return
+			}
+			redirect = id
+			i++
+		case opt == "bcast":
+			options |= CLIENT_TRACKING_BCAST
+		case opt == "optin":
+			options |= CLIENT_TRACKING_OPTIN
+		case opt == "optout":
+			options |= CLIENT_TRACKING_OPTOUT
+		case opt == "noloop":
+			options |= CLIENT_TRACKING_NOLOOP
+		case opt == "prefix" && moreArgs:
+			prefixes = append(prefixes, c.args[i+1].StrVal())
+			i++
+		default:
+			server.AddReplyStr(c, "-ERR syntax error\r\n")
+			return
+		}
+	}
+
+	switch strings.ToLower(c.args[2].StrVal()) {
+	case "on":
+		if !server.checkTrackingOptions(c, options, redirect, prefixes) {
+			return
+		}
+		server.enableTracking(c, redirect, options, prefixes)
+	case "off":
+		server.disableTracking(c)
+	default:
+		server.AddReplyStr(c, "-ERR syntax error\r\n")
+		return
+	}
+	server.AddReplyStr(c, "+OK\r\n")
+}
+
+// checkTrackingOptions 不合法时回复错误并返回false
+func (server *GodisServer) checkTrackingOptions(c *GodisClient, options int, redirect int64, prefixes []string) bool {
+	if options&CLIENT_TRACKING_BCAST == 0 && len(prefixes) > 0 {
+		server.AddReplyStr(c, "-ERR PREFIX option requires BCAST mode to be enabled\r\n")
+		return false
+	}
+	if c.flags&CLIENT_TRACKING != 0 {
+		if (options^c.flags)&CLIENT_TRACKING_BCAST != 0 {
+			server.AddReplyStr(c, "-ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.\r\n")
+			return false
+		}
+		if (options^c.flags)&(CLIENT_TRACKING_OPTIN|CLIENT_TRACKING_OPTOUT) != 0 {
+			server.AddReplyStr(c, "-ERR You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, and then re-enabling it with a different mode.\r\n")
+			return false
+		}
+	}
+	if options&CLIENT_TRACKING_OPTIN != 0 && options&CLIENT_TRACKING_OPTOUT != 0 {
+		server.AddReplyStr(c, "-ERR You can't use both OPTIN and OPTOUT\r\n")
+		return false
+	}
+	if options&CLIENT_TRACKING_BCAST != 0 && options&(CLIENT_TRACKING_OPTIN|CLIENT_TRACKING_OPTOUT) != 0 {
+		server.AddReplyStr(c, "-ERR OPTIN and OPTOUT are not compatible with BCAST\r\n")
+		return false
+	}
+	if redirect != 0 && server.lookupClientByID(redirect) == nil {
+		server.AddReplyStr(c, "-ERR The client ID you want redirect to does not exist\r\n")
+		return false
+	}
+	// 同一个客户端的prefix之间不能有包含关系，否则会收到重复的通知
+	all := append(append([]string(nil), c.trackingPrefixes...), prefixes...)
+	for i := range all {
+		for j := i + 1; j < len(all); j++ {
+			if strings.HasPrefix(all[i], all[j]) || strings.HasPrefix(all[j], all[i]) {
+				server.AddReplyStr(c, fmt.Sprintf("-ERR Prefix '%s' overlaps with an existing prefix '%s'. Prefixes for a single client must not overlap.\r\n", all[j], all[i]))
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (server *GodisServer) enableTracking(c *GodisClient, redirect int64, options int, prefixes []string) {
+	if c.flags&CLIENT_TRACKING == 0 {
+		server.trackingClients++
+	}
+	c.flags |= CLIENT_TRACKING
+	c.flags &= ^(CLIENT_TRACKING_BROKEN_REDIR | CLIENT_TRACKING_BCAST | CLIENT_TRACKING_OPTIN |
+		CLIENT_TRACKING_OPTOUT | CLIENT_TRACKING_NOLOOP | CLIENT_TRACKING_CACHING)
+	c.flags |= options
+	c.trackingRedirect = redirect
+	if options&CLIENT_TRACKING_BCAST == 0 {
+		return
+	}
+	if len(prefixes) == 0 && len(c.trackingPrefixes) == 0 {
+		prefixes = []string{""} //没有prefix时接收所有key的通知
+	}
+	for _, prefix := range prefixes {
+		bs := server.trackingPrefixes[prefix]
+		if bs == nil {
+			bs = &bcastState{keys: make(map[string]*GodisClient), clients: make(map[*GodisClient]bool)}
+			server.trackingPrefixes[prefix] = bs
+		}
+		bs.clients[c] = true
+		c.trackingPrefixes = append(c.trackingPrefixes, prefix)
+	}
+}
+
+// disableTracking 已记录在trackingTable中的客户端id在key被修改时跳过
+func (server *GodisServer) disableTracking(c *GodisClient) {
+	if c.flags&CLIENT_TRACKING == 0 {
+		return
+	}
+	for _, prefix := range c.trackingPrefixes {
+		bs := server.trackingPrefixes[prefix]
+		delete(bs.clients, c)
+		if len(bs.clients) == 0 {
+			delete(server.trackingPrefixes, prefix)
+		}
+	}
+	c.trackingPrefixes = nil
+	c.trackingRedirect = 0
+	c.flags &= ^(CLIENT_TRACKING | CLIENT_TRACKING_BROKEN_REDIR | CLIENT_TRACKING_BCAST | CLIENT_TRACKING_OPTIN |
+		CLIENT_TRACKING_OPTOUT | CLIENT_TRACKING_NOLOOP | CLIENT_TRACKING_CACHING)
+	server.trackingClients--
+}
+
+// CLIENT CACHING YES|NO 只对下一条命令生效
+func (server *GodisServer) clientCachingCommand(c *GodisClient) {
+	if c.flags&CLIENT_TRACKING == 0 || c.flags&(CLIENT_TRACKING_OPTIN|CLIENT_TRACKING_OPTOUT) == 0 {
+		server.AddReplyStr(c, "-ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled\r\n")
+		return
+	}
+	switch strings.ToLower(c.args[2].StrVal()) {
+	case "yes":
+		if c.flags&CLIENT_TRACKING_OPTIN == 0 {
+			server.AddReplyStr(c, "-ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.\r\n")
+			return
+		}
+	case "no":
+		if c.flags&CLIENT_TRACKING_OPTOUT == 0 {
+			server.AddReplyStr(c, "-ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.\r\n")
+			return
+		}
+	default:
+		server.AddReplyStr(c, "-ERR syntax error\r\n")
+		return
+	}
+	c.flags |= CLIENT_TRACKING_CACHING
+	server.AddReplyStr(c, "+OK\r\n")
+}
+
+// CLIENT GETREDIR 没有开启tracking时返回-1
+func (server *GodisServer) clientGetredirCommand(c *GodisClient) {
+	if c.flags&CLIENT_TRACKING == 0 {
+		server.AddReplyStr(c, ":-1\r\n")
+		return
+	}
+	server.AddReplyStr(c, fmt.Sprintf(":%d\r\n", c.trackingRedirect))
+}
+
+// trackingRememberKeys 记录客户端读过的key，key被修改时通知它
+func (server *GodisServer) trackingRememberKeys(c *GodisClient, cmd *GodisCommand, args []*GObj) {
+	optin := c.flags&CLIENT_TRACKING_OPTIN != 0
+	optout := c.flags&CLIENT_TRACKING_OPTOUT != 0
+	caching := c.flags&CLIENT_TRACKING_CACHING != 0
+	if (optin && !caching) || (optout && caching) {
+		return
+	}
+	for _, i := range getKeysFromCommand(cmd, args) {
+		key := args[i].StrVal()
+		ids := server.trackingTable[key]
+		if ids == nil {
+			ids = make(map[int64]bool)
+			server.trackingTable[key] = ids
+		}
+		ids[c.id] = true
+	}
+}
+
+// sendTrackingMessage RESP3直接推送，RESP2只能通过REDIRECT发送到订阅了__redis__:invalidate的客户端
+func (server *GodisServer) sendTrackingMessage(c *GodisClient, keys []string) {
+	target := c
+	usingRedirect := c.trackingRedirect != 0
+	if usingRedirect {
+		target = server.lookupClientByID(c.trackingRedirect)
+		if target == nil {
+			// 只通知一次
+			if c.flags&CLIENT_TRACKING_BROKEN_REDIR == 0 {
+				c.flags |= CLIENT_TRACKING_BROKEN_REDIR
+				if c.resp == 3 {
+					server.addReplyPush(c, 2, fmt.Sprintf("$21\r\ntracking-redir-broken\r\n:%d\r\n", c.trackingRedirect))
+				}
+			}
+			return
+		}
+	}
+	if target.resp == 3 {
+		server.addReplyPush(target, 2, "$10\r\ninvalidate\r\n"+addReplyBulkArray(keys))
+	} else if usingRedirect && target.flags&CLIENT_PUBSUB != 0 {
+		server.addReplyPush(target, 3, "$7\r\nmessage\r\n"+bulkString(TRACKING_CHANNEL_NAME)+addReplyBulkArray(keys))
+	}
+}
+
+// trackingInvalidateKey key被修改或过期，c为修改它的客户端，可能为nil
+// bcast为false时不通知BCAST客户端，用于trackingTable的淘汰
+func (server *GodisServer) trackingInvalidateKey(c *GodisClient, key string, bcast bool) {
+	for prefix, bs := range server.trackingPrefixes {
+		if bcast && strings.HasPrefix(key, prefix) {
+			bs.keys[key] = c
+		}
+	}
+	ids := server.trackingTable[key]
+	if ids == nil {
+		return
+	}
+	delete(server.trackingTable, key)
+	for id := range ids {
+		target := server.lookupClientByID(id)
+		if target == nil || target.flags&CLIENT_TRACKING == 0 || target.flags&CLIENT_TRACKING_BCAST != 0 {
+			continue
+		}
+		if target == c && target.flags&CLIENT_TRACKING_NOLOOP != 0 {
+			continue
+		}
+		server.sendTrackingMessage(target, []string{key})
+	}
+}
+
+// trackingBroadcastInvalidationMessages 在beforeSleep中把本轮修改的key发送给BCAST客户端
+func (server *GodisServer) trackingBroadcastInvalidationMessages() {
+	for _, bs := range server.trackingPrefixes {
+		if len(bs.keys) == 0 {
+			continue
+		}
+		for c := range bs.clients {
+			var keys []string
+			for key, modifier := range bs.keys {
+				if modifier == c && c.flags&CLIENT_TRACKING_NOLOOP != 0 {
+					continue
+				}
+				keys = append(keys, key)
+			}
+			if len(keys) > 0 {
+				sort.Strings(keys)
+				server.sendTrackingMessage(c, keys)
+			}
+		}
+		bs.keys = make(map[string]*GodisClient)
+	}
+}
+
+// trackingLimitUsedSlots trackingTable超过tracking-table-max-keys时淘汰一部分key，并通知客户端
+func (server *GodisServer) trackingLimitUsedSlots() {
+	if server.trackingTableMaxKeys == 0 {
+		return
+	}
+	effort := TRACKING_EVICTION_EFFORT
+	for key := range server.trackingTable {
+		if len(server.trackingTable) <= server.trackingTableMaxKeys || effort == 0 {
+			return
+		}
+		server.trackingInvalidateKey(nil, key, false)
+		effort--
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientTracking(t *testing.T) {
+	var conf Config
+	assert.Nil(t, server.initServer(&conf))
+	var clients []*GodisClient
+	for i := 0; i < 3; i++ {
+		clients = append(clients, newTestClient(t, "", 0))
+	}
+	c, redir, writer := clients[0], clients[1], clients[2]
+	invalidate := func(keys ...string) string {
+		return "*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n" + addReplyBulkArray(keys)
+	}
+
+	assert.Equal(t, ":-1\r\n", runQuery(t, c, "client getredir\r\n"))
+	assert.Equal(t, "-ERR The client ID you want redirect to does not exist\r\n", runQuery(t, c, "client tracking on redirect 1000\r\n"))
+	assert.Equal(t, "-ERR PREFIX option requires BCAST mode to be enabled\r\n", runQuery(t, c, "client tracking on prefix a\r\n"))
+	assert.Equal(t, "-ERR You can't use both OPTIN and OPTOUT\r\n", runQuery(t, c, "client tracking on optin optout\r\n"))
+	assert.Equal(t, "-ERR OPTIN and OPTOUT are not compatible with BCAST\r\n", runQuery(t, c, "client tracking on bcast optin\r\n"))
+	assert.Contains(t, runQuery(t, c, "client tracking on bcast prefix a prefix ab\r\n"), "overlaps")
+	assert.Equal(t, "-ERR syntax error\r\n", runQuery(t, c, "client tracking on foo\r\n"))
+
+	// RESP2通过REDIRECT接收失效通知
+	runQuery(t, redir, "subscribe __redis__:invalidate\r\n")
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, fmt.Sprintf("client tracking on redirect %d\r\n", redir.id)))
+	assert.Equal(t, fmt.Sprintf(":%d\r\n", redir.id), runQuery(t, c, "client getredir\r\n"))
+	assert.Equal(t, "$-1\r\n$-1\r\n", runQuery(t, c, "get k1\r\nget k2\r\n"))
+	assert.Equal(t, 2, len(server.trackingTable))
+	runQuery(t, writer, "set k1 v\r\n")
+	assert.Equal(t, invalidate("k1"), takeReply(redir))
+	assert.Equal(t, 1, len(server.trackingTable))
+	runQuery(t, writer, "set k1 v2\r\n")
+	assert.Equal(t, "", takeReply(redir)) //没有再次读取，不会重复通知
+
+	// 过期也会发送失效通知
+	server.db.data.Set(CreateObject(GSTR, "k2"), CreateObject(GSTR, "v"))
+	server.db.expire.Set(CreateObject(GSTR, "k2"), CreateFromInt(GetMsTime()-1))
+	server.ServerCron(server.aeloop, 0, nil)
+	assert.Equal(t, invalidate("k2"), takeReply(redir))
+
+	// NOLOOP不通知自己的修改
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, fmt.Sprintf("client tracking on redirect %d noloop\r\n", redir.id)))
+	runQuery(t, c, "get k1\r\nset k1 v3\r\n")
+	assert.Equal(t, "", takeReply(redir))
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "client tracking off\r\n"))
+	assert.Equal(t, 0, server.trackingClients)
+
+	// OPTIN只记录CLIENT CACHING YES之后的命令
+	assert.Contains(t, runQuery(t, c, "client caching yes\r\n"), "-ERR CLIENT CACHING can be called only")
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, fmt.Sprintf("client tracking on redirect %d optin\r\n", redir.id)))
+	assert.Equal(t, "-ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.\r\n", runQuery(t, c, "client caching no\r\n"))
+	runQuery(t, c, "get a\r\nclient caching yes\r\nget b\r\nget c\r\n")
+	runQuery(t, writer, "set a 1\r\nset b 1\r\nset c 1\r\n")
+	assert.Equal(t, invalidate("b"), takeReply(redir))
+	assert.Contains(t, runQuery(t, c, "client tracking on bcast\r\n"), "You can't switch BCAST mode")
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "client tracking off\r\n"))
+
+	// BCAST在beforeSleep中批量发送匹配prefix的key
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, fmt.Sprintf("client tracking on redirect %d bcast prefix user: prefix order:\r\n", redir.id)))
+	runQuery(t, writer, "set user:1 a\r\nset other b\r\nset order:1 c\r\nset user:2 d\r\n")
+	server.beforeSleep(server.aeloop)
+	reply := takeReply(redir) //prefix之间的顺序不确定
+	assert.Contains(t, reply, invalidate("order:1"))
+	assert.Contains(t, reply, invalidate("user:1", "user:2"))
+	assert.Equal(t, len(invalidate("order:1")+invalidate("user:1", "user:2")), len(reply))
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "client tracking off\r\n"))
+	assert.Equal(t, 0, len(server.trackingPrefixes))
+
+	// REDIRECT的客户端断开
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, fmt.Sprintf("client tracking on redirect %d\r\n", redir.id)))
+	runQuery(t, c, "get k1\r\n")
+	assert.Equal(t, redir, server.lookupClientByID(redir.id))
+	server.freeClient(redir)
+	assert.Nil(t, server.lookupClientByID(redir.id))
+	runQuery(t, writer, "set k1 v\r\n")
+	assert.NotEqual(t, 0, c.flags&CLIENT_TRACKING_BROKEN_REDIR)
+
+	server.freeClient(c)
+	server.freeClient(writer)
+}
+
+func TestClientTrackingResp3(t *testing.T) {
+	conf := Config{TrackingTableMaxKeys: new(int)}
+	*conf.TrackingTableMaxKeys = 2
+	assert.Nil(t, server.initServer(&conf))
+	c := newTestClient(t, "", 0)
+
+	runQuery(t, c, "hello 3\r\n")
+	assert.Equal(t, "+OK\r\n", runQuery(t, c, "client tracking on\r\n"))
+	assert.Equal(t, "$-1\r\n", runQuery(t, c, "get k\r\n"))
+	assert.Equal(t, ">2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\nk\r\n+OK\r\n", runQuery(t, c, "set k v\r\n")) //失效通知先于命令的回复
+
+	// 超过tracking-table-max-keys时淘汰key并通知
+	runQuery(t, c, "get a\r\nget b\r\nget c\r\n")
+	assert.Equal(t, 3, len(server.trackingTable))
+	reply := runQuery(t, c, "ping\r\n")
+	assert.Contains(t, reply, ">2\r\n$10\r\ninvalidate\r\n*1\r\n")
+	assert.Equal(t, 2, len(server.trackingTable))
+
+	// RESP3下订阅模式不限制命令
+	runQuery(t, c, "subscribe ch\r\n")
+	assert.Equal(t, "$1\r\nv\r\n", runQuery(t, c, "get k\r\n"))
+	server.freeClient(c)
+}
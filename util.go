@@ -0,0 +1,107 @@
+package main
+
+func toLowerByte(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+
+func equalByte(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLowerByte(a) == toLowerByte(b)
+	}
+	return a == b
+}
+
+// stringMatch redis风格的glob匹配，支持 * ? [abc] [^a-z] 以及 \ 转义。
+// 不匹配时只回溯到最近的一个*，复杂度为O(len(pattern)*len(str))，不会因为多个*指数级回溯
+func stringMatch(pattern, str string, nocase bool) bool {
+	p, s := 0, 0
+	starP, starS := -1, 0 //最近一个*之后的pattern位置，以及*当前匹配到的str位置
+	for {
+		if p == len(pattern) {
+			if s == len(str) {
+				return true
+			}
+		} else if pattern[p] == '*' {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			if p == len(pattern) {
+				return true
+			}
+			starP, starS = p, s
+			continue
+		} else if n := matchOneByte(pattern[p:], str, s, nocase); n > 0 {
+			p += n
+			s++
+			continue
+		}
+		// 不匹配，让最近的*多匹配一个字符
+		if starP < 0 || starS >= len(str) {
+			return false
+		}
+		starS++
+		p, s = starP, starS
+	}
+}
+
+// matchOneByte 用pattern开头的一项(? [...] \x 或普通字符)匹配str[s]，
+// 返回这一项在pattern中的长度，不匹配时返回0
+func matchOneByte(pattern, str string, s int, nocase bool) int {
+	if s >= len(str) {
+		return 0
+	}
+	switch pattern[0] {
+	case '?':
+		return 1
+	case '[':
+		p := 1
+		not := p < len(pattern) && pattern[p] == '^'
+		if not {
+			p++
+		}
+		match := false
+		for p < len(pattern) && pattern[p] != ']' {
+			if pattern[p] == '\\' && p+1 < len(pattern) {
+				p++
+				match = match || equalByte(pattern[p], str[s], nocase)
+			} else if p+2 < len(pattern) && pattern[p+1] == '-' {
+				start, end, c := pattern[p], pattern[p+2], str[s]
+				if nocase {
+					start, end, c = toLowerByte(start), toLowerByte(end), toLowerByte(c)
+				}
+				if start > end {
+					start, end = end, start
+				}
+				match = match || (c >= start && c <= end)
+				p += 2
+			} else {
+				match = match || equalByte(pattern[p], str[s], nocase)
+			}
+			p++
+		}
+		if not {
+			match = !match
+		}
+		if !match {
+			return 0
+		}
+		if p < len(pattern) {
+			p++ //跳过]
+		}
+		return p
+	case '\\':
+		if len(pattern) > 1 {
+			if equalByte(pattern[1], str[s], nocase) {
+				return 2
+			}
+			return 0
+		}
+	}
+	if equalByte(pattern[0], str[s], nocase) {
+		return 1
+	}
+	return 0
+}